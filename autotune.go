@@ -0,0 +1,158 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"log"
+	"time"
+)
+
+var autoTune = flag.Bool("auto-tune", false, "Start replaying INSERT statements on one connection and adjust how many run concurrently, up to -workers (8 if not set), to the throughput, latency, errors and lock waits observed on the target; the statements themselves, and so -batch, are not tuned")
+
+// autoTuneWorkers is the most connections -auto-tune uses if -workers is
+// not set.
+const autoTuneWorkers = 8
+
+// tuneInterval is how long the tuner observes each concurrency level.
+const tuneInterval = 10 * time.Second
+
+// maxWorkers returns the number of connections of a parallel replay.
+func maxWorkers() int {
+	if *autoTune && *workers <= 1 {
+		return autoTuneWorkers
+	}
+	return *workers
+}
+
+// tuner adjusts the number of concurrent INSERT statements by hill
+// climbing: it keeps moving the limit in the same direction while the
+// throughput improves, and turns back when it drops or the target
+// shows signs of contention: row lock waits, failing statements, or a
+// latency that rose well beyond what the throughput gained.
+//
+// Only the time during which concurrent statements run counts, so that
+// the other statements of the dump, such as CREATE TABLE, which run
+// alone, do not weigh on the throughput observed.
+type tuner struct {
+	db         *sql.DB
+	limit, max int
+	// direction is +1 or -1.
+	direction int
+
+	// active counts the concurrent statements running; busy is the time
+	// some ran in the current window, up to activeSince.
+	active      int
+	activeSince time.Time
+	busy        time.Duration
+
+	bytes       int64
+	latency     time.Duration
+	n, errors   int
+	lockWaits   int64
+	prevRate    float64
+	prevLatency time.Duration
+}
+
+func newTuner(db *sql.DB, max int) *tuner {
+	t := &tuner{db: db, limit: 1, max: max, direction: 1}
+	t.lockWaits, _ = t.rowLockWaits()
+	return t
+}
+
+// begin records that a concurrent statement started.
+func (t *tuner) begin() {
+	if t.active == 0 {
+		t.activeSince = time.Now()
+	}
+	t.active++
+}
+
+// observe records that a concurrent statement of size bytes took d and
+// failed with err, if not nil.
+func (t *tuner) observe(size int, d time.Duration, err error) {
+	now := time.Now()
+	t.busy += now.Sub(t.activeSince)
+	t.activeSince = now
+	t.active--
+	t.latency += d
+	t.n++
+	if err != nil {
+		t.errors++
+	} else {
+		t.bytes += int64(size)
+	}
+	if t.busy >= tuneInterval {
+		t.adjust()
+	}
+}
+
+// adjust moves the limit at the end of an observation window.
+func (t *tuner) adjust() {
+	rate := float64(t.bytes) / t.busy.Seconds()
+	var latency time.Duration
+	if t.n > 0 {
+		latency = t.latency / time.Duration(t.n)
+	}
+	waits, err := t.rowLockWaits()
+	locked := err == nil && waits-t.lockWaits > int64(t.n)/10
+	t.lockWaits = waits
+	failing := t.errors > t.n/100
+	// More concurrency queues statements on the target: worth it only
+	// if the throughput grows with the latency.
+	slower := t.prevLatency > 0 && t.prevRate > 0 &&
+		float64(latency)/float64(t.prevLatency) > 1.5*rate/t.prevRate
+	contended := locked || failing || slower
+
+	prev := t.limit
+	switch {
+	case contended:
+		t.direction = -1
+	case rate < t.prevRate*0.95:
+		// Worse: turn back, or down if the limit was held.
+		if t.direction == 0 {
+			t.direction = -1
+		} else {
+			t.direction = -t.direction
+		}
+	case rate < t.prevRate*1.05:
+		// No clear change: stay.
+		t.direction = 0
+	case t.direction == 0:
+		t.direction = 1
+	}
+	t.limit += t.direction
+	if t.limit < 1 {
+		t.limit = 1
+	}
+	if t.limit > t.max {
+		t.limit = t.max
+	}
+	log.Printf("auto-tune: %.0f bytes/s, %dms average latency, %d of %d statements failed, contended %v: %d -> %d concurrent statements",
+		rate, latency/time.Millisecond, t.errors, t.n, contended, prev, t.limit)
+
+	t.prevRate, t.prevLatency = rate, latency
+	t.busy, t.bytes, t.latency, t.n, t.errors = 0, 0, 0, 0, 0
+}
+
+// rowLockWaits returns how many times the target waited on a row lock.
+func (t *tuner) rowLockWaits() (int64, error) {
+	var name string
+	var n int64
+	err := t.db.QueryRow("SHOW GLOBAL STATUS LIKE 'Innodb_row_lock_waits'").Scan(&name, &n)
+	return n, err
+}
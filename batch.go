@@ -0,0 +1,131 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"log"
+	"os"
+	"time"
+)
+
+var batchSize = flag.Int("batch", 1, "Execute up to this many consecutive INSERT and REPLACE statements in a single round trip, inside a transaction (without -workers)")
+
+// batchedStmt is a statement held in the batch, between start and pos
+// of the dump.
+type batchedStmt struct {
+	stmt       []byte
+	start, pos int64
+}
+
+// batching is set by run, whose loop executes the last batch and only
+// checkpoints past executed ones.
+var batching bool
+
+// batch holds the statements not executed yet.
+var batch struct {
+	stmts []batchedStmt
+	bytes int
+}
+
+// batchable reports whether stmt is to be executed as part of a batch.
+func batchable(stmt []byte) bool {
+	if !batching {
+		return false
+	}
+	kind := classify(stmt).Kind
+	return kind == "INSERT" || kind == "REPLACE"
+}
+
+// batchPending reports whether statements are waiting in the batch, in
+// which case the checkpoint must not move past them.
+func batchPending() bool {
+	return len(batch.stmts) > 0
+}
+
+// addToBatch adds stmt, between start and pos of a dump of the given
+// size, to the batch, executing the batch if it is full.
+func addToBatch(db *target, stmt []byte, start, pos, size int64) error {
+	if packetLimit > 0 && batch.bytes+len(stmt) > packetLimit {
+		if err := flushBatch(db, size); err != nil {
+			return err
+		}
+	}
+	batch.stmts = append(batch.stmts, batchedStmt{append([]byte(nil), stmt...), start, pos})
+	batch.bytes += len(stmt) + 1
+	if len(batch.stmts) < *batchSize {
+		return nil
+	}
+	return flushBatch(db, size)
+}
+
+// flushBeforeHalt executes the batch, if any, and saves the checkpoint
+// past it to logFile, before the import stops, pauses or is
+// interrupted at start; otherwise the batched statements, which precede
+// start, would be skipped on resume without having been executed.
+func flushBeforeHalt(db *target, logFile *os.File, start, size int64) error {
+	if !batchPending() {
+		return nil
+	}
+	if err := flushBatch(db, size); err != nil {
+		return err
+	}
+	progress.complete(progress.pos, start)
+	if err := save(logFile, logLine{Position: progress.pos, Done: progress.done}); err != nil {
+		log.Fatalf("Error saving to log: %v", err)
+	}
+	return nil
+}
+
+// flushBatch executes the statements of the batch in a single round
+// trip, within a transaction. If that fails, the transaction is rolled
+// back and the statements executed one at a time, to find the one that
+// fails and handle its error as usual.
+func flushBatch(db *target, size int64) error {
+	stmts := batch.stmts
+	if len(stmts) == 0 {
+		return nil
+	}
+	batch.stmts, batch.bytes = nil, 0
+
+	var b bytes.Buffer
+	b.WriteString("START TRANSACTION;\n")
+	for _, s := range stmts {
+		b.Write(s.stmt)
+		b.WriteByte('\n')
+	}
+	b.WriteString("COMMIT;")
+	waitTurn(len(stmts), b.Len())
+	t := time.Now()
+	err := db.execBatch(b.String())
+	d := time.Since(t) / time.Duration(len(stmts))
+	if err == nil {
+		for _, s := range stmts {
+			logStatement(s.stmt, s.start, s.pos, size, d, nil)
+			trackStatement(s.stmt, s.start, s.pos, d, nil)
+		}
+		return nil
+	}
+
+	log.Printf("batch of %d statements failed, executing them one at a time: %v", len(stmts), err)
+	for _, s := range stmts {
+		if err := executeNow(db, s.stmt, s.start, s.pos, size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
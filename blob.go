@@ -0,0 +1,36 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"log"
+
+	"github.com/GoogleCloudPlatform/cloudsql-import/importer"
+)
+
+// binaryWarned is whether the replay warned of raw binary data.
+var binaryWarned bool
+
+// warnBinary warns, once per run, that the statement last read by r
+// holds raw binary data in a string, as dumps made without --hex-blob
+// do.
+func warnBinary(r *importer.Reader, size int64) {
+	if binaryWarned || !r.Binary() {
+		return
+	}
+	binaryWarned = true
+	log.Printf("%s the statement at offset %d holds raw binary data in a string, as in a dump made without --hex-blob; it is sent byte for byte, but -rewrite rules may mangle it, and a dump made with --hex-blob is safer", progressMark(r.Pos, size), r.Start)
+}
@@ -0,0 +1,82 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"strings"
+)
+
+// exitBreakpoint is the exit status of an import paused at a breakpoint.
+const exitBreakpoint = 3
+
+var (
+	breakAtTable stringList
+	breakMatch   regexpList
+
+	// breaksHit holds the breakpoints that already paused the import.
+	breaksHit = map[string]bool{}
+)
+
+func init() {
+	flag.Var(&breakAtTable, "break-at-table", "Pause the import before the first statement on this table (may be repeated; \"db.table\" or \"table\")")
+	flag.Var(&breakMatch, "break-match", "Pause the import before the first statement matching this regular expression (may be repeated)")
+}
+
+// breakpoint returns the name of the first breakpoint that stmt hits
+// and that has not paused the import yet, or "" if there is none.
+func breakpoint(stmt []byte) string {
+	if len(breakAtTable) > 0 {
+		info := classify(stmt)
+		for _, t := range breakAtTable {
+			name := "table=" + t
+			if breaksHit[name] || info.Table == "" {
+				continue
+			}
+			db := info.Database
+			if db == "" {
+				db = currentDatabase
+			}
+			if t == info.Table || db != "" && t == db+"."+info.Table {
+				return name
+			}
+		}
+	}
+	for _, re := range breakMatch {
+		name := "match=" + re.String()
+		if breaksHit[name] {
+			continue
+		}
+		if re.Match(stmt) {
+			return name
+		}
+	}
+	return ""
+}
+
+// pause records in logFile that the breakpoint name paused the import
+// before the statement starting at pos, and exits.
+func pause(logFile *os.File, pos int64, name string) {
+	flushLog()
+	if err := save(logFile, logLine{Position: pos, Break: name}); err != nil {
+		log.Fatalf("Error saving to log: %v", err)
+	}
+	recordRun("paused", pos, nil)
+	log.Printf("paused at breakpoint %s, offset %d; run the same command again to resume", strings.Replace(name, "=", " ", 1), pos)
+	os.Exit(exitBreakpoint)
+}
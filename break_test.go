@@ -0,0 +1,43 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import "testing"
+
+func TestBreakAtTableAfterUse(t *testing.T) {
+	defer func(l stringList) { breakAtTable, currentDatabase = l, "" }(breakAtTable)
+	breakAtTable = stringList{"shop.orders"}
+
+	dump := []struct {
+		stmt string
+		want string
+	}{
+		{"USE `blog`;", ""},
+		{"INSERT INTO `orders` VALUES (1);", ""},
+		{"USE `shop`;", ""},
+		{"CREATE TABLE `customers` (`id` int);", ""},
+		{"INSERT INTO `orders` VALUES (1);", "table=shop.orders"},
+	}
+	for _, d := range dump {
+		stmt := rewrite([]byte(d.stmt))
+		if stmt == nil {
+			t.Fatalf("rewrite(%q) skipped the statement", d.stmt)
+		}
+		if got := breakpoint(stmt); got != d.want {
+			t.Errorf("breakpoint(%q) after %q = %q, want %q", d.stmt, "USE "+currentDatabase, got, d.want)
+		}
+	}
+}
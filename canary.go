@@ -0,0 +1,162 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"flag"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/GoogleCloudPlatform/cloudsql-import/importer"
+)
+
+var (
+	canaryDsn   = flag.String("canary-dsn", "", "Data source name of a scratch instance to import the dump into first; the import into -dsn only starts if that import succeeds")
+	canaryBytes byteSize
+)
+
+func init() {
+	flag.Var(&canaryBytes, "canary-bytes", "With -canary-dsn, only import the statements within this many bytes of the start of the dump into the scratch instance (e.g. 1GB; default the whole dump)")
+}
+
+const (
+	// canaryEnv is set in the environment of the canary import.
+	canaryEnv = "CLOUDSQL_IMPORT_CANARY"
+	// canaryDSNEnv passes -canary-dsn to the canary import as its -dsn,
+	// keeping the password off its command line, which ps shows.
+	canaryDSNEnv = "CLOUDSQL_IMPORT_CANARY_DSN"
+)
+
+// canaryFlags are the flags the canary import does not inherit, as they
+// name the target or its credentials, or files, addresses and
+// notifications shared with the import into -dsn.
+var canaryFlags = map[string]bool{
+	"dump":              true,
+	"dsn":               true,
+	"failover_dsn":      true,
+	"instance":          true,
+	"cloudsql-instance": true,
+	"socket":            true,
+	"user":              true,
+	"database":          true,
+	"prompt":            true,
+	"password-env":      true,
+	"password-file":     true,
+	"vault-path":        true,
+	"canary-dsn":        true,
+	"canary-bytes":      true,
+	"checkpoint":        true,
+	"tee":               true,
+	"changed-only":      true,
+	"error-report":      true,
+	"failure-report":    true,
+	"summary-file":      true,
+	"metrics-addr":      true,
+	"status-addr":       true,
+	"notify-url":        true,
+	"history":           true,
+}
+
+// useCanaryDSN sets -dsn to the scratch instance in the canary import.
+func useCanaryDSN() {
+	if s := os.Getenv(canaryDSNEnv); s != "" && os.Getenv(canaryEnv) != "" {
+		*dsn = s
+	}
+}
+
+// importCanary imports the dump f, of the given size, into -canary-dsn
+// with the other flags of this import, checks such as -verify and
+// -verify-sample included, in a child process. The child runs in the
+// current directory, where the relative paths of the flags lead, but
+// keeps its checkpoint log and failure report in a scratch directory.
+// It exits if the canary import fails, keeping the directory for
+// diagnosis. Resumed imports, whose target was already written to, skip
+// it.
+func importCanary(f *dumpFile, size int64) {
+	if _, err := os.Stat(checkpointName(*dump)); err == nil {
+		log.Printf("canary: resuming an import, skipping the canary import")
+		return
+	}
+	addSecret(dsnPassword(*canaryDsn))
+	dir, err := ioutil.TempDir("", "cloudsql-import-canary")
+	if err != nil {
+		log.Fatalf("canary: %v", err)
+	}
+	dumpPath := *dump
+	if !isRemoteDump(dumpPath) {
+		if dumpPath, err = filepath.Abs(dumpPath); err != nil {
+			log.Fatalf("canary: %v", err)
+		}
+	}
+	drop := canaryFlags
+	if canaryBytes > 0 && (size < 0 || int64(canaryBytes) < size) {
+		dumpPath = filepath.Join(dir, filepath.Base(*dump))
+		if err := writeDumpPrefix(dumpPath, f, int64(canaryBytes)); err != nil {
+			log.Fatalf("canary: %v", err)
+		}
+		// The source tables hold more rows than the prefix inserts, so
+		// -verify=rowcount counts those of the prefix instead.
+		drop = map[string]bool{"verify-source-dsn": true}
+		for name := range canaryFlags {
+			drop[name] = true
+		}
+	}
+
+	log.Printf("canary: importing %s into the scratch instance, keeping its checkpoint log in %s", dumpPath, dir)
+	base := filepath.Base(*dump)
+	args := append(dropFlags(os.Args[1:], drop), "-dump", dumpPath, "-history", "",
+		"-checkpoint", filepath.Join(dir, base+".log"), "-failure-report", filepath.Join(dir, base+".failure.txt"))
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), canaryEnv+"=1", canaryDSNEnv+"="+*canaryDsn)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		log.Fatalf("canary: the import into the scratch instance failed, not importing into -dsn; see %s: %v", dir, err)
+	}
+	os.RemoveAll(dir)
+	log.Printf("canary: the import into the scratch instance succeeded")
+}
+
+// writeDumpPrefix writes the statements of the dump f that end within
+// limit bytes of its start to name.
+func writeDumpPrefix(name string, f *dumpFile, limit int64) error {
+	sr := newStmtReader(io.NewSectionReader(f, 0, limit), 0)
+	end := int64(0)
+	for {
+		_, err := sr.Next()
+		if err != nil {
+			// The statement cut by limit reads as one that is not
+			// terminated.
+			if err != io.EOF && err != importer.ErrTruncated && err != importer.ErrUnterminated {
+				return err
+			}
+			break
+		}
+		end = sr.Pos
+	}
+	out, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, io.NewSectionReader(f, 0, end)); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
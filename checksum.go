@@ -0,0 +1,175 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+)
+
+// checksumResult compares a table of the source with its copy on the
+// target, in the report of the verify subcommand.
+type checksumResult struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+	// The checksums are nil for a table missing from the server.
+	SourceChecksum *int64 `json:"source_checksum"`
+	TargetChecksum *int64 `json:"target_checksum"`
+	// Status is "match", "mismatch", "missing" when the target lacks the
+	// table, or "error".
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// checksumReport is the report of the verify subcommand.
+type checksumReport struct {
+	Tables     []checksumResult `json:"tables"`
+	Mismatches int              `json:"mismatches"`
+}
+
+// verifyCmd implements "cloudsql-import verify -source-dsn=... -dsn=...",
+// which compares the CHECKSUM TABLE of every table of the source with
+// that of its copy on the target, and writes a JSON report. It exits
+// with status 1 if some differ.
+func verifyCmd(args []string) {
+	fs := subcommandFlags("verify")
+	sourceDSN := fs.String("source-dsn", "", "MySQL Data Source Name of the server the dump was taken from (default -verify-source-dsn)")
+	out := fs.String("out", "", "File the JSON report is written to (default the standard output)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s verify [flags] -source-dsn=DSN -dsn=DSN\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if len(parseInterspersed(fs, args)) != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *sourceDSN == "" {
+		*sourceDSN = *verifySourceDSN
+	}
+	if *sourceDSN == "" {
+		log.Fatalf("verify: no -source-dsn")
+	}
+	addSecret(dsnPassword(*sourceDSN))
+	source, err := sql.Open("mysql", *sourceDSN)
+	if err != nil {
+		log.Fatalf("verify: -source-dsn: %v", err)
+	}
+	defer source.Close()
+	db := connect()
+	defer db.close()
+
+	tables, err := sourceTables(source)
+	if err != nil {
+		log.Fatalf("verify: list the tables of the source: %v", err)
+	}
+	if *targetDB != "" && len(tables) > 0 && tables[0][0] != tables[len(tables)-1][0] {
+		log.Fatalf("verify: -target-db: the source holds several databases; select one with -databases")
+	}
+	report := checksumReport{Tables: []checksumResult{}}
+	for _, t := range tables {
+		database, table := t[0], t[1]
+		r := checksumResult{Source: qualifiedName(database, table)}
+		if *targetDB != "" {
+			database = *targetDB
+		}
+		if new, ok := renameTable[table]; ok {
+			table = new
+		}
+		r.Target = qualifiedName(database, table)
+		if r.SourceChecksum, err = checksumTable(source, r.Source); err == nil {
+			r.TargetChecksum, err = checksumTable(db.db, r.Target)
+		}
+		switch {
+		case err != nil:
+			r.Status, r.Error = "error", err.Error()
+		case r.TargetChecksum == nil:
+			r.Status = "missing"
+		case r.SourceChecksum == nil || *r.SourceChecksum != *r.TargetChecksum:
+			r.Status = "mismatch"
+		default:
+			r.Status = "match"
+		}
+		if r.Status != "match" {
+			report.Mismatches++
+			log.Printf("%s: %s %s", r.Source, r.Status, r.Error)
+		}
+		report.Tables = append(report.Tables, r)
+	}
+
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		log.Fatalf("verify: %v", err)
+	}
+	b = append(b, '\n')
+	if *out == "" {
+		os.Stdout.Write(b)
+	} else if err := ioutil.WriteFile(*out, b, 0644); err != nil {
+		log.Fatalf("verify: %v", err)
+	}
+	log.Printf("%d of %d tables differ", report.Mismatches, len(report.Tables))
+	if report.Mismatches > 0 {
+		os.Exit(1)
+	}
+}
+
+// systemDatabases are the databases of the server itself, which are
+// not compared.
+var systemDatabases = []string{"mysql", "information_schema", "performance_schema", "sys"}
+
+// sourceTables returns the database and name of the base tables of db
+// that -databases, -include-tables and -exclude-tables select, ordered
+// by database.
+func sourceTables(db *sql.DB) ([][2]string, error) {
+	rows, err := db.Query("SELECT TABLE_SCHEMA, TABLE_NAME FROM information_schema.TABLES WHERE TABLE_TYPE = 'BASE TABLE' AND TABLE_SCHEMA NOT IN ('" +
+		strings.Join(systemDatabases, "', '") + "') ORDER BY TABLE_SCHEMA, TABLE_NAME")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tables [][2]string
+	for rows.Next() {
+		var database, table string
+		if err := rows.Scan(&database, &table); err != nil {
+			return nil, err
+		}
+		if !databaseSelected(database) ||
+			len(includeTables) > 0 && !matchTable(includeTables, database, table) ||
+			matchTable(excludeTables, database, table) {
+			continue
+		}
+		tables = append(tables, [2]string{database, table})
+	}
+	return tables, rows.Err()
+}
+
+// checksumTable returns the CHECKSUM TABLE of name on db, or nil if the
+// table does not exist.
+func checksumTable(db *sql.DB, name string) (*int64, error) {
+	var table string
+	var sum sql.NullInt64
+	if err := db.QueryRow("CHECKSUM TABLE "+name).Scan(&table, &sum); err != nil {
+		return nil, err
+	}
+	if !sum.Valid {
+		return nil, nil
+	}
+	return &sum.Int64, nil
+}
@@ -0,0 +1,121 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var chunkSize byteSize
+
+func init() {
+	flag.Var(&chunkSize, "chunk-size", "Split the -tee or transform output into numbered files of at most this size (e.g. 1GB)")
+}
+
+// chunkWriter writes to a sequence of numbered files, name.001.ext,
+// name.002.ext and so on, starting a new file whenever a write would
+// push the current one past limit. Each Write is expected to hold whole
+// statements, so that no statement is split across two files.
+type chunkWriter struct {
+	base, ext string
+	limit     int64
+	n         int
+	f         *os.File
+	size      int64
+}
+
+// newChunkWriter creates a chunkWriter for the output file name. When
+// resume is true, writing continues at the end of the last existing
+// chunk; otherwise the chunks of an earlier run are removed.
+func newChunkWriter(name string, limit int64, resume bool) (*chunkWriter, error) {
+	ext := filepath.Ext(name)
+	w := &chunkWriter{base: strings.TrimSuffix(name, ext), ext: ext, limit: limit}
+	for {
+		if _, err := os.Stat(w.chunkName(w.n + 1)); err != nil {
+			break
+		}
+		w.n++
+	}
+	if resume && w.n > 0 {
+		w.n--
+		return w, w.open(os.O_WRONLY | os.O_APPEND)
+	}
+	for ; w.n > 0; w.n-- {
+		if err := os.Remove(w.chunkName(w.n)); err != nil {
+			return nil, err
+		}
+	}
+	return w, w.open(os.O_WRONLY | os.O_TRUNC)
+}
+
+func (w *chunkWriter) chunkName(n int) string {
+	return fmt.Sprintf("%s.%03d%s", w.base, n, w.ext)
+}
+
+func (w *chunkWriter) open(mode int) error {
+	w.n++
+	f, err := os.OpenFile(w.chunkName(w.n), os.O_CREATE|mode, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.f, w.size = f, fi.Size()
+	return nil
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	if w.size > 0 && w.size+int64(len(p)) > w.limit {
+		if err := w.f.Close(); err != nil {
+			return 0, err
+		}
+		if err := w.open(os.O_WRONLY | os.O_TRUNC); err != nil {
+			return 0, err
+		}
+	}
+	if int64(len(p)) > w.limit {
+		log.Printf("statement of %d bytes exceeds -chunk-size, writing it alone to %q", len(p), w.f.Name())
+	}
+	n, err := w.f.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *chunkWriter) Close() error {
+	return w.f.Close()
+}
+
+// createOutput opens the file that transformed statements are written
+// to, split into chunks when -chunk-size is set. When resume is true,
+// output is appended to what a previous run already wrote.
+func createOutput(name string, resume bool) (io.WriteCloser, error) {
+	if chunkSize > 0 {
+		return newChunkWriter(name, int64(chunkSize), resume)
+	}
+	mode := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if !resume {
+		mode |= os.O_TRUNC
+	}
+	return os.OpenFile(name, mode, 0644)
+}
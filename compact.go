@@ -0,0 +1,96 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"compress/gzip"
+	"os"
+)
+
+// logCompactSize is how many bytes are appended to the checkpoint log
+// before it is rewritten with only the current state, so that it does
+// not grow with the number of statements of the dump.
+const logCompactSize = 16 << 20
+
+// The checkpoint log opened by openLog is rewritten by compactLog to a
+// new file, which replaces it under its name. Callers keep the file
+// openLog returned; writes to it go to its replacement.
+var (
+	openedLog, replacedLog *os.File
+	openedName             string
+	// openedState is the state the log holds, and logWritten how much
+	// was appended to it since it was last rewritten.
+	openedState *checkpoint
+	logWritten  int64
+)
+
+// trackLog starts tracking the checkpoint log f, opened as name and
+// holding the state cp, for compaction.
+func trackLog(f *os.File, name string, cp *checkpoint) {
+	if replacedLog != nil {
+		replacedLog.Close()
+	}
+	state := *cp
+	state.Breaks = map[string]bool{}
+	for b := range cp.Breaks {
+		state.Breaks[b] = true
+	}
+	openedLog, replacedLog, openedName, openedState, logWritten = f, nil, name, &state, 0
+}
+
+// liveLog returns the file that writes to the checkpoint log f go to.
+func liveLog(f *os.File) *os.File {
+	if f == openedLog && replacedLog != nil {
+		return replacedLog
+	}
+	return f
+}
+
+// logged records that the log line ll, of n bytes, was appended to the
+// checkpoint log f, and compacts the log if it grew large enough.
+func logged(f *os.File, ll *logLine, n int) error {
+	if f != openedLog {
+		return nil
+	}
+	openedState.apply(ll)
+	if logWritten += int64(n); logWritten < logCompactSize {
+		return nil
+	}
+	return compactLog()
+}
+
+// compactLog rewrites the checkpoint log with only its current state.
+// The new file is renamed over the log, so that a crash leaves either.
+func compactLog() error {
+	if err := closeLog(openedLog); err != nil {
+		return err
+	}
+	if err := rewriteLog(openedName, openedState); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(openedName, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if *compressLog {
+		logGzip = gzip.NewWriter(f)
+	}
+	if replacedLog != nil {
+		replacedLog.Close()
+	}
+	replacedLog, logWritten = f, 0
+	return nil
+}
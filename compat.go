@@ -0,0 +1,211 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"flag"
+	"io"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	generatedColumns = choiceFlag("generated-columns", "keep", "How to create generated columns; plain makes them ordinary columns holding the dumped values, for targets that reject their expression or the values inserted into them", "keep", "plain")
+	compatRewrites   = flag.Bool("compat-rewrites", false, "Enable the rewrites fixing the known incompatibilities between the server the dump was taken from and the target")
+	sridPolicy       = choiceFlag("srid", "keep", "How to create spatial columns with an SRID attribute; strip removes it, for targets older than MySQL 8.0", "keep", "strip")
+)
+
+var (
+	generatedPrefix = regexp.MustCompile(`(?i)\s+(?:GENERATED\s+ALWAYS\s+)?AS\s*$`)
+	generatedSuffix = regexp.MustCompile(`(?i)^\s*(?:VIRTUAL|STORED|PERSISTENT)\b`)
+	sridAttribute   = regexp.MustCompile(`(?i)\s*(?:/\*!\d*\s*SRID\s+\d+\s*\*/|\bSRID\s+\d+)`)
+)
+
+// rewriteColumns applies the -generated-columns and -srid policies to
+// the column definitions of the CREATE TABLE statement stmt, which
+// mysqldump writes one per line.
+func rewriteColumns(stmt []byte) []byte {
+	if *generatedColumns == "keep" && *sridPolicy == "keep" || classify(stmt).Kind != "CREATE TABLE" {
+		return stmt
+	}
+	lines := bytes.Split(stmt, []byte("\n"))
+	for i, line := range lines {
+		if !bytes.HasPrefix(bytes.TrimSpace(line), []byte("`")) {
+			continue
+		}
+		if *generatedColumns == "plain" {
+			line = removeGenerated(line)
+		}
+		if *sridPolicy == "strip" {
+			line = sridAttribute.ReplaceAll(line, nil)
+		}
+		lines[i] = line
+	}
+	return bytes.Join(lines, []byte("\n"))
+}
+
+// removeGenerated removes the GENERATED ALWAYS AS (...) clause of the
+// column definition line, leaving an ordinary column.
+func removeGenerated(line []byte) []byte {
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '\'', '"', '`':
+			if i = closingQuote(line, i); i < 0 {
+				return line
+			}
+		case '(':
+			m := generatedPrefix.FindIndex(line[:i])
+			if m == nil {
+				continue
+			}
+			start := m[0]
+			end := closingParen(line, i)
+			if end < 0 {
+				return line
+			}
+			if m := generatedSuffix.FindIndex(line[end:]); m != nil {
+				end += m[1]
+			}
+			return append(append([]byte(nil), line[:start]...), line[end:]...)
+		}
+	}
+	return line
+}
+
+// serverVersion is the version of a MySQL or MariaDB server.
+type serverVersion struct {
+	raw          string
+	major, minor int
+	mariaDB      bool
+}
+
+var versionPattern = regexp.MustCompile(`^(\d+)\.(\d+)`)
+
+func parseVersion(s string) serverVersion {
+	v := serverVersion{raw: s, mariaDB: strings.Contains(strings.ToLower(s), "mariadb")}
+	if m := versionPattern.FindStringSubmatch(s); m != nil {
+		v.major, _ = strconv.Atoi(m[1])
+		v.minor, _ = strconv.Atoi(m[2])
+	}
+	return v
+}
+
+// before reports whether v is a MySQL version older than major.minor.
+func (v serverVersion) before(major, minor int) bool {
+	return !v.mariaDB && (v.major < major || v.major == major && v.minor < minor)
+}
+
+func (v serverVersion) String() string {
+	if v.mariaDB {
+		return "MariaDB " + v.raw
+	}
+	return "MySQL " + v.raw
+}
+
+var (
+	dumpProgramHeader = regexp.MustCompile(`^-- (?:MySQL|MariaDB) dump \S+\s+Distrib (\S+?),`)
+	serverHeader      = regexp.MustCompile(`^-- Server version\s+(\S+)`)
+)
+
+// dumpVersions returns the versions of mysqldump and of the server that
+// the dump r was taken from, as its header comments give them.
+func dumpVersions(r io.Reader) (program, server string) {
+	s := bufio.NewScanner(io.LimitReader(r, 4096))
+	for s.Scan() {
+		if m := dumpProgramHeader.FindStringSubmatch(s.Text()); m != nil {
+			program = m[1]
+		}
+		if m := serverHeader.FindStringSubmatch(s.Text()); m != nil {
+			server = m[1]
+		}
+	}
+	return program, server
+}
+
+// incompatibility is a known problem importing a dump taken from the
+// server src into the server dst.
+type incompatibility struct {
+	applies func(src, dst serverVersion) bool
+	problem string
+	// rewrite enables the rewrite fixing the problem, if there is one,
+	// and describes it.
+	rewrite func() string
+}
+
+func downgrade(src, dst serverVersion) bool {
+	return !src.before(8, 0) && dst.before(8, 0)
+}
+
+func upgrade(src, dst serverVersion) bool {
+	return src.before(8, 0) && !dst.before(8, 0)
+}
+
+var incompatibilities = []incompatibility{
+	{downgrade, "MySQL 8.0 defaults to the utf8mb4_0900_ai_ci collation, which older servers do not know", nil},
+	{downgrade, "spatial columns may have an SRID attribute, which older servers reject", func() string {
+		if *sridPolicy == "keep" {
+			*sridPolicy = "strip"
+		}
+		return "-srid=" + *sridPolicy
+	}},
+	{upgrade, "MySQL 8.0 removed the NO_AUTO_CREATE_USER sql_mode, which dumps of stored routines and triggers set", enable80Rewrites},
+	{upgrade, "words reserved since MySQL 8.0, such as RANK, GROUPS, LATERAL and WINDOW, must be quoted in views, triggers and routines", enable80Rewrites},
+	{upgrade, "the default character set changed from latin1 to utf8mb4, which tables that do not specify theirs will use", nil},
+	{func(src, dst serverVersion) bool { return src.mariaDB && !dst.mariaDB },
+		"MariaDB dumps may use syntax that MySQL rejects, such as PERSISTENT generated columns and sequences", nil},
+}
+
+func enable80Rewrites() string {
+	*mysql80Rewrites = true
+	return "-mysql80-rewrites"
+}
+
+// checkCompatibility compares the versions of the server the dump r was
+// taken from and of the target, warns about the known
+// incompatibilities between them and, with -compat-rewrites, enables
+// the rewrites fixing them.
+func checkCompatibility(db *sql.DB, r io.Reader) {
+	program, server := dumpVersions(r)
+	if server == "" {
+		log.Printf("compatibility: the dump does not say which server it was taken from")
+		return
+	}
+	var version string
+	if err := db.QueryRow("SELECT VERSION()").Scan(&version); err != nil {
+		log.Printf("compatibility: cannot query the target version: %v", err)
+		return
+	}
+	src, dst := parseVersion(server), parseVersion(version)
+	log.Printf("compatibility: dump of %s by mysqldump %s, target %s", src, program, dst)
+	for _, inc := range incompatibilities {
+		if !inc.applies(src, dst) {
+			continue
+		}
+		switch {
+		case inc.rewrite == nil:
+			log.Printf("WARNING: %s", inc.problem)
+		case *compatRewrites:
+			log.Printf("WARNING: %s; rewriting with %s", inc.problem, inc.rewrite())
+		default:
+			log.Printf("WARNING: %s; see -compat-rewrites", inc.problem)
+		}
+	}
+}
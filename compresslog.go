@@ -0,0 +1,164 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"flag"
+	"io"
+	"os"
+	"time"
+)
+
+var compressLog = flag.Bool("compress-log", false, "Write the checkpoint log gzip-compressed")
+
+// logGzip compresses the checkpoint log with -compress-log.
+var logGzip *gzip.Writer
+
+// logFlushInterval is how often the compressed checkpoint log is
+// flushed. Flushing it after every line would make it larger than a
+// plain log, so a crash may lose the checkpoints of up to this long,
+// whose statements are then replayed again, as in a parallel replay.
+const logFlushInterval = time.Second
+
+var lastLogFlush time.Time
+
+// logReader returns a reader of the contents of the checkpoint log r,
+// and whether it is compressed.
+func logReader(r io.Reader) (io.Reader, bool, error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); len(magic) < 2 || magic[0] != 0x1f || magic[1] != 0x8b {
+		return br, false, nil
+	}
+	zr, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, false, err
+	}
+	return zr, true, nil
+}
+
+// writeLog appends b to the checkpoint log f and syncs it. With
+// -compress-log, b is compressed, and only flushed and synced if force
+// is set or logFlushInterval elapsed.
+func writeLog(f *os.File, b []byte, force bool) error {
+	f = liveLog(f)
+	if logGzip == nil {
+		if _, err := f.Write(b); err != nil {
+			return err
+		}
+		return f.Sync()
+	}
+	if _, err := logGzip.Write(b); err != nil {
+		return err
+	}
+	if !force && time.Since(lastLogFlush) < logFlushInterval {
+		return nil
+	}
+	lastLogFlush = time.Now()
+	if err := logGzip.Flush(); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// closeLog ends the compressed stream of the checkpoint log f.
+func closeLog(f *os.File) error {
+	f = liveLog(f)
+	if logGzip == nil {
+		return nil
+	}
+	if err := logGzip.Close(); err != nil {
+		return err
+	}
+	logGzip = nil
+	return f.Sync()
+}
+
+// openLog opens the checkpoint log name, from which cp was recovered,
+// for appending. A compressed log cannot be appended plain lines, nor a
+// plain log compressed ones, and a compressed stream cut short by the
+// end of a previous run cannot be continued. So unless the log is and
+// remains plain, it is first rewritten with only the state of cp.
+func openLog(name string, cp *checkpoint) (*os.File, error) {
+	if cp.compressed || cp.found && *compressLog {
+		if err := rewriteLog(name, cp); err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if *compressLog {
+		// A new gzip member, which readers concatenate to the previous.
+		logGzip = gzip.NewWriter(f)
+	}
+	if encryptionEnabled() && logCipher == nil {
+		if err := writeLogHeader(f); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	trackLog(f, name, cp)
+	return f, nil
+}
+
+// rewriteLog replaces the checkpoint log name with one holding only the
+// state of cp.
+func rewriteLog(name string, cp *checkpoint) error {
+	tmp := name + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if *compressLog {
+		logGzip = gzip.NewWriter(f)
+	}
+	if encryptionEnabled() {
+		if err := writeLogHeader(f); err != nil {
+			return err
+		}
+	}
+	if cp.File != "" {
+		if err := save(f, logLine{Position: cp.Position, File: cp.File}); err != nil {
+			return err
+		}
+	}
+	if cp.Dump != nil {
+		if err := save(f, logLine{Position: cp.Position, Dump: cp.Dump}); err != nil {
+			return err
+		}
+	}
+	for name := range cp.Breaks {
+		if err := save(f, logLine{Position: cp.Position, Break: name}); err != nil {
+			return err
+		}
+	}
+	for _, s := range cp.Session {
+		if err := save(f, logLine{Position: cp.Position, Session: s}); err != nil {
+			return err
+		}
+	}
+	if err := save(f, logLine{Position: cp.Position, Done: cp.Done, Delimiter: cp.Delimiter, Resume: cp.Resume}); err != nil {
+		return err
+	}
+	if err := closeLog(f); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
@@ -0,0 +1,79 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net"
+
+	"cloud.google.com/go/cloudsqlconn"
+	"github.com/go-sql-driver/mysql"
+)
+
+var cloudsqlInstance = flag.String("cloudsql-instance", "", "Connect to this Cloud SQL instance (project:region:instance) through the Cloud SQL Go Connector with -credentials_file or Application Default Credentials, instead of the -dsn address and the SSL flags; also the default -instance")
+
+// connectorNet is the network of the DSNs dialed through the Cloud SQL
+// Go Connector, whose address is the instance connection name.
+const connectorNet = "cloudsqlconn"
+
+// setupConnector registers the Cloud SQL Go Connector with the MySQL
+// driver if -cloudsql-instance is set. The connector fetches an
+// ephemeral client certificate and encrypts the connection itself.
+func setupConnector() {
+	if *cloudsqlInstance == "" {
+		return
+	}
+	if sslEnabled() {
+		log.Fatalf("-enable_ssl and -ssl-insecure-skip-verify cannot be used with -cloudsql-instance, which encrypts the connection itself")
+	}
+	if *instanceName == "" {
+		*instanceName = *cloudsqlInstance
+	}
+	ctx := context.Background()
+	ts, err := googleTokenSource(ctx, scopeCloudPlatform)
+	if err != nil {
+		log.Fatalf("Cloud SQL Go Connector: %v", err)
+	}
+	opts := []cloudsqlconn.Option{cloudsqlconn.WithTokenSource(ts)}
+	if *iamAuth {
+		// The connector puts the login token in the certificate it
+		// refreshes, leaving the password empty.
+		opts = []cloudsqlconn.Option{cloudsqlconn.WithIAMAuthN(), cloudsqlconn.WithIAMAuthNTokenSources(ts, iamTokens)}
+	}
+	d, err := cloudsqlconn.NewDialer(ctx, opts...)
+	if err != nil {
+		log.Fatalf("Cloud SQL Go Connector: %v", err)
+	}
+	mysql.RegisterDialContext(connectorNet, func(ctx context.Context, addr string) (net.Conn, error) {
+		return d.Dial(ctx, addr)
+	})
+}
+
+// connectorDSN returns the DSN d dialing -cloudsql-instance through the
+// connector, if set, in place of its address.
+func connectorDSN(d string) (string, error) {
+	if *cloudsqlInstance == "" {
+		return d, nil
+	}
+	cfg, err := mysql.ParseDSN(d)
+	if err != nil {
+		return "", err
+	}
+	cfg.Net, cfg.Addr = connectorNet, *cloudsqlInstance
+	return cfg.FormatDSN(), nil
+}
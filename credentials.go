@@ -0,0 +1,159 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// All integrations with Google APIs authenticate through
+// googleTokenSource, so that a single set of flags configures them.
+var (
+	credentialsFile = flag.String("credentials_file", "", "Service account key file used for Google APIs instead of Application Default Credentials")
+	impersonateSA   = flag.String("impersonate_service_account", "", "Service account email to impersonate when calling Google APIs")
+)
+
+// scopeCloudPlatform grants access to all Google Cloud APIs.
+const scopeCloudPlatform = "https://www.googleapis.com/auth/cloud-platform"
+
+// tokenSources caches the token sources of googleTokenSource by scopes,
+// so that a token is reused until it expires rather than minted for
+// every call.
+var tokenSources struct {
+	sync.Mutex
+	m map[string]oauth2.TokenSource
+}
+
+// googleTokenSource returns a token source for the given scopes, using
+// -credentials_file or Application Default Credentials, and
+// impersonating -impersonate_service_account if set. Sources are cached
+// for the whole run, so they do not depend on ctx.
+func googleTokenSource(ctx context.Context, scopes ...string) (oauth2.TokenSource, error) {
+	key := strings.Join(scopes, " ")
+	tokenSources.Lock()
+	defer tokenSources.Unlock()
+	if ts := tokenSources.m[key]; ts != nil {
+		return ts, nil
+	}
+	ts, err := newTokenSource(context.Background(), scopes...)
+	if err != nil {
+		return nil, err
+	}
+	if tokenSources.m == nil {
+		tokenSources.m = map[string]oauth2.TokenSource{}
+	}
+	tokenSources.m[key] = ts
+	return ts, nil
+}
+
+func newTokenSource(ctx context.Context, scopes ...string) (oauth2.TokenSource, error) {
+	if *impersonateSA == "" {
+		base, err := baseTokenSource(ctx, scopes...)
+		if err != nil {
+			return nil, err
+		}
+		return oauth2.ReuseTokenSource(nil, base), nil
+	}
+	// Generating tokens for another account is done with the
+	// caller's own cloud-platform access.
+	base, err := baseTokenSource(ctx, scopeCloudPlatform)
+	if err != nil {
+		return nil, err
+	}
+	return oauth2.ReuseTokenSource(nil, &impersonatedTokenSource{
+		client: oauth2.NewClient(ctx, base),
+		target: *impersonateSA,
+		scopes: scopes,
+	}), nil
+}
+
+// googleClient returns an HTTP client authorized for the given scopes.
+func googleClient(ctx context.Context, scopes ...string) (*http.Client, error) {
+	ts, err := googleTokenSource(ctx, scopes...)
+	if err != nil {
+		return nil, err
+	}
+	return oauth2.NewClient(ctx, ts), nil
+}
+
+func baseTokenSource(ctx context.Context, scopes ...string) (oauth2.TokenSource, error) {
+	var creds *google.Credentials
+	var err error
+	if *credentialsFile != "" {
+		b, rerr := ioutil.ReadFile(*credentialsFile)
+		if rerr != nil {
+			return nil, rerr
+		}
+		creds, err = google.CredentialsFromJSON(ctx, b, scopes...)
+	} else {
+		creds, err = google.FindDefaultCredentials(ctx, scopes...)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("google credentials: %v", err)
+	}
+	return creds.TokenSource, nil
+}
+
+// impersonatedTokenSource generates access tokens of the service account
+// target with the IAM Credentials API.
+type impersonatedTokenSource struct {
+	client *http.Client
+	target string
+	scopes []string
+}
+
+func (ts *impersonatedTokenSource) Token() (*oauth2.Token, error) {
+	req, err := json.Marshal(map[string]interface{}{
+		"scope":    ts.scopes,
+		"lifetime": "3600s",
+	})
+	if err != nil {
+		return nil, err
+	}
+	url := fmt.Sprintf("https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/%s:generateAccessToken", ts.target)
+	resp, err := ts.client.Post(url, "application/json", bytes.NewReader(req))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("impersonate %s: %s: %s", ts.target, resp.Status, body)
+	}
+	var r struct {
+		AccessToken string
+		ExpireTime  time.Time
+	}
+	if err := json.Unmarshal(body, &r); err != nil {
+		return nil, err
+	}
+	return &oauth2.Token{AccessToken: r.AccessToken, TokenType: "Bearer", Expiry: r.ExpireTime}, nil
+}
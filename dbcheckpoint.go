@@ -0,0 +1,125 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var checkpointTable = flag.String("checkpoint-table", "", "Also keep the checkpoint in this table of the target (\"db.table\", e.g. \"admin._cloudsql_import_progress\"), resuming from it when the checkpoint log is missing")
+
+// tableCheckpoint is the state mirrored to -checkpoint-table.
+var tableCheckpoint struct {
+	db *target
+	// key identifies the import in the table.
+	key string
+	cp  *checkpoint
+}
+
+// checkpointTableName returns -checkpoint-table, quoted.
+func checkpointTableName() (string, error) {
+	parts := strings.Split(*checkpointTable, ".")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", fmt.Errorf("%q is not of the form db.table", *checkpointTable)
+	}
+	return quoteIdent(parts[0]) + "." + quoteIdent(parts[1]), nil
+}
+
+// recoverFromTable creates -checkpoint-table if needed and, if the
+// checkpoint log logName does not exist, writes it from the state saved
+// in the table, so that the import resumes from there.
+func recoverFromTable(db *target, logName string) error {
+	if *checkpointTable == "" {
+		return nil
+	}
+	table, err := checkpointTableName()
+	if err != nil {
+		return err
+	}
+	database := strings.Split(*checkpointTable, ".")[0]
+	if _, err := db.db.Exec("CREATE DATABASE IF NOT EXISTS " + quoteIdent(database)); err != nil {
+		return err
+	}
+	if _, err := db.db.Exec("CREATE TABLE IF NOT EXISTS " + table + ` (
+  dump VARCHAR(255) NOT NULL PRIMARY KEY,
+  state LONGTEXT NOT NULL,
+  updated TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+)`); err != nil {
+		return err
+	}
+	tableCheckpoint.db, tableCheckpoint.key = db, filepath.Base(logName)
+
+	if _, err := os.Stat(logName); !os.IsNotExist(err) {
+		return err
+	}
+	var state []byte
+	err = db.db.QueryRow("SELECT state FROM "+table+" WHERE dump = ?", tableCheckpoint.key).Scan(&state)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	cp := &checkpoint{}
+	if err := json.Unmarshal(state, cp); err != nil {
+		return err
+	}
+	if cp.Breaks == nil {
+		cp.Breaks = map[string]bool{}
+	}
+	log.Printf("no checkpoint log %q, resuming from position %d saved in %s", logName, cp.Position, *checkpointTable)
+	return rewriteLog(logName, cp)
+}
+
+// startTableCheckpoint starts mirroring the checkpoint, recovered as cp,
+// to -checkpoint-table.
+func startTableCheckpoint(cp *checkpoint) {
+	if tableCheckpoint.db == nil {
+		return
+	}
+	c := *cp
+	c.Breaks = map[string]bool{}
+	for b := range cp.Breaks {
+		c.Breaks[b] = true
+	}
+	tableCheckpoint.cp = &c
+}
+
+// saveToTable applies the log line ll to the checkpoint and saves it to
+// -checkpoint-table.
+func saveToTable(ll *logLine) error {
+	if tableCheckpoint.cp == nil {
+		return nil
+	}
+	tableCheckpoint.cp.apply(ll)
+	state, err := json.Marshal(tableCheckpoint.cp)
+	if err != nil {
+		return err
+	}
+	table, err := checkpointTableName()
+	if err != nil {
+		return err
+	}
+	_, err = tableCheckpoint.db.db.Exec("REPLACE INTO "+table+" (dump, state) VALUES (?, ?)", tableCheckpoint.key, state)
+	return err
+}
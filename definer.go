@@ -0,0 +1,44 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"flag"
+	"regexp"
+)
+
+var stripDefiner = flag.Bool("strip-definer", false, "Remove the DEFINER clauses of views, triggers, routines and events, which Cloud SQL rejects unless the user has the SUPER privilege, so that they are created with the importing user as definer")
+
+// definerUser matches a DEFINER clause, quoted or not, with the spaces
+// following it.
+var definerUser = regexp.MustCompile(`(?i)\bDEFINER\s*=\s*(?:CURRENT_USER(?:\s*\(\s*\))?|` +
+	userPart + `\s*@\s*` + userPart + `)\s*`)
+
+// userPart matches the user or host name of an account.
+const userPart = "(?:`(?:[^`]|``)*`|" + `'(?:[^'\\]|\\.|'')*'|"(?:[^"\\]|\\.)*"|[\w.%-]+)`
+
+// stripDefiners removes the DEFINER clauses of stmt when -strip-definer
+// is set. INSERT and REPLACE statements are left alone, since only their
+// data could match.
+func stripDefiners(stmt []byte) []byte {
+	if !*stripDefiner || stmt == nil {
+		return stmt
+	}
+	if kind := classify(stmt).Kind; kind == "INSERT" || kind == "REPLACE" {
+		return stmt
+	}
+	return definerUser.ReplaceAll(stmt, nil)
+}
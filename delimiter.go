@@ -0,0 +1,53 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import "bytes"
+
+// startDelimiter is the statement delimiter in effect where the replay
+// starts, inside a DELIMITER block when resuming from one.
+var startDelimiter string
+
+// delimiterAt returns the delimiter of the dump in effect at pos, the
+// end of the last statement read by the replay, or "" for ";". Only the
+// reader knows it, and the checkpoint only falls behind the reader
+// outside DELIMITER blocks, where INSERT statements are replayed in
+// batches or concurrently.
+func delimiterAt(pos int64) string {
+	if replayReader == nil || replayReader.Pos != pos {
+		return ""
+	}
+	if d := replayReader.Delimiter(); d != ";" {
+		return d
+	}
+	return ""
+}
+
+// appendStatement appends stmt, as written to a tee file, to b. A
+// statement read from a DELIMITER block is written inside its own
+// block, so that the file can be imported again.
+func appendStatement(b, stmt []byte) []byte {
+	d := ";"
+	if replayReader != nil {
+		d = replayReader.Delimiter()
+	}
+	if d == ";" {
+		return append(append(b, stmt...), '\n')
+	}
+	b = append(b, "DELIMITER "+d+"\n"...)
+	b = append(b, bytes.TrimSuffix(stmt, []byte(";"))...)
+	return append(b, d+"\nDELIMITER ;\n"...)
+}
@@ -0,0 +1,622 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// leaseTimeout is how long an agent may go without a heartbeat before
+// its range is handed to another agent. Agents send one every
+// heartbeatInterval.
+const (
+	leaseTimeout      = time.Minute
+	heartbeatInterval = 10 * time.Second
+)
+
+// workRange is a run of INSERT and REPLACE statements on a table, from
+// Start, the end of the statement preceding them, to End. Prelude holds
+// the session statements, such as SET and USE, in effect before them,
+// and Fingerprint identifies the coordinator's dump, so that agents
+// refuse ranges of a different one.
+type workRange struct {
+	ID          int
+	Start, End  int64
+	Prelude     []string
+	Fingerprint string
+	table       string
+}
+
+// agentRequest is the body of an agent's requests to the coordinator.
+type agentRequest struct {
+	Agent string
+	ID    int
+	Error string
+}
+
+type lease struct {
+	r       *workRange
+	agent   string
+	expires time.Time
+}
+
+// coordinator hands the ranges of a dump to agents and tracks their
+// completion in the checkpoint log.
+type coordinator struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	// pending ranges wait for an agent; leased ones are being imported.
+	pending []*workRange
+	leased  map[int]*lease
+	// outstanding counts the ranges of each table not completed yet,
+	// and total those of all tables.
+	outstanding map[string]int
+	total       int
+	scanned     bool
+	failed      error
+	// stopping is set on SIGINT or SIGTERM, after which no range is
+	// leased.
+	stopping    bool
+	nextID      int
+	token       string
+	fingerprint string
+	logFile     *os.File
+}
+
+// sessionKey matches what a session statement sets, so that the prelude
+// only keeps the last statement setting each variable.
+var sessionKey = regexp.MustCompile(`(?is)^(?:/\*!\d*\s*)?(SET\s+(?:NAMES|CHARACTER\s+SET|[@\w.]+)|USE)\b`)
+
+func addToPrelude(prelude []string, stmt string) []string {
+	key := stmt
+	if m := sessionKey.FindStringSubmatch(stmt); m != nil {
+		key = strings.ToUpper(m[1])
+	}
+	var out []string
+	for _, p := range prelude {
+		if m := sessionKey.FindStringSubmatch(p); m == nil || strings.ToUpper(m[1]) != key {
+			out = append(out, p)
+		}
+	}
+	return append(out, stmt)
+}
+
+func (c *coordinator) authorized(r *http.Request) bool {
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+c.token)) == 1
+}
+
+// expireLeases returns the ranges of agents that stopped sending
+// heartbeats to the pending ones. c.mu is held.
+func (c *coordinator) expireLeases() {
+	for id, l := range c.leased {
+		if time.Now().After(l.expires) {
+			log.Printf("coordinator: agent %s lost range #%d, reassigning it", l.agent, id)
+			delete(c.leased, id)
+			c.pending = append([]*workRange{l.r}, c.pending...)
+		}
+	}
+}
+
+func (c *coordinator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !c.authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	req := &agentRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expireLeases()
+	if c.failed != nil {
+		http.Error(w, c.failed.Error(), http.StatusGone)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/lease":
+		if len(c.pending) == 0 || c.stopping {
+			if c.scanned && c.total == 0 {
+				http.Error(w, "done", http.StatusGone)
+			} else {
+				w.WriteHeader(http.StatusNoContent)
+			}
+			return
+		}
+		wr := c.pending[0]
+		wr.Fingerprint = c.fingerprint
+		c.pending = c.pending[1:]
+		c.leased[wr.ID] = &lease{r: wr, agent: req.Agent, expires: time.Now().Add(leaseTimeout)}
+		json.NewEncoder(w).Encode(wr)
+	case "/heartbeat":
+		l := c.leased[req.ID]
+		if l == nil || l.agent != req.Agent {
+			http.Error(w, "range reassigned", http.StatusConflict)
+			return
+		}
+		l.expires = time.Now().Add(leaseTimeout)
+	case "/complete":
+		l := c.leased[req.ID]
+		if l == nil || l.agent != req.Agent {
+			http.Error(w, "range reassigned", http.StatusConflict)
+			return
+		}
+		if req.Error != "" {
+			c.failed = fmt.Errorf("agent %s: range #%d (bytes %d to %d): %s", req.Agent, req.ID, l.r.Start, l.r.End, req.Error)
+			c.cond.Broadcast()
+			return
+		}
+		delete(c.leased, req.ID)
+		c.complete(l.r.Start, l.r.End)
+		c.outstanding[l.r.table]--
+		c.total--
+		c.cond.Broadcast()
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// complete records that the range from start to end was replayed. c.mu
+// is held.
+func (c *coordinator) complete(start, end int64) {
+	progress.complete(start, end)
+	if err := save(c.logFile, logLine{Position: progress.pos, Done: progress.done}); err != nil {
+		log.Fatalf("Error saving to log: %v", err)
+	}
+}
+
+// submit queues wr for the agents.
+func (c *coordinator) submit(wr *workRange) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nextID++
+	wr.ID = c.nextID
+	c.pending = append(c.pending, wr)
+	c.outstanding[wr.table]++
+	c.total++
+}
+
+// wait blocks until the ranges of table, or of every table if it is
+// empty, are completed, or the import is stopping. It returns the error
+// of a failed range.
+func (c *coordinator) wait(table string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.failed == nil && !c.stopping && (table == "" && c.total > 0 || table != "" && c.outstanding[table] > 0) {
+		c.cond.Wait()
+	}
+	return c.failed
+}
+
+// stopOnSignal makes SIGINT and SIGTERM stop the leasing of ranges, as
+// catchSignals does for a single import. A second signal exits at once.
+func (c *coordinator) stopOnSignal() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	s := <-signals
+	log.Printf("received %v, stopping once the leased ranges complete; send it again to exit at once", s)
+	atomic.StoreInt32(&interrupted, 1)
+	c.mu.Lock()
+	c.stopping = true
+	c.cond.Broadcast()
+	c.mu.Unlock()
+	s = <-signals
+	log.Printf("received %v again, exiting; the ranges in flight are imported again on resume", s)
+	os.Exit(exitInterrupted)
+}
+
+// stopIfInterrupted exits if a signal was received, once the leased
+// ranges complete, with the checkpoint log saved; the ranges not leased
+// yet are imported on resume. It returns the error of a failed range.
+func (c *coordinator) stopIfInterrupted() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.stopping {
+		return nil
+	}
+	for c.failed == nil && len(c.leased) > 0 {
+		c.cond.Wait()
+	}
+	if c.failed != nil {
+		return c.failed
+	}
+	stopIfInterrupted(c.logFile, progress.pos)
+	return nil
+}
+
+// coordinateCmd implements "cloudsql-import coordinate [flags] dump.sql",
+// which splits an import among agents on other machines. It replays the
+// statements other than INSERT and REPLACE itself, in order, and hands
+// out runs of INSERT and REPLACE statements on a table to the agents.
+// A statement on a table waits for the ranges on it to complete, and
+// one on no particular table for all ranges. Table locks are skipped,
+// as in a parallel replay. Ranges whose agent stops
+// responding are handed to another; their statements already replayed
+// cause "duplicate entry" errors, which are ignored. Since agents
+// execute what they are handed, the coordinator serves HTTPS only and
+// agents must present the token of -token-file.
+func coordinateCmd(args []string) {
+	fs := subcommandFlags("coordinate")
+	listen := fs.String("listen", ":8443", "Address to listen on for agents")
+	certFile := fs.String("listen-cert", "", "Certificate of the server")
+	keyFile := fs.String("listen-key", "", "Key of the server")
+	tokenFile := fs.String("token-file", "", "File holding the token that agents must present")
+	var rangeSize byteSize = 256 << 20
+	fs.Var(&rangeSize, "range-size", "Largest range of statements handed to an agent")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s coordinate -listen-cert cert.pem -listen-key key.pem -token-file token [flags] dump.sql\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	dumps := parseInterspersed(fs, args)
+	if len(dumps) != 1 || *certFile == "" || *keyFile == "" || *tokenFile == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	// Pausing or stopping at a statement saves a single position,
+	// which would lose the ranges completed past it.
+	if len(breakAtTable) > 0 || len(breakMatch) > 0 {
+		log.Fatalf("coordinate: breakpoints are not supported")
+	}
+	if *stopOffset >= 0 || *stopAfterStatements > 0 || stopAfterBytes > 0 {
+		log.Fatalf("coordinate: -stop-offset, -stop-after-statements and -stop-after-bytes are not supported")
+	}
+	c := &coordinator{leased: map[int]*lease{}, outstanding: map[string]int{}}
+	c.cond = sync.NewCond(&c.mu)
+	var err error
+	if c.token, err = readToken(*tokenFile); err != nil {
+		log.Fatalf("coordinate: %v", err)
+	}
+
+	f, err := openDump(dumps[0])
+	if err != nil {
+		log.Fatalf("open dump: %v", err)
+	}
+	defer f.Close()
+	if f.compressed() {
+		// Agents read their ranges of the dump by offset.
+		log.Fatalf("coordinate: compressed dumps are not supported")
+	}
+	size, err := f.Size()
+	if err != nil {
+		log.Fatalf("dump size: %v", err)
+	}
+	logFilename := checkpointName(f.Name())
+	cp, err := recover(logFilename)
+	if err != nil {
+		log.Fatalf("recover from log: %v", err)
+	}
+	id := checkResume(f, cp)
+	if id == nil {
+		log.Fatalf("coordinate: cannot fingerprint a piped dump")
+	}
+	c.fingerprint = id.Fingerprint
+	db := connect()
+	defer db.close()
+
+	breaksHit = cp.Breaks
+	progress = &frontier{pos: cp.Position, done: cp.Done}
+	if c.logFile, err = openLog(logFilename, cp); err != nil {
+		log.Fatalf("open checkpoint log: %v", err)
+	}
+	defer c.logFile.Close()
+	if cp.Dump == nil || *cp.Dump != *id {
+		if err := save(c.logFile, logLine{Position: progress.pos, Done: progress.done, Dump: id}); err != nil {
+			log.Fatalf("Error saving to log: %v", err)
+		}
+	}
+	go c.stopOnSignal()
+
+	go func() {
+		log.Fatal(http.ListenAndServeTLS(*listen, *certFile, *keyFile, c))
+	}()
+	log.Printf("coordinator: listening on %s", *listen)
+
+	// The whole dump is scanned, even below the checkpoint, to know the
+	// session statements in effect for each range.
+	var prelude []string
+	var cur *workRange
+	flush := func() {
+		if cur != nil {
+			c.submit(cur)
+			cur = nil
+		}
+	}
+	fail := func(err error) {
+		c.mu.Lock()
+		closeLog(c.logFile)
+		c.mu.Unlock()
+		flushLog()
+		log.Fatalf("coordinator: %v", err)
+	}
+	r := newStmtReader(f, 0)
+	for {
+		if err := c.stopIfInterrupted(); err != nil {
+			fail(err)
+		}
+		prev := r.Pos
+		stmt, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fail(err)
+		}
+		info := classify(stmt)
+		if isSessionStatement(info.Kind) {
+			prelude = addToPrelude(prelude, string(stmt))
+		}
+		if progress.replayed(r.Start, r.Pos) {
+			// The coordinator's own connection needs the session
+			// statements below the checkpoint as well.
+			if s := sessionStatement(stmt); s != "" {
+				if err := replaySession(db.db, []string{s}); err != nil {
+					fail(err)
+				}
+			}
+			continue
+		}
+		if info.Kind == "INSERT" || info.Kind == "REPLACE" {
+			table := qualifiedName(info.Database, info.Table)
+			if cur != nil && (cur.table != table || cur.End-cur.Start >= int64(rangeSize)) {
+				flush()
+			}
+			if cur == nil {
+				cur = &workRange{Start: prev, Prelude: append([]string(nil), prelude...), table: table}
+			}
+			cur.End = r.Pos
+			continue
+		}
+		flush()
+		// Session statements reach the agents through the preludes, so
+		// they need not wait for them.
+		if !isSessionStatement(info.Kind) && !isTableLock(info.Kind) {
+			table := ""
+			if info.Table != "" {
+				table = qualifiedName(info.Database, info.Table)
+			}
+			if err := c.wait(table); err != nil {
+				fail(err)
+			}
+			if err := c.stopIfInterrupted(); err != nil {
+				fail(err)
+			}
+		}
+		if !isTableLock(info.Kind) {
+			// Without a log, replay leaves stopping on a signal to
+			// stopIfInterrupted, which lets the leased ranges
+			// complete first.
+			if err := replay(db, nil, nil, stmt, r.Start, r.Pos, size); err != nil {
+				fail(err)
+			}
+		}
+		c.mu.Lock()
+		c.complete(prev, r.Pos)
+		c.mu.Unlock()
+	}
+	flush()
+	c.mu.Lock()
+	c.scanned = true
+	c.mu.Unlock()
+	if err := c.wait(""); err != nil {
+		fail(err)
+	}
+	if err := c.stopIfInterrupted(); err != nil {
+		fail(err)
+	}
+	c.mu.Lock()
+	closeLog(c.logFile)
+	c.mu.Unlock()
+	flushLog()
+	log.Printf("coordinator: imported %s", f.Name())
+	// Let the agents learn that the import is done.
+	time.Sleep(2 * heartbeatInterval)
+}
+
+// agentCmd implements "cloudsql-import agent -coordinator URL [flags]
+// dump", which imports the ranges that a coordinator hands out. The dump
+// is a local copy of the coordinator's, or a gs://bucket/object; ranges
+// of a dump with another fingerprint are refused.
+func agentCmd(args []string) {
+	fs := subcommandFlags("agent")
+	coordinatorURL := fs.String("coordinator", "", "URL of the coordinator, as https://host:8443")
+	coordinatorCA := fs.String("coordinator-ca", "", "CA certificate that the coordinator's certificate must be signed by, instead of the system roots")
+	tokenFile := fs.String("token-file", "", "File holding the token to present to the coordinator")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s agent -coordinator https://host:8443 -token-file token [flags] dump.sql|gs://bucket/dump.sql\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	dumps := parseInterspersed(fs, args)
+	if len(dumps) != 1 || *coordinatorURL == "" || *tokenFile == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if !strings.HasPrefix(*coordinatorURL, "https://") {
+		log.Fatalf("agent: -coordinator must be an https:// URL")
+	}
+	token, err := readToken(*tokenFile)
+	if err != nil {
+		log.Fatalf("agent: %v", err)
+	}
+	client := http.DefaultClient
+	if *coordinatorCA != "" {
+		ca, err := ioutil.ReadFile(*coordinatorCA)
+		if err != nil {
+			log.Fatalf("agent: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			log.Fatalf("agent: no certificate in %s", *coordinatorCA)
+		}
+		client = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	}
+	f, err := openDump(dumps[0])
+	if err != nil {
+		log.Fatalf("open dump: %v", err)
+	}
+	defer f.Close()
+	id, err := identify(f)
+	if err != nil || id == nil {
+		log.Fatalf("agent: cannot fingerprint the dump: %v", err)
+	}
+	host, _ := os.Hostname()
+	agent := fmt.Sprintf("%s-%d", host, os.Getpid())
+
+	call := func(path string, req *agentRequest) (*http.Response, error) {
+		b, err := json.Marshal(req)
+		if err != nil {
+			return nil, err
+		}
+		hr, err := http.NewRequest("POST", strings.TrimSuffix(*coordinatorURL, "/")+path, bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		hr.Header.Set("Authorization", "Bearer "+token)
+		return client.Do(hr)
+	}
+
+	db := connect()
+	defer db.close()
+	// A single connection, so that the prelude applies to the statements.
+	db.db.SetMaxOpenConns(1)
+	detectPacketLimit(db)
+
+	for {
+		resp, err := call("/lease", &agentRequest{Agent: agent})
+		if err != nil {
+			log.Printf("agent: %v", err)
+			time.Sleep(heartbeatInterval)
+			continue
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusNoContent:
+			time.Sleep(time.Second)
+			continue
+		case http.StatusGone:
+			log.Printf("agent: the coordinator is done: %s", strings.TrimSpace(string(body)))
+			return
+		case http.StatusOK:
+		default:
+			log.Fatalf("agent: lease: %s: %s", resp.Status, body)
+		}
+		wr := &workRange{}
+		if err := json.Unmarshal(body, wr); err != nil {
+			log.Fatalf("agent: %v", err)
+		}
+		if wr.Fingerprint != id.Fingerprint {
+			// The lease expires and the range goes to another agent.
+			log.Fatalf("agent: %s is not the coordinator's dump: fingerprint %s, want %s", dumps[0], id.Fingerprint, wr.Fingerprint)
+		}
+
+		done := make(chan struct{})
+		go func() {
+			t := time.NewTicker(heartbeatInterval)
+			defer t.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-t.C:
+					if resp, err := call("/heartbeat", &agentRequest{Agent: agent, ID: wr.ID}); err == nil {
+						resp.Body.Close()
+					}
+				}
+			}
+		}()
+		log.Printf("agent: importing range #%d, bytes %d to %d", wr.ID, wr.Start, wr.End)
+		err = importRange(db, f, wr)
+		close(done)
+		req := &agentRequest{Agent: agent, ID: wr.ID}
+		if err != nil {
+			log.Printf("agent: range #%d: %v", wr.ID, err)
+			req.Error = err.Error()
+		}
+		if resp, err := call("/complete", req); err != nil {
+			log.Printf("agent: %v", err)
+		} else {
+			resp.Body.Close()
+		}
+	}
+}
+
+// importRange replays the range wr of the dump f.
+func importRange(db *target, f *dumpFile, wr *workRange) error {
+	for _, p := range wr.Prelude {
+		if err := replay(db, nil, nil, []byte(p), wr.Start, wr.Start, wr.End); err != nil {
+			return err
+		}
+	}
+	var rc io.ReadCloser
+	if f.remote != nil {
+		var err error
+		if rc, err = f.remote.readRange(wr.Start, wr.End); err != nil {
+			return err
+		}
+	} else {
+		rc = ioutil.NopCloser(io.NewSectionReader(f.f, wr.Start, wr.End-wr.Start))
+	}
+	defer rc.Close()
+	r := newStmtReader(rc, wr.Start)
+	for {
+		stmt, err := r.Next()
+		if err == io.EOF {
+			if r.Pos != wr.End {
+				return errors.New("the dump is shorter than the range")
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := replay(db, nil, nil, stmt, r.Start, r.Pos, wr.End); err != nil {
+			return err
+		}
+	}
+}
+
+// readToken returns the token held in name, which must not be empty.
+func readToken(name string) (string, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return "", fmt.Errorf("no token in %s", name)
+	}
+	return token, nil
+}
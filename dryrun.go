@@ -0,0 +1,76 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var dryRun = flag.Bool("dry-run", false, "Do not connect to MySQL; log every statement that would be executed, with its position and size, checkpointing to \"<dump>.dry-run.log\"")
+
+// dryRunStatements and dryRunBytes count what a dry run would execute.
+var dryRunStatements, dryRunBytes int64
+
+// dryRunImport goes through the import of the dump f, of the given
+// size, without a database: statements are logged instead of executed,
+// and the checkpoint log is a separate one, so that the checkpoint of
+// the real import is neither consulted nor advanced. The dry-run log is
+// removed once the dump is read to the end.
+func dryRunImport(f *dumpFile, size int64) {
+	if *changedOnly != "" || *deferForeignKeys || *verifySample > 0 || *verifyMode != "none" {
+		log.Fatalf("-dry-run cannot be used with -changed-only, -defer-foreign-keys, -verify-sample or -verify, which query the target")
+	}
+	logFilename := filepath.Base(f.Name()) + ".dry-run.log"
+	cp, err := recover(logFilename)
+	if err != nil {
+		log.Fatalf("recover from log: %v", err)
+	}
+	pos := cp.Position
+	breaksHit = cp.Breaks
+	progress = &frontier{pos: pos, done: cp.Done}
+	for _, s := range cp.Session {
+		// Keeps track of the current database for the filters.
+		rewrite([]byte(s))
+	}
+	if *skipToTable != "" {
+		skipTo(f)
+	}
+	if pos != 0 {
+		log.Printf("dry-run: resuming at %d", pos)
+		if _, err = f.Seek(pos, io.SeekStart); err != nil {
+			log.Fatalf("Seek: %v", err)
+		}
+	}
+	logFile, err := openLog(logFilename, cp)
+	if err != nil {
+		log.Fatalf("open checkpoint log: %v", err)
+	}
+
+	start := time.Now()
+	run(nil, nil, f, pos, size, logFile)
+	if err := closeLog(logFile); err != nil {
+		log.Fatalf("close checkpoint log: %v", err)
+	}
+	logFile.Close()
+	os.Remove(logFilename)
+	log.Printf("dry-run: %d statements, %d bytes would be executed; read the dump in %v",
+		dryRunStatements, dryRunBytes, time.Since(start))
+}
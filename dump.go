@@ -0,0 +1,808 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/GoogleCloudPlatform/cloudsql-import/importer"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+var compression = choiceFlag("compression", "auto", "Compression of the dump, detected from its name and first bytes with auto", "auto", "none", "gzip", "zstd", "xz", "bzip2")
+
+// decompressor recognizes a compressed dump format, by the suffix of
+// the file name or the magic bytes the file starts with, and
+// decompresses it.
+type decompressor struct {
+	name   string
+	suffix string
+	magic  []byte
+	open   func(io.Reader) (io.ReadCloser, error)
+}
+
+// decompressors are the compressed formats, by -compression name.
+var decompressors = []decompressor{
+	{"gzip", ".gz", []byte{0x1f, 0x8b}, func(r io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	}},
+	{"zstd", ".zst", []byte{0x28, 0xb5, 0x2f, 0xfd}, func(r io.Reader) (io.ReadCloser, error) {
+		// A single goroutine: the dump is read sequentially anyway.
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	}},
+	{"xz", ".xz", []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}, func(r io.Reader) (io.ReadCloser, error) {
+		x, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(x), nil
+	}},
+	{"bzip2", ".bz2", []byte("BZh"), func(r io.Reader) (io.ReadCloser, error) {
+		return ioutil.NopCloser(bzip2.NewReader(r)), nil
+	}},
+}
+
+// errPipeSeek is returned when a piped dump would have to be read
+// again or at an offset.
+var errPipeSeek = errors.New("a dump read from a pipe can only be read once, from the start")
+
+// remoteDump is a dump stored remotely, read by ranges of bytes.
+type remoteDump interface {
+	size() (int64, error)
+	// readRange returns a reader of the bytes from start to end.
+	readRange(start, end int64) (io.ReadCloser, error)
+}
+
+// remoteReadRetries is how many times reading a remote dump is retried
+// from where it failed.
+const remoteReadRetries = 3
+
+// isRemoteDump reports whether the dump name is a URL rather than a
+// local file.
+func isRemoteDump(name string) bool {
+	return strings.Contains(name, "://")
+}
+
+// openRemoteDump returns the remote dump name, or nil if it is a local
+// file.
+func openRemoteDump(name string) (remoteDump, error) {
+	if bucket, object, ok := gcsPath(name); ok {
+		return &gcsDump{bucket: bucket, object: object}, nil
+	}
+	if bucket, key, ok := s3Path(name); ok {
+		return s3Dump{bucket, key}, nil
+	}
+	if strings.HasPrefix(name, "https://") || strings.HasPrefix(name, "http://") {
+		return httpDump(name), nil
+	}
+	if isRemoteDump(name) {
+		return nil, fmt.Errorf("unsupported dump location %q", name)
+	}
+	return nil, nil
+}
+
+// dumpFile is a dump opened for import. A compressed dump is
+// decompressed as it is read, and its offsets, including those of the
+// checkpoint log, are those of the decompressed statements. The state
+// of the decompressor cannot be saved, so seeking in the dump
+// decompresses it again, without executing anything, from its start
+// or, for a gzip dump of several members, from the start of the last
+// member before the offset: the access points recorded while reading
+// tie offsets to positions in the compressed dump.
+//
+// A dump read from a pipe, such as standard input, has no known size
+// and can only be read once: seeking skips what the pipe gives up to
+// the offset.
+type dumpFile struct {
+	name string
+	// f is the local file or pipe, nil for a remote dump.
+	f      *os.File
+	remote remoteDump
+	// rawSize is the size of the dump as stored, or -1 for a pipe.
+	rawSize int64
+	// rawPos is the position of Read in the dump as stored, accessed
+	// atomically.
+	rawPos int64
+	// points are the access points of a gzip dump, by offset.
+	// savedPoint is the one last saved to the checkpoint log.
+	pointsMu   sync.Mutex
+	points     []accessPoint
+	savedPoint accessPoint
+	// dec is the format of a compressed dump, nil otherwise.
+	dec *decompressor
+	// pipe is the buffered pipe the dump is read from, if it is.
+	pipe *bufio.Reader
+	// stream is the position of Read, and random that of ReadAt.
+	stream *dumpCursor
+	mu     sync.Mutex
+	random *dumpCursor
+	size   int64
+}
+
+// replayDump is the dump being replayed, whose access points are saved
+// with the checkpoints.
+var replayDump *dumpFile
+
+// dumpCursor is a position in a compressed, piped or remote dump.
+type dumpCursor struct {
+	src io.Closer
+	r   io.ReadCloser
+	pos int64
+	// raw counts the bytes read from the dump as stored.
+	raw *rawCounter
+}
+
+// rawCounter counts the bytes read from r.
+type rawCounter struct {
+	r io.Reader
+	n int64
+}
+
+func (c *rawCounter) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// accessPoint is a place where decompression can restart: the start of
+// a gzip member, at Raw in the compressed dump and Offset in the
+// decompressed one.
+type accessPoint struct {
+	Raw, Offset int64
+}
+
+// accessPointInterval is the least distance between recorded access
+// points, which bounds their number for dumps of many small members,
+// such as those of bgzip.
+const accessPointInterval = 1 << 20
+
+func (c *dumpCursor) close() {
+	c.r.Close()
+	c.src.Close()
+}
+
+// openDump opens the dump name, compressed as -compression says. The
+// name "-" is standard input, gs://bucket/object a Cloud Storage
+// object, s3://bucket/key an Amazon S3 object and an HTTP(S) URL a file
+// served with support for Range requests.
+func openDump(name string) (*dumpFile, error) {
+	d := &dumpFile{name: name, size: -1, rawSize: -1}
+	if u, err := url.Parse(name); err == nil && u.RawQuery != "" && isRemoteDump(name) {
+		// The query of a signed URL is a credential, which the name of
+		// the dump, logged and used for its checkpoint log, omits.
+		addSecret(u.RawQuery)
+		u.RawQuery = ""
+		d.name = u.String()
+	}
+	var head []byte
+	remote, err := openRemoteDump(name)
+	switch {
+	case err != nil:
+		return nil, err
+	case remote != nil:
+		d.remote = remote
+		if d.rawSize, err = remote.size(); err != nil {
+			return nil, err
+		}
+		if d.rawSize > 0 {
+			n := int64(8)
+			if n > d.rawSize {
+				n = d.rawSize
+			}
+			rc, err := remote.readRange(0, n)
+			if err != nil {
+				return nil, err
+			}
+			head, err = ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				return nil, err
+			}
+		}
+	default:
+		d.f = os.Stdin
+		if name != "-" {
+			if d.f, err = os.Open(name); err != nil {
+				return nil, err
+			}
+		}
+		fi, err := d.f.Stat()
+		if err != nil {
+			d.f.Close()
+			return nil, err
+		}
+		if fi.Mode().IsRegular() {
+			d.rawSize = fi.Size()
+			head = make([]byte, 8)
+			n, err := io.ReadFull(d.f, head)
+			if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+				d.f.Close()
+				return nil, err
+			}
+			head = head[:n]
+			if _, err := d.f.Seek(0, io.SeekStart); err != nil {
+				d.f.Close()
+				return nil, err
+			}
+		} else {
+			d.pipe = bufio.NewReaderSize(d.f, importer.BufferSize)
+			head, _ = d.pipe.Peek(8)
+		}
+	}
+	for i, dec := range decompressors {
+		if *compression == dec.name || *compression == "auto" && (strings.HasSuffix(d.name, dec.suffix) || bytes.HasPrefix(head, dec.magic)) {
+			d.dec = &decompressors[i]
+			break
+		}
+	}
+	if d.dec != nil {
+		log.Printf("%s is %s-compressed", d.Name(), d.dec.name)
+	}
+	if d.dec == nil || d.pipe != nil {
+		return d, nil
+	}
+	// Fail now rather than on the first read if it is not.
+	if _, err := d.Read(head); err != nil && err != io.EOF {
+		d.Close()
+		return nil, fmt.Errorf("%s: %v", d.dec.name, err)
+	}
+	if _, err := d.Seek(0, io.SeekStart); err != nil {
+		d.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// Name returns the name of the dump, "stdin" for standard input.
+func (d *dumpFile) Name() string {
+	if d.f == os.Stdin {
+		return "stdin"
+	}
+	return d.name
+}
+
+// compressed reports whether the dump is compressed.
+func (d *dumpFile) compressed() bool {
+	return d.dec != nil
+}
+
+// piped reports whether the dump is read from a pipe.
+func (d *dumpFile) piped() bool {
+	return d.pipe != nil
+}
+
+// direct reports whether the reads of the dump are those of its file.
+func (d *dumpFile) direct() bool {
+	return d.dec == nil && d.pipe == nil && d.remote == nil
+}
+
+// Size returns the size of the dump, or -1 if it is unknown short of
+// reading all of it, for a piped or compressed dump. Progress through a
+// compressed dump is measured in the compressed bytes instead.
+func (d *dumpFile) Size() (int64, error) {
+	if d.size >= 0 || d.pipe != nil || d.dec != nil {
+		return d.size, nil
+	}
+	if d.remote != nil {
+		d.size = d.rawSize
+		return d.size, nil
+	}
+	fi, err := d.f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	d.size = fi.Size()
+	return d.size, nil
+}
+
+// decompressedSize returns the size of the dump, decompressing all of
+// it once if it is compressed, for the few uses that need it.
+func (d *dumpFile) decompressedSize() (int64, error) {
+	if d.size >= 0 || d.dec == nil || d.pipe != nil {
+		return d.Size()
+	}
+	log.Printf("decompressing %s to find its size", d.Name())
+	var c *dumpCursor
+	if err := d.seek(&c, 0); err != nil {
+		return 0, err
+	}
+	defer c.close()
+	n, err := io.Copy(ioutil.Discard, c.r)
+	if err != nil {
+		return 0, err
+	}
+	d.size = n
+	return n, nil
+}
+
+// from returns a reader of the dump from off to its end, whether its
+// size is known or not.
+func (d *dumpFile) from(off int64) io.Reader {
+	return io.NewSectionReader(d, off, math.MaxInt64-off)
+}
+
+// compressedProgress returns the position of Read in the dump as
+// stored and the size of the dump as stored, or -1 if unknown, against
+// which the progress through a compressed dump is reported.
+func (d *dumpFile) compressedProgress() (pos, size int64) {
+	return atomic.LoadInt64(&d.rawPos), d.rawSize
+}
+
+// addPoint records the access point p, unless it is too close to the
+// last one.
+func (d *dumpFile) addPoint(p accessPoint) {
+	d.pointsMu.Lock()
+	defer d.pointsMu.Unlock()
+	if n := len(d.points); n > 0 && p.Offset < d.points[n-1].Offset+accessPointInterval {
+		return
+	}
+	d.points = append(d.points, p)
+}
+
+// resumeFrom records the access point p saved with the checkpoint the
+// import resumes from.
+func (d *dumpFile) resumeFrom(p *accessPoint) {
+	if p == nil || d.dec == nil {
+		return
+	}
+	d.pointsMu.Lock()
+	d.points, d.savedPoint = []accessPoint{*p}, *p
+	d.pointsMu.Unlock()
+}
+
+// accessPointBefore returns the last access point at or before off, or
+// the start of the dump.
+func (d *dumpFile) accessPointBefore(off int64) accessPoint {
+	d.pointsMu.Lock()
+	defer d.pointsMu.Unlock()
+	i := sort.Search(len(d.points), func(i int) bool { return d.points[i].Offset > off })
+	if i == 0 {
+		return accessPoint{}
+	}
+	return d.points[i-1]
+}
+
+// resumePoint returns the access point to save with a checkpoint at
+// pos, or nil if it is the one last returned. The points before it are
+// forgotten.
+func (d *dumpFile) resumePoint(pos int64) *accessPoint {
+	d.pointsMu.Lock()
+	defer d.pointsMu.Unlock()
+	i := sort.Search(len(d.points), func(i int) bool { return d.points[i].Offset > pos })
+	if i == 0 {
+		return nil
+	}
+	p := d.points[i-1]
+	d.points = d.points[i-1:]
+	if p == d.savedPoint {
+		return nil
+	}
+	d.savedPoint = p
+	return &p
+}
+
+// raw returns a reader of the dump as stored, compressed or not, and
+// its size, for the formats that have one.
+func (d *dumpFile) raw() (io.ReaderAt, int64, error) {
+	switch {
+	case d.pipe != nil:
+		return nil, 0, errPipeSeek
+	case d.remote != nil:
+		return remoteReaderAt{d.remote, d.rawSize}, d.rawSize, nil
+	}
+	fi, err := d.f.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	return d.f, fi.Size(), nil
+}
+
+// cursor returns a new cursor at off, or before it where the dump can
+// be read from: its start, or an access point of a gzip dump. The
+// cursor of Read, stream, records access points.
+func (d *dumpFile) cursor(off int64, stream bool) (*dumpCursor, error) {
+	var src io.ReadCloser
+	start := int64(0)
+	var p accessPoint
+	if d.dec != nil && d.pipe == nil {
+		p = d.accessPointBefore(off)
+	}
+	switch {
+	case d.pipe != nil:
+		if d.stream != nil {
+			return nil, errPipeSeek
+		}
+		src = struct {
+			io.Reader
+			io.Closer
+		}{d.pipe, d.f}
+	case d.remote != nil:
+		if d.dec == nil {
+			start = off
+		}
+		src = &remoteStream{d: d.remote, pos: start + p.Raw, end: d.rawSize}
+	default:
+		f, err := os.Open(d.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := f.Seek(p.Raw, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+		src = f
+	}
+	if d.dec == nil {
+		return &dumpCursor{src: src, r: ioutil.NopCloser(src), pos: start}, nil
+	}
+	raw := &rawCounter{r: src, n: p.Raw}
+	var r io.ReadCloser
+	var err error
+	if d.dec.name == "gzip" {
+		var points *dumpFile
+		if stream {
+			points = d
+		}
+		r, err = newGzipStream(raw, p.Offset, points)
+	} else {
+		r, err = d.dec.open(bufio.NewReader(raw))
+	}
+	if err != nil {
+		src.Close()
+		return nil, err
+	}
+	return &dumpCursor{src: src, r: r, pos: p.Offset, raw: raw}, nil
+}
+
+// gzipStream decompresses a gzip dump member by member, recording the
+// start of each member as an access point of d, if not nil.
+type gzipStream struct {
+	d   *dumpFile
+	raw *rawCounter
+	src *bufio.Reader
+	z   *gzip.Reader
+	// pos is the offset in the decompressed dump.
+	pos int64
+}
+
+// newGzipStream returns a gzipStream reading raw, at the start of a
+// member that is at offset pos of the decompressed dump.
+func newGzipStream(raw *rawCounter, pos int64, d *dumpFile) (*gzipStream, error) {
+	// gzip.Reader reads no further than a member through a
+	// bufio.Reader, so the compressed position of the next one is
+	// known.
+	s := &gzipStream{d: d, raw: raw, src: bufio.NewReader(raw), pos: pos}
+	z, err := gzip.NewReader(s.src)
+	if err != nil {
+		return nil, err
+	}
+	z.Multistream(false)
+	s.z = z
+	return s, nil
+}
+
+func (s *gzipStream) Read(p []byte) (int, error) {
+	n, err := s.z.Read(p)
+	s.pos += int64(n)
+	if err != io.EOF {
+		return n, err
+	}
+	if _, err := s.src.Peek(1); err != nil {
+		return n, err
+	}
+	if s.d != nil {
+		s.d.addPoint(accessPoint{Raw: s.raw.n - int64(s.src.Buffered()), Offset: s.pos})
+	}
+	if err := s.z.Reset(s.src); err != nil {
+		return n, err
+	}
+	s.z.Multistream(false)
+	return n, nil
+}
+
+func (s *gzipStream) Close() error {
+	return s.z.Close()
+}
+
+// seek moves the cursor *c to off, starting over when it is past off
+// or, for an uncompressed remote dump, not at off.
+func (d *dumpFile) seek(c **dumpCursor, off int64) error {
+	if *c == nil || off < (*c).pos || d.remote != nil && d.dec == nil && off != (*c).pos {
+		if d.pipe != nil && *c != nil {
+			return errPipeSeek
+		}
+		if *c != nil {
+			(*c).close()
+			*c = nil
+		}
+		nc, err := d.cursor(off, c == &d.stream)
+		if err != nil {
+			return err
+		}
+		*c = nc
+	}
+	n, err := io.CopyN(ioutil.Discard, (*c).r, off-(*c).pos)
+	(*c).pos += n
+	if c == &d.stream && d.stream.raw != nil {
+		atomic.StoreInt64(&d.rawPos, d.stream.raw.n)
+	}
+	if err == io.EOF {
+		// Past the end, where reads return io.EOF.
+		return nil
+	}
+	return err
+}
+
+func (d *dumpFile) Read(p []byte) (int, error) {
+	if d.direct() {
+		return d.f.Read(p)
+	}
+	if d.stream == nil {
+		if err := d.seek(&d.stream, 0); err != nil {
+			return 0, err
+		}
+	}
+	n, err := d.stream.r.Read(p)
+	d.stream.pos += int64(n)
+	if d.stream.raw != nil {
+		atomic.StoreInt64(&d.rawPos, d.stream.raw.n)
+	}
+	return n, err
+}
+
+func (d *dumpFile) ReadAt(p []byte, off int64) (int, error) {
+	if d.direct() {
+		return d.f.ReadAt(p, off)
+	}
+	if d.pipe != nil {
+		return 0, errPipeSeek
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.seek(&d.random, off); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(d.random.r, p)
+	d.random.pos += int64(n)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (d *dumpFile) Seek(offset int64, whence int) (int64, error) {
+	if d.direct() {
+		return d.f.Seek(offset, whence)
+	}
+	switch whence {
+	case io.SeekCurrent:
+		if d.stream != nil {
+			offset += d.stream.pos
+		}
+	case io.SeekEnd:
+		if d.pipe != nil {
+			return 0, errPipeSeek
+		}
+		size, err := d.decompressedSize()
+		if err != nil {
+			return 0, err
+		}
+		offset += size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before the start of the dump")
+	}
+	if err := d.seek(&d.stream, offset); err != nil {
+		return 0, err
+	}
+	return offset, nil
+}
+
+func (d *dumpFile) Close() error {
+	for _, c := range []*dumpCursor{d.stream, d.random} {
+		if c != nil {
+			c.close()
+		}
+	}
+	if d.f != nil {
+		return d.f.Close()
+	}
+	return nil
+}
+
+// remoteStream reads a remote dump from pos to end, resuming where it
+// failed after transient errors.
+type remoteStream struct {
+	d        remoteDump
+	pos, end int64
+	rc       io.ReadCloser
+}
+
+func (r *remoteStream) Read(p []byte) (int, error) {
+	for retry := 0; ; retry++ {
+		if r.pos >= r.end {
+			return 0, io.EOF
+		}
+		var err error
+		if r.rc == nil {
+			if r.rc, err = r.d.readRange(r.pos, r.end); err != nil {
+				return 0, err
+			}
+		}
+		n, err := r.rc.Read(p)
+		r.pos += int64(n)
+		if err == nil || err == io.EOF && r.pos >= r.end {
+			return n, err
+		}
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		r.rc.Close()
+		r.rc = nil
+		if retry == remoteReadRetries {
+			return n, err
+		}
+		log.Printf("reading the dump at %d: %v; retrying", r.pos, err)
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (r *remoteStream) Close() error {
+	if r.rc != nil {
+		return r.rc.Close()
+	}
+	return nil
+}
+
+// httpDump is a dump served over HTTP(S), e.g. with a signed URL.
+type httpDump string
+
+// size asks for the first byte rather than the HEAD of the URL, as
+// signed URLs are only valid for GET.
+func (h httpDump) size() (int64, error) {
+	resp, err := h.get("bytes=0-0")
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return resp.ContentLength, nil
+	}
+	cr := resp.Header.Get("Content-Range")
+	var size int64
+	if i := strings.LastIndex(cr, "/"); i < 0 || cr[i+1:] == "*" {
+		return 0, fmt.Errorf("GET %s: no size in Content-Range %q", h.Name(), cr)
+	} else if size, err = strconv.ParseInt(cr[i+1:], 10, 64); err != nil {
+		return 0, fmt.Errorf("GET %s: Content-Range %q: %v", h.Name(), cr, err)
+	}
+	return size, nil
+}
+
+func (h httpDump) readRange(start, end int64) (io.ReadCloser, error) {
+	resp, err := h.get(fmt.Sprintf("bytes=%d-%d", start, end-1))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusPartialContent && start > 0 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: the server does not support Range requests", h.Name())
+	}
+	return resp.Body, nil
+}
+
+// Name returns the URL without its query.
+func (h httpDump) Name() string {
+	return strings.SplitN(string(h), "?", 2)[0]
+}
+
+func (h httpDump) get(byteRange string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", string(h), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", byteRange)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		// The error holds the URL, query included.
+		return nil, fmt.Errorf("GET %s: %v", h.Name(), errors.Unwrap(err))
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s: %s", h.Name(), resp.Status, b)
+	}
+	return resp, nil
+}
+
+// remoteReaderAt reads a remote dump at offsets.
+type remoteReaderAt struct {
+	d    remoteDump
+	size int64
+}
+
+func (r remoteReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	end := off + int64(len(p))
+	if end > r.size {
+		end = r.size
+	}
+	rc, err := r.d.readRange(off, end)
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+	n, err := io.ReadFull(rc, p[:end-off])
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// gcsDump is a dump stored in Cloud Storage. Its reads are pinned to
+// the generation of the object found by size, so that an object
+// overwritten during the import is not read from partly.
+type gcsDump struct {
+	bucket, object string
+	generation     int64
+}
+
+func (g *gcsDump) size() (int64, error) {
+	size, generation, err := gcsSize(g.bucket, g.object)
+	if err != nil {
+		return 0, err
+	}
+	g.generation = generation
+	return size, nil
+}
+
+func (g *gcsDump) readRange(start, end int64) (io.ReadCloser, error) {
+	return gcsReadRange(g.bucket, g.object, g.generation, start, end)
+}
+
+// progressMark tells how far into a dump of the given size pos is: as
+// a fraction, or in bytes if the size is unknown.
+func progressMark(pos, size int64) string {
+	if size < 0 {
+		return fmt.Sprintf("%dB", pos)
+	}
+	return fmt.Sprintf("%.2f", float64(pos)/float64(size))
+}
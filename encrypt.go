@@ -0,0 +1,212 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var (
+	checkpointKey    = flag.String("checkpoint_key", "", "File holding a 256-bit AES key, raw or base64-encoded, used to encrypt the checkpoint log")
+	checkpointKMSKey = flag.String("checkpoint_kms_key", "", "Cloud KMS key (projects/P/locations/L/keyRings/R/cryptoKeys/K) used to encrypt the checkpoint log")
+)
+
+// logCipher encrypts the records of the checkpoint log when not nil.
+var logCipher cipher.AEAD
+
+// logHeader is the first line of an encrypted checkpoint log. Each
+// following line is a record sealed with AES-256-GCM, base64-encoded
+// with its nonce prepended. With Cloud KMS, the record key is random
+// and stored in the header, wrapped with the KMS key.
+type logHeader struct {
+	Encryption string
+	KMSKey     string `json:",omitempty"`
+	WrappedKey []byte `json:",omitempty"`
+}
+
+const logEncryption = "AES-256-GCM"
+
+func encryptionEnabled() bool {
+	return *checkpointKey != "" || *checkpointKMSKey != ""
+}
+
+// readLogHeader sets up logCipher if line is the header of an encrypted
+// log, and reports whether it was one.
+func readLogHeader(line []byte) (bool, error) {
+	if !bytes.HasPrefix(line, []byte(`{"Encryption"`)) {
+		if encryptionEnabled() {
+			return false, errors.New("the checkpoint log is not encrypted; remove it or drop the encryption flags")
+		}
+		return false, nil
+	}
+	h := &logHeader{}
+	if err := json.Unmarshal(line, h); err != nil {
+		return false, err
+	}
+	if h.Encryption != logEncryption {
+		return false, fmt.Errorf("unknown checkpoint log encryption %q", h.Encryption)
+	}
+
+	var key []byte
+	var err error
+	switch {
+	case h.KMSKey != "":
+		if *checkpointKMSKey != h.KMSKey {
+			return false, fmt.Errorf("the checkpoint log is encrypted with -checkpoint_kms_key=%s", h.KMSKey)
+		}
+		key, err = kmsCall(h.KMSKey, "decrypt", "ciphertext", h.WrappedKey, "plaintext")
+	case *checkpointKey != "":
+		key, err = readKeyFile(*checkpointKey)
+	default:
+		return false, errors.New("the checkpoint log is encrypted; pass its -checkpoint_key")
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, setLogCipher(key)
+}
+
+// newLogHeader sets up logCipher for a new log and returns the header
+// to write first in it.
+func newLogHeader() (*logHeader, error) {
+	h := &logHeader{Encryption: logEncryption}
+	var key []byte
+	var err error
+	if *checkpointKMSKey != "" {
+		key = make([]byte, 32)
+		if _, err := io.ReadFull(rand.Reader, key); err != nil {
+			return nil, err
+		}
+		h.KMSKey = *checkpointKMSKey
+		h.WrappedKey, err = kmsCall(h.KMSKey, "encrypt", "plaintext", key, "ciphertext")
+	} else {
+		key, err = readKeyFile(*checkpointKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return h, setLogCipher(key)
+}
+
+// writeLogHeader starts the encrypted log f.
+func writeLogHeader(f *os.File) error {
+	h, err := newLogHeader()
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	return writeLog(f, append(b, '\n'), true)
+}
+
+func setLogCipher(key []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	logCipher, err = cipher.NewGCM(block)
+	return err
+}
+
+// readKeyFile reads a 256-bit key, stored either raw or base64-encoded.
+func readKeyFile(filename string) ([]byte, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 32 {
+		return b, nil
+	}
+	if k, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b))); err == nil && len(k) == 32 {
+		return k, nil
+	}
+	return nil, fmt.Errorf("%q does not hold a 256-bit key", filename)
+}
+
+// sealLine encrypts a record of the log.
+func sealLine(b []byte) ([]byte, error) {
+	nonce := make([]byte, logCipher.NonceSize(), logCipher.NonceSize()+len(b)+logCipher.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	sealed := logCipher.Seal(nonce, nonce, b, nil)
+	out := make([]byte, base64.StdEncoding.EncodedLen(len(sealed)))
+	base64.StdEncoding.Encode(out, sealed)
+	return out, nil
+}
+
+// openLine decrypts a record of the log.
+func openLine(b []byte) ([]byte, error) {
+	sealed := make([]byte, base64.StdEncoding.DecodedLen(len(b)))
+	n, err := base64.StdEncoding.Decode(sealed, b)
+	if err != nil {
+		return nil, err
+	}
+	sealed = sealed[:n]
+	ns := logCipher.NonceSize()
+	if len(sealed) < ns {
+		return nil, errors.New("truncated checkpoint record")
+	}
+	return logCipher.Open(nil, sealed[:ns], sealed[ns:], nil)
+}
+
+// kmsCall calls the Cloud KMS method (encrypt or decrypt) of key with
+// the input field set to in, and returns the output field.
+func kmsCall(key, method, inField string, in []byte, outField string) ([]byte, error) {
+	ctx := context.Background()
+	client, err := googleClient(ctx, scopeCloudPlatform)
+	if err != nil {
+		return nil, err
+	}
+	req, err := json.Marshal(map[string][]byte{inField: in})
+	if err != nil {
+		return nil, err
+	}
+	url := fmt.Sprintf("https://cloudkms.googleapis.com/v1/%s:%s", key, method)
+	resp, err := client.Post(url, "application/json", bytes.NewReader(req))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Cloud KMS %s: %s: %s", method, resp.Status, body)
+	}
+	var r map[string][]byte
+	if err := json.Unmarshal(body, &r); err != nil {
+		return nil, err
+	}
+	return r[outField], nil
+}
@@ -0,0 +1,220 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"time"
+)
+
+// tableSample holds what the estimate knows about a table of the dump.
+type tableSample struct {
+	database, name string
+	// create is the CREATE TABLE statement of the table, if any.
+	create []byte
+	// bytes and statements count the rows statements of the table, and
+	// samples holds the first of them.
+	bytes      int64
+	statements int
+	samples    [][]byte
+}
+
+var (
+	createTableKeyword = regexp.MustCompile(`(?i)^\s*CREATE\s+TABLE`)
+	foreignKeyLine     = regexp.MustCompile(`(?m)^\s*CONSTRAINT [^\n]*FOREIGN KEY[^\n]*\n`)
+	trailingComma      = regexp.MustCompile(`,(\s*\))`)
+)
+
+// estimateCmd implements "cloudsql-import estimate [-sample n] dump.sql",
+// which projects the duration of an import by executing a few rows
+// statements per table against the target and rolling them back.
+func estimateCmd(args []string) {
+	fs := subcommandFlags("estimate")
+	sample := fs.Int("sample", 5, "Number of rows statements executed per table")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s estimate [flags] dump.sql\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	in := parseInterspersed(fs, args)
+	if len(in) != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	tables, other, err := sampleDump(in[0], *sample)
+	if err != nil {
+		log.Fatalf("read %q: %v", in[0], err)
+	}
+	db := connect()
+	defer db.close()
+
+	ctx := context.Background()
+	conn, err := db.db.Conn(ctx)
+	if err != nil {
+		log.Fatalf("connect: %v", err)
+	}
+	defer conn.Close()
+
+	// Rates of the tables that could be sampled, in bytes per second.
+	rates := map[*tableSample]float64{}
+	var sampledBytes int64
+	var sampledTime time.Duration
+	for _, t := range tables {
+		if len(t.samples) == 0 {
+			continue
+		}
+		n, d, err := timeSamples(ctx, conn, t)
+		if err != nil {
+			log.Printf("cannot sample %s.%s: %v", t.database, t.name, err)
+			continue
+		}
+		rates[t] = float64(n) / d.Seconds()
+		sampledBytes += n
+		sampledTime += d
+	}
+	if sampledTime == 0 {
+		log.Fatalf("no table could be sampled")
+	}
+	avg := float64(sampledBytes) / sampledTime.Seconds()
+
+	var total time.Duration
+	fmt.Printf("%-40s %14s %10s %12s %10s\n", "TABLE", "BYTES", "STATEMENTS", "BYTES/S", "ESTIMATE")
+	for _, t := range tables {
+		rate, ok := rates[t]
+		note := ""
+		if !ok {
+			rate, note = avg, " (average)"
+		}
+		d := time.Duration(float64(t.bytes) / rate * float64(time.Second))
+		total += d
+		fmt.Printf("%-40s %14d %10d %12.0f %10s%s\n", t.database+"."+t.name, t.bytes, t.statements, rate, d.Round(time.Second), note)
+	}
+	// Other statements are mostly DDL, assumed to take about as long
+	// as creating a table did.
+	total += time.Duration(other) * ddlTime
+	fmt.Printf("\n%d other statements, about %s\n", other, (time.Duration(other) * ddlTime).Round(time.Second))
+	fmt.Printf("Estimated import time: %s\n", total.Round(time.Second))
+}
+
+// ddlTime is the average time creating a sampled table took.
+var ddlTime time.Duration
+
+// sampleDump reads the dump name and returns its tables, with up to n
+// sample rows statements each, and the number of other statements.
+func sampleDump(name string, n int) ([]*tableSample, int, error) {
+	f, err := openDump(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	var tables []*tableSample
+	byName := map[[2]string]*tableSample{}
+	db, other := "", 0
+	r := newStmtReader(f, 0)
+	for {
+		line, err := r.Next()
+		if err == io.EOF {
+			return tables, other, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		stmt := rewrite(line)
+		if stmt == nil {
+			continue
+		}
+		info := classify(stmt)
+		if info.Kind == "USE" {
+			db = info.Database
+		}
+		if info.Table == "" || info.Kind != "CREATE TABLE" && info.Kind != "INSERT" && info.Kind != "REPLACE" {
+			other++
+			continue
+		}
+		key := [2]string{info.Database, info.Table}
+		if key[0] == "" {
+			key[0] = db
+		}
+		t := byName[key]
+		if t == nil {
+			t = &tableSample{database: key[0], name: key[1]}
+			byName[key] = t
+			tables = append(tables, t)
+		}
+		if info.Kind == "CREATE TABLE" {
+			t.create = append([]byte(nil), stmt...)
+			continue
+		}
+		t.bytes += int64(len(stmt))
+		t.statements++
+		if len(t.samples) < n {
+			t.samples = append(t.samples, append([]byte(nil), stmt...))
+		}
+	}
+}
+
+// timeSamples executes the samples of t in a transaction that is rolled
+// back, into a temporary copy of the table so that existing data is
+// neither read nor changed. It returns the bytes executed and the time
+// it took.
+func timeSamples(ctx context.Context, conn *sql.Conn, t *tableSample) (int64, time.Duration, error) {
+	if t.create == nil {
+		return 0, 0, fmt.Errorf("no CREATE TABLE statement in the dump")
+	}
+	if t.database != "" {
+		if _, err := conn.ExecContext(ctx, "USE "+quoteIdent(t.database)); err != nil {
+			return 0, 0, err
+		}
+	}
+	// Temporary tables shadow tables of the same name and do not
+	// support foreign keys.
+	create := createTableKeyword.ReplaceAll(t.create, []byte("CREATE TEMPORARY TABLE"))
+	if foreignKeyLine.Match(create) {
+		create = trailingComma.ReplaceAll(foreignKeyLine.ReplaceAll(create, nil), []byte("$1"))
+	}
+	start := time.Now()
+	if _, err := conn.ExecContext(ctx, string(create)); err != nil {
+		return 0, 0, err
+	}
+	if ddlTime == 0 {
+		ddlTime = time.Since(start)
+	} else {
+		ddlTime = (ddlTime + time.Since(start)) / 2
+	}
+	defer conn.ExecContext(ctx, "DROP TEMPORARY TABLE IF EXISTS "+quoteIdent(t.name))
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+	var n int64
+	start = time.Now()
+	for _, s := range t.samples {
+		if _, err := tx.ExecContext(ctx, string(s)); err != nil {
+			return 0, 0, err
+		}
+		n += int64(len(s))
+	}
+	return n, time.Since(start), nil
+}
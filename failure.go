@@ -0,0 +1,159 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+var (
+	failureReport = flag.String("failure-report", "", "File the failure report is written to when a statement fails (default \"<dump>.failure.txt\")")
+	errorReport   = flag.String("error-report", "", "Append a JSON record for every failed or skipped statement to this file")
+)
+
+// errorReportFile is the opened -error-report file, if any.
+var errorReportFile *os.File
+
+// errorRecord is a line of the -error-report file.
+type errorRecord struct {
+	Time time.Time
+	// Start and End are the offsets of the statement in the dump.
+	Start, End int64
+	Statement  string
+	// Error and Code are the error and MySQL error number, if any.
+	Error string `json:",omitempty"`
+	Code  uint16 `json:",omitempty"`
+	// Action is what the import did: "skipped" the statement without
+	// executing it, "ignored" its error, or "aborted".
+	Action string
+}
+
+// openErrorReport opens -error-report, appending to it when resuming.
+func openErrorReport(resume bool) error {
+	if *errorReport == "" {
+		return nil
+	}
+	mode := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if !resume {
+		mode |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(*errorReport, mode, 0644)
+	if err != nil {
+		return err
+	}
+	errorReportFile = f
+	return nil
+}
+
+// recordError adds the statement stmt between start and end of the
+// dump to the -error-report file.
+func recordError(start, end int64, stmt []byte, err error, action string) {
+	if errorReportFile == nil {
+		return
+	}
+	r := errorRecord{Time: time.Now(), Start: start, End: end, Statement: excerpt(stmt), Action: action}
+	if err != nil {
+		r.Error = err.Error()
+		if merr, ok := err.(*mysql.MySQLError); ok {
+			r.Code = merr.Number
+		}
+	}
+	b, jerr := json.Marshal(r)
+	if jerr != nil {
+		log.Fatalf("json.Marshal: %v", jerr)
+	}
+	if _, werr := errorReportFile.Write(redact(append(b, '\n'))); werr != nil {
+		log.Fatalf("Error writing to error report: %v", werr)
+	}
+}
+
+// contextSize is how many bytes of the dump around a failed statement,
+// and of the start and end of the statement itself, a failure report
+// shows.
+const contextSize = 1024
+
+// reportFailure writes a report describing the failure err of the
+// statement between the offsets start and end of the dump f, so that
+// it can be diagnosed without searching the dump by hand.
+func reportFailure(db *target, f *dumpFile, start, end int64, err error) {
+	name := *failureReport
+	if name == "" {
+		name = filepath.Base(f.Name()) + ".failure.txt"
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "Time:       %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(&b, "Dump:       %s\n", f.Name())
+	fmt.Fprintf(&b, "Statement:  bytes %d to %d (%d bytes)\n", start, end, end-start)
+	fmt.Fprintf(&b, "Checkpoint: %d\n", start)
+	fmt.Fprintf(&b, "Error:      %v\n", err)
+
+	if db != nil {
+		fmt.Fprintf(&b, "\nSession state:\n")
+		var database, sqlMode, charset, timeZone string
+		var fkChecks, uniqueChecks, autocommit, connID int64
+		qerr := db.db.QueryRow("SELECT COALESCE(DATABASE(), ''), @@session.sql_mode, @@session.character_set_client, @@session.time_zone, "+
+			"@@session.foreign_key_checks, @@session.unique_checks, @@session.autocommit, CONNECTION_ID()").
+			Scan(&database, &sqlMode, &charset, &timeZone, &fkChecks, &uniqueChecks, &autocommit, &connID)
+		if qerr != nil {
+			fmt.Fprintf(&b, "  unavailable: %v\n", qerr)
+		} else {
+			fmt.Fprintf(&b, "  connection_id=%d database=%q sql_mode=%q character_set_client=%s time_zone=%s\n", connID, database, sqlMode, charset, timeZone)
+			fmt.Fprintf(&b, "  foreign_key_checks=%d unique_checks=%d autocommit=%d\n", fkChecks, uniqueChecks, autocommit)
+		}
+	}
+
+	section := func(title string, from, to int64) {
+		if from < 0 {
+			from = 0
+		}
+		if to <= from {
+			return
+		}
+		buf := make([]byte, to-from)
+		n, rerr := f.ReadAt(buf, from)
+		if rerr != nil && rerr != io.EOF {
+			fmt.Fprintf(&b, "\n%s: unavailable: %v\n", title, rerr)
+			return
+		}
+		fmt.Fprintf(&b, "\n%s (bytes %d to %d):\n%s\n", title, from, from+int64(n), buf[:n])
+	}
+	section("Before the statement", start-contextSize, start)
+	if end-start <= 2*contextSize {
+		section("Statement", start, end)
+	} else {
+		section("Statement start", start, start+contextSize)
+		section("Statement end", end-contextSize, end)
+	}
+	section("After the statement", end, end+contextSize)
+
+	if werr := ioutil.WriteFile(name, redact(b.Bytes()), 0600); werr != nil {
+		log.Printf("cannot write failure report: %v", werr)
+		return
+	}
+	log.Printf("failure report written to %q", name)
+}
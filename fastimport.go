@@ -0,0 +1,63 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"log"
+)
+
+var fastImport = flag.Bool("fast-import", false, "Disable foreign key and unique checks on the import's connections, and commit INSERT and REPLACE statements in batches (-batch, 1000 by default)")
+
+// fastImportBatch is the -batch that -fast-import implies.
+const fastImportBatch = 1000
+
+// setupFastImport makes -fast-import imply batches.
+func setupFastImport() {
+	if *fastImport && *batchSize <= 1 {
+		*batchSize = fastImportBatch
+	}
+}
+
+var uniqueChecksVar = []byte("UNIQUE_CHECKS")
+
+// setsUniqueChecks reports whether stmt is a SET statement changing
+// unique_checks. With -fast-import these are skipped, as are those
+// changing foreign_key_checks.
+func setsUniqueChecks(stmt []byte) bool {
+	return classify(stmt).Kind == "SET" && bytes.Contains(bytes.ToUpper(stmt), uniqueChecksVar)
+}
+
+// fastImportParams returns the DSN parameters disabling the checks, so
+// that they also apply to the connections of parallel workers and to
+// those opened after a failover.
+func fastImportParams() []string {
+	if !*fastImport {
+		return nil
+	}
+	return []string{"foreign_key_checks=0", "unique_checks=0"}
+}
+
+// endFastImport enables the checks again once the import completes.
+func endFastImport(db *target) {
+	if !*fastImport {
+		return
+	}
+	if err := db.exec("SET FOREIGN_KEY_CHECKS=1, UNIQUE_CHECKS=1"); err != nil {
+		log.Printf("-fast-import: cannot enable the checks again: %v", err)
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"flag"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// tablePatterns is a flag.Value for repeated, comma-separated lists of
+// table patterns: globs, or regular expressions between slashes.
+type tablePatterns []*regexp.Regexp
+
+func (p *tablePatterns) String() string {
+	var s []string
+	for _, re := range *p {
+		s = append(s, re.String())
+	}
+	return strings.Join(s, ",")
+}
+
+func (p *tablePatterns) Set(v string) error {
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		expr := ""
+		if len(s) > 2 && strings.HasPrefix(s, "/") && strings.HasSuffix(s, "/") {
+			expr = s[1 : len(s)-1]
+		} else {
+			if _, err := path.Match(s, ""); err != nil {
+				return err
+			}
+			expr = "^" + globToRegexp(s) + "$"
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return err
+		}
+		*p = append(*p, re)
+	}
+	return nil
+}
+
+// globToRegexp translates a glob, where * and ? do not match dots, to
+// a regular expression.
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			b.WriteString(`[^.]*`)
+		case '?':
+			b.WriteString(`[^.]`)
+		case '[':
+			j := strings.IndexByte(glob[i:], ']')
+			b.WriteString(glob[i : i+j+1])
+			i += j
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+			}
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String()
+}
+
+var (
+	includeTables, excludeTables tablePatterns
+	databases                    stringList
+)
+
+func init() {
+	flag.Var(&databases, "databases", "Only replay the statements of these databases of a multi-database dump (comma-separated, may be repeated)")
+	flag.Var(&includeTables, "include-tables", "Only replay the statements on tables matching these patterns (comma-separated, may be repeated): globs such as \"orders\" or \"shop.order_*\", or regular expressions such as \"/^log_\\d+$/\", matched against \"table\" and \"db.table\"")
+	flag.Var(&excludeTables, "exclude-tables", "Skip the statements on tables matching these patterns, as for -include-tables")
+}
+
+// currentDatabase is the database of the statements being replayed,
+// set by the last USE statement rewritten.
+var currentDatabase string
+
+// matchTable reports whether db.table matches one of patterns.
+func matchTable(patterns tablePatterns, db, table string) bool {
+	for _, re := range patterns {
+		if re.MatchString(table) || db != "" && re.MatchString(db+"."+table) {
+			return true
+		}
+	}
+	return false
+}
+
+// databaseSelected reports whether -databases selects db. Statements
+// outside any database are always replayed.
+func databaseSelected(db string) bool {
+	if len(databases) == 0 || db == "" {
+		return true
+	}
+	for _, l := range databases {
+		for _, d := range strings.Split(l, ",") {
+			if strings.TrimSpace(d) == db {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// filteredOut reports whether stmt belongs to a database that
+// -databases leaves out, or operates on a table that -include-tables
+// and -exclude-tables leave out. It keeps track of the current
+// database, which the filters and -break-at-table rely on.
+func filteredOut(stmt []byte) bool {
+	filtering := len(includeTables) > 0 || len(excludeTables) > 0 || len(databases) > 0
+	if !filtering && len(breakAtTable) == 0 {
+		return false
+	}
+	info := classify(stmt)
+	if info.Kind == "USE" {
+		currentDatabase = info.Database
+	}
+	if !filtering {
+		return false
+	}
+	switch info.Kind {
+	case "USE":
+		return !databaseSelected(info.Database)
+	case "CREATE DATABASE", "DROP DATABASE":
+		return !databaseSelected(info.Database)
+	}
+	db := info.Database
+	if db == "" {
+		db = currentDatabase
+	}
+	// Session variables do not belong to a database.
+	if info.Kind != "SET" && !databaseSelected(db) {
+		return true
+	}
+	if info.Table == "" {
+		return false
+	}
+	if len(includeTables) > 0 && !matchTable(includeTables, db, info.Table) {
+		return true
+	}
+	return matchTable(excludeTables, db, info.Table)
+}
@@ -0,0 +1,124 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// byteSize is a flag.Value holding a number of bytes, written either as
+// a plain number or with a KB, MB, GB or TB suffix (powers of 1024).
+type byteSize int64
+
+var sizeSuffixes = []struct {
+	suffix string
+	mult   int64
+}{
+	{"TB", 1 << 40},
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+func (b *byteSize) String() string {
+	for _, s := range sizeSuffixes {
+		if *b != 0 && int64(*b)%s.mult == 0 {
+			return fmt.Sprintf("%d%s", int64(*b)/s.mult, s.suffix)
+		}
+	}
+	return "0"
+}
+
+func (b *byteSize) Set(v string) error {
+	u := strings.ToUpper(strings.TrimSpace(v))
+	mult := int64(1)
+	for _, s := range sizeSuffixes {
+		if strings.HasSuffix(u, s.suffix) {
+			u, mult = strings.TrimSpace(strings.TrimSuffix(u, s.suffix)), s.mult
+			break
+		}
+	}
+	n, err := strconv.ParseInt(u, 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q", v)
+	}
+	*b = byteSize(n * mult)
+	return nil
+}
+
+// stringList is a flag.Value for flags that may be repeated.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// regexpList is a flag.Value for repeated regular expression flags.
+type regexpList []*regexp.Regexp
+
+func (l *regexpList) String() string {
+	var s []string
+	for _, re := range *l {
+		s = append(s, re.String())
+	}
+	return strings.Join(s, ",")
+}
+
+func (l *regexpList) Set(v string) error {
+	re, err := regexp.Compile(v)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, re)
+	return nil
+}
+
+// choice is a flag.Value holding one of a fixed set of values.
+type choice struct {
+	value   string
+	allowed []string
+}
+
+// choiceFlag defines a flag whose value must be one of allowed.
+func choiceFlag(name, value, usage string, allowed ...string) *string {
+	c := &choice{value: value, allowed: allowed}
+	flag.Var(c, name, fmt.Sprintf("%s: %s", usage, strings.Join(allowed, ", ")))
+	return &c.value
+}
+
+func (c *choice) String() string {
+	return c.value
+}
+
+func (c *choice) Set(v string) error {
+	for _, a := range c.allowed {
+		if v == a {
+			c.value = v
+			return nil
+		}
+	}
+	return fmt.Errorf("must be one of %s", strings.Join(c.allowed, ", "))
+}
@@ -0,0 +1,159 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var deferForeignKeys = flag.Bool("defer-foreign-keys", false, "Disable foreign key checks while loading, then check every foreign key of the dump for orphaned rows")
+
+// exitForeignKeyViolations is the exit status of an import that
+// completed with -defer-foreign-keys but left orphaned rows.
+const exitForeignKeyViolations = 4
+
+var foreignKeyChecksVar = []byte("FOREIGN_KEY_CHECKS")
+
+// setsForeignKeyChecks reports whether stmt is a SET statement changing
+// foreign_key_checks. With -defer-foreign-keys these are skipped, since
+// the dump's own statements would enable the checks again.
+func setsForeignKeyChecks(stmt []byte) bool {
+	return classify(stmt).Kind == "SET" && bytes.Contains(bytes.ToUpper(stmt), foreignKeyChecksVar)
+}
+
+// foreignKey is a foreign key constraint defined in the dump.
+type foreignKey struct {
+	name                  string
+	database, table       string
+	columns               []string
+	refDatabase, refTable string
+	refColumns            []string
+}
+
+var foreignKeyPattern = regexp.MustCompile(`(?is)CONSTRAINT\s+` + ident + `\s+FOREIGN\s+KEY\s*\(([^)]*)\)\s*REFERENCES\s+` + qident + `\s*\(([^)]*)\)`)
+
+// identList splits a list of column names, as in "`a`, `b`".
+func identList(b []byte) []string {
+	var l []string
+	for _, c := range bytes.Split(b, []byte(",")) {
+		l = append(l, unquoteIdent(bytes.TrimSpace(c)))
+	}
+	return l
+}
+
+// collectForeignKeys returns the foreign keys that the CREATE TABLE
+// statements of the dump r define.
+func collectForeignKeys(r io.Reader) ([]*foreignKey, error) {
+	var fks []*foreignKey
+	db := ""
+	sr := newStmtReader(r, 0)
+	for {
+		line, err := sr.Next()
+		if err == io.EOF {
+			return fks, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		stmt := rewrite(line)
+		if stmt == nil {
+			continue
+		}
+		info := classify(stmt)
+		if info.Kind == "USE" {
+			db = info.Database
+		}
+		if info.Kind != "CREATE TABLE" {
+			continue
+		}
+		if info.Database == "" {
+			info.Database = db
+		}
+		for _, m := range foreignKeyPattern.FindAllSubmatch(stmt, -1) {
+			fk := &foreignKey{
+				name:       unquoteIdent(m[1]),
+				database:   info.Database,
+				table:      info.Table,
+				columns:    identList(m[2]),
+				refColumns: identList(m[5]),
+			}
+			fk.refDatabase, fk.refTable = qualified(m[3], m[4])
+			if fk.refDatabase == "" {
+				fk.refDatabase = info.Database
+			}
+			fks = append(fks, fk)
+		}
+	}
+}
+
+func qualifiedName(database, table string) string {
+	if database == "" {
+		return quoteIdent(table)
+	}
+	return quoteIdent(database) + "." + quoteIdent(table)
+}
+
+// orphanQuery returns a query counting the rows of the table of fk that
+// reference no row of the referenced table.
+func (fk *foreignKey) orphanQuery() string {
+	var on, notNull []string
+	for i, c := range fk.columns {
+		on = append(on, fmt.Sprintf("c.%s = p.%s", quoteIdent(c), quoteIdent(fk.refColumns[i])))
+		notNull = append(notNull, fmt.Sprintf("c.%s IS NOT NULL", quoteIdent(c)))
+	}
+	return fmt.Sprintf("SELECT COUNT(*) FROM %s c LEFT JOIN %s p ON %s WHERE p.%s IS NULL AND %s",
+		qualifiedName(fk.database, fk.table), qualifiedName(fk.refDatabase, fk.refTable),
+		strings.Join(on, " AND "), quoteIdent(fk.refColumns[0]), strings.Join(notNull, " AND "))
+}
+
+// validateForeignKeys checks every foreign key of the dump f for
+// orphaned rows, and exits with a distinct status if there are any.
+func validateForeignKeys(db *target, f *dumpFile) {
+	fks, err := collectForeignKeys(f.from(0))
+	if err != nil {
+		log.Fatalf("collect foreign keys: %v", err)
+	}
+	log.Printf("checking %d foreign keys for orphaned rows", len(fks))
+	violations := 0
+	for _, fk := range fks {
+		if len(fk.columns) != len(fk.refColumns) {
+			log.Printf("foreign key %s of %s: cannot parse its columns", fk.name, fk.table)
+			continue
+		}
+		var n int64
+		if err := db.db.QueryRow(fk.orphanQuery()).Scan(&n); err != nil {
+			log.Printf("foreign key %s of %s: %v", fk.name, fk.table, err)
+			continue
+		}
+		if n > 0 {
+			violations++
+			log.Printf("VIOLATION: foreign key %s: %d rows of %s reference no row of %s",
+				fk.name, n, qualifiedName(fk.database, fk.table), qualifiedName(fk.refDatabase, fk.refTable))
+		}
+	}
+	if violations > 0 {
+		log.Printf("%d of %d foreign keys are violated", violations, len(fks))
+		os.Exit(exitForeignKeyViolations)
+	}
+	log.Printf("no foreign key is violated")
+}
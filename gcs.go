@@ -0,0 +1,158 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+// gcsPath splits a gs://bucket/prefix location.
+func gcsPath(loc string) (bucket, prefix string, ok bool) {
+	if !strings.HasPrefix(loc, "gs://") {
+		return "", "", false
+	}
+	loc = strings.TrimPrefix(loc, "gs://")
+	i := strings.Index(loc, "/")
+	if i < 0 {
+		return loc, "", true
+	}
+	return loc[:i], loc[i+1:], true
+}
+
+const (
+	// scopeStorageRead grants read access to Cloud Storage, which is
+	// all that reading dumps and checkpoints needs.
+	scopeStorageRead = "https://www.googleapis.com/auth/devstorage.read_only"
+	// scopeStorageWrite grants read and write access to Cloud Storage.
+	scopeStorageWrite = "https://www.googleapis.com/auth/devstorage.read_write"
+)
+
+// gcsClients holds a Cloud Storage client per scope, created on first
+// use.
+var gcsClients struct {
+	sync.Mutex
+	m map[string]*storage.Client
+}
+
+// gcsClient returns the Cloud Storage client authorized for scope.
+func gcsClient(scope string) (*storage.Client, error) {
+	gcsClients.Lock()
+	defer gcsClients.Unlock()
+	if c := gcsClients.m[scope]; c != nil {
+		return c, nil
+	}
+	ctx := context.Background()
+	ts, err := googleTokenSource(ctx, scope)
+	if err != nil {
+		return nil, err
+	}
+	c, err := storage.NewClient(ctx, option.WithTokenSource(ts))
+	if err != nil {
+		return nil, err
+	}
+	if gcsClients.m == nil {
+		gcsClients.m = map[string]*storage.Client{}
+	}
+	gcsClients.m[scope] = c
+	return c, nil
+}
+
+// gcsObject returns the handle of an object, with a client authorized
+// for scope.
+func gcsObject(bucket, name, scope string) (*storage.ObjectHandle, error) {
+	c, err := gcsClient(scope)
+	if err != nil {
+		return nil, err
+	}
+	return c.Bucket(bucket).Object(name), nil
+}
+
+func gcsUpload(bucket, name string, data []byte) error {
+	o, err := gcsObject(bucket, name, scopeStorageWrite)
+	if err != nil {
+		return err
+	}
+	w := o.NewWriter(context.Background())
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func gcsDownload(bucket, name string) ([]byte, error) {
+	o, err := gcsObject(bucket, name, scopeStorageRead)
+	if err != nil {
+		return nil, err
+	}
+	r, err := o.NewReader(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+func gcsList(bucket, prefix string) ([]string, error) {
+	c, err := gcsClient(scopeStorageRead)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	it := c.Bucket(bucket).Objects(context.Background(), &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return names, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, attrs.Name)
+	}
+}
+
+// gcsSize returns the size and generation of an object.
+func gcsSize(bucket, name string) (size, generation int64, err error) {
+	o, err := gcsObject(bucket, name, scopeStorageRead)
+	if err != nil {
+		return 0, 0, err
+	}
+	attrs, err := o.Attrs(context.Background())
+	if err != nil {
+		return 0, 0, err
+	}
+	return attrs.Size, attrs.Generation, nil
+}
+
+// gcsReadRange returns a reader of the bytes of the given generation of
+// an object from start to end, which fails if the object was replaced
+// since.
+func gcsReadRange(bucket, name string, generation, start, end int64) (io.ReadCloser, error) {
+	o, err := gcsObject(bucket, name, scopeStorageRead)
+	if err != nil {
+		return nil, err
+	}
+	return o.Generation(generation).NewRangeReader(context.Background(), start, end-start)
+}
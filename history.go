@@ -0,0 +1,260 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var historyLocation = flag.String("history", defaultHistory(), "Registry of past runs: a local file, or a gs://bucket/prefix/ to keep one object per run; empty to disable")
+
+func defaultHistory() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".cloudsql-import", "history.jsonl")
+}
+
+// runRecord is an entry of the run history.
+type runRecord struct {
+	Dump        string
+	Fingerprint string
+	Target      string
+	Instance    string `json:",omitempty"`
+	Start, End  time.Time
+	// Outcome is "completed", "failed", "paused", "interrupted" or
+	// "stopped".
+	Outcome     string
+	StartOffset int64
+	FinalOffset int64
+	Error       string `json:",omitempty"`
+}
+
+// currentRun is the record of this run, written by recordRun.
+var currentRun *runRecord
+
+// fingerprintSize is how many bytes at each end of a dump its
+// fingerprint covers, in addition to its size.
+const fingerprintSize = 1024 * 1024
+
+// fingerprint identifies the contents of r, of the given size, cheaply,
+// without reading all of a multi-gigabyte dump.
+func fingerprint(r io.ReaderAt, size int64) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(r, 0, fingerprintSize)); err != nil {
+		return "", err
+	}
+	if tail := size - fingerprintSize; tail > 0 {
+		if _, err := io.Copy(h, io.NewSectionReader(r, tail, fingerprintSize)); err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("%d:%s", size, hex.EncodeToString(h.Sum(nil))[:32]), nil
+}
+
+// startRun starts the history record of the import of f from pos, also
+// used for -notify-url.
+func startRun(f *dumpFile, pos int64) {
+	if *historyLocation == "" && *notifyURL == "" {
+		return
+	}
+	fp := ""
+	r, size, err := f.raw()
+	if err == nil {
+		fp, err = fingerprint(r, size)
+	}
+	if err != nil {
+		log.Printf("history: cannot fingerprint the dump: %v", err)
+	}
+	abs := f.Name()
+	if !isRemoteDump(abs) {
+		if p, err := filepath.Abs(abs); err == nil {
+			abs = p
+		}
+	}
+	currentRun = &runRecord{
+		Dump:        abs,
+		Fingerprint: fp,
+		Target:      string(redact([]byte(*dsn))),
+		Instance:    *instanceName,
+		Start:       time.Now(),
+		StartOffset: pos,
+	}
+}
+
+// recordRun adds this run to the history, with the given outcome.
+// Failing to do so is logged but not fatal.
+func recordRun(outcome string, pos int64, runErr error) {
+	reportSummary(outcome)
+	if jsonLog() {
+		logEvent(logRecord{Event: outcome, Position: pos}, runErr)
+	}
+	r := currentRun
+	if r == nil {
+		return
+	}
+	currentRun = nil
+	r.End, r.Outcome, r.FinalOffset = time.Now(), outcome, pos
+	if runErr != nil {
+		r.Error = string(redact([]byte(runErr.Error())))
+	}
+	notify(r)
+	if *historyLocation == "" {
+		return
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		log.Printf("history: %v", err)
+		return
+	}
+	b = append(b, '\n')
+	if bucket, prefix, ok := gcsPath(*historyLocation); ok {
+		var id [4]byte
+		rand.Read(id[:])
+		name := fmt.Sprintf("%s%s-%x.json", prefix, r.Start.UTC().Format("20060102T150405Z"), id)
+		err = gcsUpload(bucket, name, b)
+	} else {
+		err = appendFile(*historyLocation, b)
+	}
+	if err != nil {
+		log.Printf("history: cannot record the run: %v", err)
+	}
+}
+
+func appendFile(name string, b []byte) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readHistory returns the runs recorded in the history.
+func readHistory() ([]*runRecord, error) {
+	var data [][]byte
+	if bucket, prefix, ok := gcsPath(*historyLocation); ok {
+		names, err := gcsList(bucket, prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			b, err := gcsDownload(bucket, name)
+			if err != nil {
+				return nil, err
+			}
+			data = append(data, b)
+		}
+	} else {
+		b, err := ioutil.ReadFile(*historyLocation)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		data = append(data, b)
+	}
+
+	var runs []*runRecord
+	for _, b := range data {
+		s := bufio.NewScanner(bytes.NewReader(b))
+		for s.Scan() {
+			r := &runRecord{}
+			if err := json.Unmarshal(s.Bytes(), r); err != nil {
+				return nil, err
+			}
+			runs = append(runs, r)
+		}
+	}
+	sort.SliceStable(runs, func(i, j int) bool { return runs[i].Start.Before(runs[j].Start) })
+	return runs, nil
+}
+
+// historyCmd implements "cloudsql-import history [dump.sql] [-target s]",
+// which lists the recorded runs, optionally only those of the given
+// dump (compared by contents, not name) or whose target contains s.
+func historyCmd(args []string) {
+	fs := subcommandFlags("history")
+	targetFilter := fs.String("target", "", "Only list runs whose target DSN or instance contains this")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s history [flags] [dump.sql]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	dumps := parseInterspersed(fs, args)
+	if len(dumps) > 1 || *historyLocation == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	fp := ""
+	if len(dumps) == 1 {
+		f, err := openDump(dumps[0])
+		if err != nil {
+			log.Fatalf("open dump: %v", err)
+		}
+		r, size, err := f.raw()
+		if err == nil {
+			fp, err = fingerprint(r, size)
+		}
+		f.Close()
+		if err != nil {
+			log.Fatalf("fingerprint %q: %v", dumps[0], err)
+		}
+	}
+
+	runs, err := readHistory()
+	if err != nil {
+		log.Fatalf("read history: %v", err)
+	}
+	for _, r := range runs {
+		if fp != "" && r.Fingerprint != fp {
+			continue
+		}
+		if *targetFilter != "" && !strings.Contains(r.Target, *targetFilter) && !strings.Contains(r.Instance, *targetFilter) {
+			continue
+		}
+		target := r.Target
+		if r.Instance != "" {
+			target = r.Instance + " " + target
+		}
+		fmt.Printf("%s  %-9s %8s  %s  offsets %d-%d  %s\n",
+			r.Start.Local().Format("2006-01-02 15:04:05"), r.Outcome, r.End.Sub(r.Start).Round(time.Second),
+			r.Dump, r.StartOffset, r.FinalOffset, target)
+		if r.Error != "" {
+			fmt.Printf("    error: %s\n", r.Error)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/go-sql-driver/mysql"
+	"golang.org/x/oauth2"
+)
+
+var iamAuth = flag.Bool("iam-auth", false, "Log in with Cloud SQL IAM database authentication: the -dsn user is the IAM user and its password an OAuth token of -credentials_file or Application Default Credentials, refreshed for each new connection. Requires -enable_ssl or -cloudsql-instance")
+
+// scopeSQLLogin grants logging in to Cloud SQL databases as the IAM
+// user.
+const scopeSQLLogin = "https://www.googleapis.com/auth/sqlservice.login"
+
+// iamTokens is the source of the tokens used as passwords with
+// -iam-auth. It caches a token until shortly before it expires.
+var iamTokens oauth2.TokenSource
+
+// setupIAMAuth checks the flags -iam-auth is used with and creates the
+// source of its tokens.
+func setupIAMAuth() {
+	if !*iamAuth {
+		return
+	}
+	switch {
+	case *cloudsqlInstance == "" && !sslEnabled():
+		log.Fatalf("-iam-auth requires -enable_ssl or -cloudsql-instance, since the token is sent as a cleartext password")
+	case *prompt || *vaultPath != "":
+		log.Fatalf("-iam-auth cannot be used with -prompt or -vault-path")
+	}
+	ts, err := googleTokenSource(context.Background(), scopeSQLLogin)
+	if err != nil {
+		log.Fatalf("IAM database authentication: %v", err)
+	}
+	iamTokens = ts
+}
+
+// iamParams returns the DSN parameters that logging in with a token
+// requires. Through the connector, the token is sent in the client
+// certificate instead.
+func iamParams() []string {
+	if !*iamAuth || *cloudsqlInstance != "" {
+		return nil
+	}
+	return []string{"allowCleartextPasswords=true"}
+}
+
+// openDB opens a pool of connections to dsn, configured by the pool
+// flags. With -iam-auth, each new connection logs in with a current
+// token, so that an import running for days keeps reconnecting after
+// the first token expired. Each new connection executes the statements
+// session returns.
+func openDB(dsn string, session func() []string) (*sql.DB, error) {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	var c driver.Connector = &iamConnector{cfg: cfg}
+	if !*iamAuth || *cloudsqlInstance != "" {
+		if c, err = mysql.NewConnector(cfg); err != nil {
+			return nil, err
+		}
+	}
+	db := sql.OpenDB(&sessionConnector{Connector: c, session: session})
+	configurePool(db)
+	return db, nil
+}
+
+// iamConnector connects to MySQL with a token as the password.
+type iamConnector struct {
+	cfg *mysql.Config
+}
+
+func (c *iamConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	tok, err := iamTokens.Token()
+	if err != nil {
+		return nil, fmt.Errorf("IAM database authentication token: %v", err)
+	}
+	addSecret(tok.AccessToken)
+	cfg := c.cfg.Clone()
+	cfg.Passwd = tok.AccessToken
+	conn, err := mysql.NewConnector(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return conn.Connect(ctx)
+}
+
+func (c *iamConnector) Driver() driver.Driver {
+	return mysql.MySQLDriver{}
+}
@@ -0,0 +1,142 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloudsql-import/importer"
+)
+
+var force = flag.Bool("force", false, "Resume even if the dump does not look like the one the checkpoint log was written for")
+
+// dumpIdentity identifies the dump a checkpoint log was written for.
+type dumpIdentity struct {
+	// Fingerprint covers the size and both ends of the dump as stored.
+	Fingerprint string
+	// ModTime is the modification time of a local dump, in nanoseconds
+	// since the epoch.
+	ModTime int64 `json:",omitempty"`
+}
+
+// identify returns the identity of f, or nil for a piped dump, which
+// cannot be read twice.
+func identify(f *dumpFile) (*dumpIdentity, error) {
+	if f.piped() {
+		return nil, nil
+	}
+	r, size, err := f.raw()
+	if err != nil {
+		return nil, err
+	}
+	fp, err := fingerprint(r, size)
+	if err != nil {
+		return nil, err
+	}
+	id := &dumpIdentity{Fingerprint: fp}
+	if f.f != nil {
+		fi, err := f.f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		id.ModTime = fi.ModTime().UnixNano()
+	}
+	return id, nil
+}
+
+// checkResume verifies that f, about to be resumed from cp, is the dump
+// the checkpoint log was written for, and that the checkpoint falls
+// right after the end of a statement. Unless -force is set, it exits if
+// either is not the case. It returns the identity of f, to be saved to
+// the log.
+func checkResume(f *dumpFile, cp *checkpoint) *dumpIdentity {
+	id, err := identify(f)
+	if err != nil {
+		log.Fatalf("identify the dump: %v", err)
+	}
+	if !cp.found || id == nil {
+		return id
+	}
+	var problem string
+	switch {
+	case cp.Dump != nil && cp.Dump.Fingerprint != id.Fingerprint:
+		problem = fmt.Sprintf("its size or contents changed (%s, was %s)", id.Fingerprint, cp.Dump.Fingerprint)
+	case cp.Dump != nil && cp.Dump.ModTime != 0 && id.ModTime != 0 && cp.Dump.ModTime != id.ModTime:
+		problem = fmt.Sprintf("it was modified since the checkpoint log was started (%s, was %s)",
+			time.Unix(0, id.ModTime).Format(time.RFC3339Nano), time.Unix(0, cp.Dump.ModTime).Format(time.RFC3339Nano))
+	case cp.Position > 0 && !f.compressed() && !endsStatement(f, cp.Position, cp.Delimiter):
+		problem = fmt.Sprintf("the checkpoint at %d is not at the end of a statement", cp.Position)
+	}
+	if problem == "" {
+		return id
+	}
+	if !*force {
+		log.Fatalf("%q does not look like the dump the checkpoint log was written for: %s; use -force to resume anyway, or remove the checkpoint log to start over", f.Name(), problem)
+	}
+	log.Printf("%q does not look like the dump the checkpoint log was written for: %s; resuming anyway (-force)", f.Name(), problem)
+	return id
+}
+
+// endWindow is how far back endsStatement looks for the end of the
+// statement preceding a checkpoint.
+const endWindow = 4096
+
+// endsStatement reports whether pos of the dump r follows the end of a
+// statement where the statement reader puts it: right after the
+// delimiter, if another statement follows on its line, or else after
+// the blanks, comments and line ending, "\n" or "\r\n", that follow it.
+func endsStatement(r io.ReaderAt, pos int64, delim string) bool {
+	start := pos - endWindow
+	if start < 0 {
+		start = 0
+	}
+	b := make([]byte, pos-start)
+	if n, err := r.ReadAt(b, start); n < len(b) || err != nil && err != io.EOF {
+		return false
+	}
+	if *dialect == "postgres" {
+		// COPY data and psql meta-commands do not end with a ";".
+		return len(b) > 0 && b[len(b)-1] == '\n'
+	}
+	if delim == "" {
+		delim = ";"
+	}
+	if len(b) > 0 {
+		if i := bytes.LastIndexByte(b[:len(b)-1], '\n'); i >= 0 {
+			b = b[i+1:]
+		}
+	}
+	// The line may hold the delimiter in strings or comments: any of
+	// its occurrences followed by nothing but blanks and comments will
+	// do.
+	for i := len(b); ; {
+		j := bytes.LastIndex(b[:i], []byte(delim))
+		if j < 0 {
+			return false
+		}
+		sr := importer.NewReader(bytes.NewReader(b[j+len(delim):]), 0)
+		sr.SetDelimiter(delim)
+		if _, err := sr.Next(); err == io.EOF {
+			return true
+		}
+		i = j
+	}
+}
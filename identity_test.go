@@ -0,0 +1,52 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEndsStatement(t *testing.T) {
+	tests := []struct {
+		name, dump string
+		// pos is where the checkpoint is, marked by "|" in dump.
+		delim string
+		want  bool
+	}{
+		{"newline", "SELECT 1;\n|SELECT 2;\n", "", true},
+		{"CRLF", "SELECT 1;\r\n|SELECT 2;\r\n", "", true},
+		{"trailing dash comment", "SELECT 1; -- c\n|SELECT 2;\n", "", true},
+		{"trailing dash comment with CRLF", "SELECT 1; -- c\r\n|SELECT 2;\r\n", "", true},
+		{"trailing block comment", "SELECT 1; /* c; */\n|SELECT 2;\n", "", true},
+		{"delimiter in trailing comment", "SELECT 1; -- a;b\n|SELECT 2;\n", "", true},
+		{"same line", "SELECT 1; |SELECT 2;\n", "", true},
+		{"end without newline", "SELECT 1;|", "", true},
+		{"custom delimiter", "END;;\n|SELECT 2;;\n", ";;", true},
+		{"middle of a statement", "SELECT 1, |2;\n", "", false},
+		{"delimiter in a string", "SELECT 'a;' |, 1;\n", "", false},
+		{"after code following the delimiter", "SELECT 1; SELECT\n|2;\n", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pos := strings.Index(tt.dump, "|")
+			dump := strings.Replace(tt.dump, "|", "", 1)
+			if got := endsStatement(strings.NewReader(dump), int64(pos), tt.delim); got != tt.want {
+				t.Errorf("endsStatement(%q, %d) = %v, want %v", dump, pos, got, tt.want)
+			}
+		})
+	}
+}
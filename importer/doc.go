@@ -0,0 +1,25 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// Package importer splits dumps into statements for replaying them.
+// Reader splits MySQL dumps, and PostgresReader dumps written by
+// pg_dump. Both report the offsets of each statement in the dump, so
+// that an import saving the offset reached after each statement resumes
+// where it stopped by reading the dump from there.
+//
+// The cloudsql-import command replays the statements, keeping the
+// session state, checkpoint log and features such as parallelism,
+// retries and breakpoints itself.
+package importer
@@ -0,0 +1,240 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package importer
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"regexp"
+)
+
+// errNoCopyEnd is returned when the data of a COPY statement does not
+// end with a "\." line.
+var errNoCopyEnd = errors.New(`COPY data does not end with a "\." line`)
+
+// copyFromStdin matches the COPY statements pg_dump follows with their
+// data.
+var copyFromStdin = regexp.MustCompile(`(?is)^COPY\s.*\sFROM\s+stdin\s*;$`)
+
+// dollarTag matches the opening of a dollar-quoted string.
+var dollarTag = regexp.MustCompile(`^\$(?:[A-Za-z_][A-Za-z0-9_]*)?\$`)
+
+// PostgresReader splits a plain-format pg_dump into statements. A
+// statement ends with a ";" at the end of a line, outside of quoted
+// strings, dollar-quoted strings, quoted identifiers and comments. The
+// data of a COPY ... FROM stdin statement follows it up to a "\." line;
+// psql meta-commands, such as \connect, are returned as statements.
+type PostgresReader struct {
+	r *bufio.Reader
+	// Start and Pos are the offsets in the dump of the first byte of
+	// the statement last returned by Next, and of the byte following
+	// it, or its COPY data once read.
+	Start, Pos int64
+	buf        []byte
+	// copying is whether the COPY data of the last statement is yet
+	// to be read.
+	copying bool
+}
+
+// NewPostgresReader returns a PostgresReader reading r, which is
+// positioned at offset pos of the dump.
+func NewPostgresReader(r io.Reader, pos int64) *PostgresReader {
+	return &PostgresReader{r: bufio.NewReaderSize(r, BufferSize), Start: pos, Pos: pos}
+}
+
+// Next returns the next statement, without its trailing newline. The
+// statement is only valid until the following call. If it is a COPY
+// ... FROM stdin, its data is read with CopyData, or skipped by the
+// following call. At the end of the dump, Next returns io.EOF.
+func (r *PostgresReader) Next() ([]byte, error) {
+	if r.copying {
+		if _, err := io.Copy(io.Discard, r.CopyData()); err != nil {
+			return nil, err
+		}
+	}
+	r.buf = r.buf[:0]
+	r.Start = r.Pos
+	var lx pgLexer
+	for {
+		n := len(r.buf)
+		for {
+			line, err := r.r.ReadSlice('\n')
+			r.Pos += int64(len(line))
+			r.buf = append(r.buf, line...)
+			if err == bufio.ErrBufferFull {
+				continue
+			}
+			if err == io.EOF {
+				if len(r.buf) > 0 {
+					return nil, ErrNoNewline
+				}
+				return nil, io.EOF
+			}
+			if err != nil {
+				return nil, err
+			}
+			break
+		}
+		line := r.buf[n : len(r.buf)-1]
+		if n == 0 && lx.idle() {
+			if isComment(bytes.TrimSpace(line)) {
+				r.buf, r.Start = r.buf[:0], r.Pos
+				continue
+			}
+			if line[0] == '\\' {
+				return line, nil
+			}
+		}
+		if lx.scan(line) {
+			stmt := r.buf[:len(r.buf)-1]
+			r.copying = copyFromStdin.Match(stmt)
+			return stmt, nil
+		}
+	}
+}
+
+// Copying reports whether the statement last returned by Next is a
+// COPY ... FROM stdin whose data is yet to be read.
+func (r *PostgresReader) Copying() bool {
+	return r.copying
+}
+
+// CopyData returns a reader of the data of the COPY statement last
+// returned by Next, in the text format of COPY, without its "\." line.
+func (r *PostgresReader) CopyData() io.Reader {
+	return &copyData{r: r, lineStart: true}
+}
+
+type copyData struct {
+	r    *PostgresReader
+	line []byte
+	// lineStart is whether the next read starts a line.
+	lineStart bool
+}
+
+func (c *copyData) Read(p []byte) (int, error) {
+	for len(c.line) == 0 {
+		if !c.r.copying {
+			return 0, io.EOF
+		}
+		line, err := c.r.r.ReadSlice('\n')
+		if err == io.EOF {
+			return 0, errNoCopyEnd
+		}
+		if err != nil && err != bufio.ErrBufferFull {
+			return 0, err
+		}
+		c.r.Pos += int64(len(line))
+		if c.lineStart && string(line) == "\\.\n" {
+			c.r.copying = false
+			return 0, io.EOF
+		}
+		c.line, c.lineStart = line, err == nil
+	}
+	n := copy(p, c.line)
+	c.line = c.line[n:]
+	return n, nil
+}
+
+// pgLexer tracks the quoting state of a statement across its lines.
+type pgLexer struct {
+	// quote is the quote of the string or identifier being read, if
+	// any. escapes is whether it is an E'' string, in which a
+	// backslash escapes the next character.
+	quote   byte
+	escapes bool
+	// dollar is the tag, e.g. "$$" or "$body$", of the dollar-quoted
+	// string being read, if any.
+	dollar string
+	// comments is the nesting depth of the /* */ comments being read.
+	comments int
+}
+
+// idle reports whether the lexer is outside of any string or comment.
+func (lx *pgLexer) idle() bool {
+	return lx.quote == 0 && lx.dollar == "" && lx.comments == 0
+}
+
+// scan scans the next line of a statement and reports whether it ends
+// the statement.
+func (lx *pgLexer) scan(line []byte) bool {
+	end := false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case lx.comments > 0:
+			if bytes.HasPrefix(line[i:], []byte("/*")) {
+				lx.comments++
+				i++
+			} else if bytes.HasPrefix(line[i:], []byte("*/")) {
+				lx.comments--
+				i++
+			}
+			continue
+		case lx.dollar != "":
+			if bytes.HasPrefix(line[i:], []byte(lx.dollar)) {
+				i += len(lx.dollar) - 1
+				lx.dollar = ""
+			}
+			continue
+		case lx.quote != 0:
+			if c == '\\' && lx.escapes {
+				i++
+			} else if c == lx.quote {
+				if i+1 < len(line) && line[i+1] == lx.quote {
+					i++
+				} else {
+					lx.quote = 0
+				}
+			}
+			continue
+		}
+		switch c {
+		case ' ', '\t', '\r':
+			continue
+		case '-':
+			if i+1 < len(line) && line[i+1] == '-' {
+				return end
+			}
+		case '/':
+			if i+1 < len(line) && line[i+1] == '*' {
+				lx.comments++
+				i++
+				continue
+			}
+		case '\'':
+			lx.quote = c
+			lx.escapes = i > 0 && (line[i-1] == 'E' || line[i-1] == 'e') && (i == 1 || !isIdentByte(line[i-2]))
+		case '"':
+			lx.quote, lx.escapes = c, false
+		case '$':
+			if i == 0 || !isIdentByte(line[i-1]) {
+				if tag := dollarTag.Find(line[i:]); tag != nil {
+					lx.dollar = string(tag)
+					i += len(tag) - 1
+				}
+			}
+		}
+		end = c == ';'
+	}
+	return end && lx.idle()
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || c == '$' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || c >= 0x80
+}
@@ -0,0 +1,324 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package importer
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+)
+
+// BufferSize is the size of the read buffer. Statements that fit in it
+// are returned without being copied.
+const BufferSize = 1024 * 1024
+
+var (
+	// ErrNoNewline is returned when a dump does not end with a newline.
+	ErrNoNewline = errors.New(`contents do not end with a "\n"`)
+	// ErrTruncated is returned when a dump ends with a statement that
+	// is not terminated.
+	ErrTruncated = errors.New("contents end in the middle of a statement")
+	// ErrUnterminated is returned when a dump ends inside a quoted
+	// string or identifier, or a comment.
+	ErrUnterminated = errors.New("contents end inside a quote or comment")
+)
+
+var semicolon = []byte(";")
+
+// Reader splits a dump into statements. A statement ends at the first
+// ";" outside of quoted strings and identifiers and comments, which may
+// themselves span lines and hold ";" or "-- ". Statements sharing a
+// line are returned one at a time. Lines holding only comments between
+// statements are skipped, as are comments following the last ";" of a
+// line.
+//
+// A DELIMITER line, as written by mysqldump around stored routines and
+// triggers, changes the string that ends statements until the next
+// one, so that a routine body is returned as a single statement. The
+// delimiter of such a statement is replaced by a ";".
+type Reader struct {
+	r *bufio.Reader
+	// Start and Pos are the offsets in the dump of the first byte of
+	// the statement last returned by Next, and of the byte following
+	// its trailing newline, or of the next statement on the same line.
+	Start, Pos int64
+	// buf holds statements that span several lines or do not fit in
+	// the read buffer. It is reused across statements.
+	buf []byte
+	// rest is what follows the statement last returned on its line,
+	// held in restBuf unless it was already read from there.
+	rest, restBuf []byte
+	// delim ends statements; nil stands for ";".
+	delim []byte
+	// binary is whether the statement last returned holds raw binary
+	// data in a string.
+	binary bool
+}
+
+// NewReader returns a Reader reading r, which is positioned at offset
+// pos of the dump.
+func NewReader(r io.Reader, pos int64) *Reader {
+	return &Reader{r: bufio.NewReaderSize(r, BufferSize), Start: pos, Pos: pos}
+}
+
+// Next returns the next statement, without its trailing newline. The
+// statement is only valid until the following call. At the end of the
+// dump, Next returns io.EOF, or ErrTruncated or ErrUnterminated if it
+// ends in the middle of a statement.
+func (r *Reader) Next() ([]byte, error) {
+	r.buf = r.buf[:0]
+	r.Start = r.Pos
+	var lx mysqlLexer
+	for {
+		// Lines that do not fit in the read buffer are read into buf.
+		n := len(r.buf)
+		var line []byte
+		var err error
+		fromRest := len(r.rest) > 0
+		if fromRest {
+			line, r.rest = r.rest, nil
+		} else {
+			line, err = r.r.ReadSlice('\n')
+			for err == bufio.ErrBufferFull {
+				r.Pos += int64(len(line))
+				r.buf = append(r.buf, line...)
+				line, err = r.r.ReadSlice('\n')
+			}
+		}
+		r.Pos += int64(len(line))
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		// Fast path: a statement on a single line of the read buffer is
+		// returned from it.
+		if len(r.buf) > 0 {
+			r.buf = append(r.buf, line...)
+			line = r.buf[n:]
+		}
+		if len(line) == 0 {
+			switch {
+			case !lx.idle():
+				return nil, ErrUnterminated
+			case lx.code:
+				return nil, ErrTruncated
+			}
+			return nil, io.EOF
+		}
+		if n == 0 {
+			if d, ok := delimiterCommand(line); ok {
+				r.SetDelimiter(d)
+				r.buf, r.Start = r.buf[:0], r.Pos
+				continue
+			}
+		}
+		delim := r.delim
+		if delim == nil {
+			delim = semicolon
+		}
+		if end := lx.scan(line, delim); end >= 0 {
+			r.binary = lx.binary
+			if tail := bytes.TrimLeft(line[end:], " \t"); followsCode(tail, delim) {
+				// Another statement follows on the line.
+				r.Pos -= int64(len(tail))
+				if fromRest {
+					r.rest = tail
+				} else {
+					r.restBuf = append(r.restBuf[:0], tail...)
+					r.rest = r.restBuf
+				}
+			}
+			if n == 0 {
+				return r.terminate(line[:end]), nil
+			}
+			return r.terminate(r.buf[:n+end]), nil
+		}
+		if !lx.code && lx.idle() {
+			// Only comments and blank lines so far.
+			r.buf, r.Start = r.buf[:0], r.Pos
+			continue
+		}
+		if n == 0 && len(r.buf) == 0 {
+			r.buf = append(r.buf, line...)
+		}
+	}
+}
+
+// Binary reports whether the statement last returned by Next holds raw
+// binary data, such as a BLOB dumped without --hex-blob, in a string.
+// Quotes are tracked byte by byte, so such data, newlines and ";"
+// included, is returned as is.
+func (r *Reader) Binary() bool {
+	return r.binary
+}
+
+// Delimiter returns the string that currently ends statements.
+func (r *Reader) Delimiter() string {
+	if r.delim == nil {
+		return ";"
+	}
+	return string(r.delim)
+}
+
+// SetDelimiter sets the string that ends statements, as a DELIMITER line
+// does. It is used to resume reading inside a DELIMITER block.
+func (r *Reader) SetDelimiter(d string) {
+	if d == "" || d == ";" {
+		r.delim = nil
+		return
+	}
+	r.delim = []byte(d)
+}
+
+// terminate replaces the custom delimiter at the end of stmt, if any,
+// with a ";".
+func (r *Reader) terminate(stmt []byte) []byte {
+	if r.delim == nil {
+		return stmt
+	}
+	return append(stmt[:len(stmt)-len(r.delim)], ';')
+}
+
+// Buffered returns the capacity of the buffer held for statements that
+// span several lines or do not fit in the read buffer.
+func (r *Reader) Buffered() int {
+	return cap(r.buf)
+}
+
+// delimiterCommand returns the delimiter set by line if it is a
+// DELIMITER command of the mysql client.
+func delimiterCommand(line []byte) (string, bool) {
+	const command = "DELIMITER"
+	line = bytes.TrimSpace(line)
+	if len(line) <= len(command) || !bytes.EqualFold(line[:len(command)], []byte(command)) {
+		return "", false
+	}
+	rest := line[len(command):]
+	if rest[0] != ' ' && rest[0] != '\t' {
+		return "", false
+	}
+	fields := bytes.Fields(rest)
+	if len(fields) != 1 {
+		return "", false
+	}
+	return string(fields[0]), true
+}
+
+// mysqlLexer tracks the quoting state of a MySQL statement across its
+// lines.
+type mysqlLexer struct {
+	// quote is the quote of the string or identifier being read, if
+	// any.
+	quote byte
+	// comment is whether a /* */ comment is being read. Conditional
+	// comments, /*! */, are read as code.
+	comment bool
+	// code is whether the statement holds anything but comments so
+	// far.
+	code bool
+	// binary is whether a string holds control characters other than
+	// blanks, as raw BLOB data does.
+	binary bool
+}
+
+// idle reports whether the lexer is outside of any quote or comment.
+func (lx *mysqlLexer) idle() bool {
+	return lx.quote == 0 && !lx.comment
+}
+
+// followsCode reports whether the rest of a line after a statement holds
+// more than blanks and comments that end on it.
+func followsCode(rest, delim []byte) bool {
+	var lx mysqlLexer
+	lx.scan(rest, delim)
+	return lx.code || !lx.idle()
+}
+
+// scan scans the next line of a statement, with its trailing newline.
+// If the statement ends with delim on that line, it returns the length
+// of the line up to the end of the first such delim, and -1 otherwise.
+func (lx *mysqlLexer) scan(line, delim []byte) int {
+	// end follows the last byte of code of the line.
+	end := -1
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case lx.comment:
+			if j := bytes.Index(line[i:], []byte("*/")); j >= 0 {
+				i += j + 1
+				lx.comment = false
+			} else {
+				i = len(line)
+			}
+			continue
+		case lx.quote != 0:
+			for ; i < len(line) && line[i] != lx.quote; i++ {
+				switch c := line[i]; {
+				case c == '\\' && lx.quote != '`':
+					i++
+				case c < ' ' && c != '\t' && c != '\n' && c != '\r' || c == 0x7f:
+					lx.binary = true
+				}
+			}
+			if i < len(line) {
+				// A doubled quote is read as two strings.
+				lx.quote = 0
+				end = i + 1
+			}
+			continue
+		}
+		switch c {
+		case ' ', '\t', '\r', '\n':
+			continue
+		case '#':
+			i = len(line)
+			continue
+		case '-':
+			// "--" starts a comment when followed by a blank, a
+			// control character or the end of the dump.
+			if i+1 < len(line) && line[i+1] == '-' && (i+2 == len(line) || line[i+2] <= ' ') {
+				i = len(line)
+				continue
+			}
+		case '/':
+			if i+1 < len(line) && line[i+1] == '*' && (i+2 >= len(line) || line[i+2] != '!') {
+				lx.comment = true
+				i++
+				continue
+			}
+		case '\'', '"', '`':
+			lx.quote = c
+		}
+		lx.code = true
+		end = i + 1
+		if bytes.HasSuffix(line[:end], delim) {
+			return end
+		}
+	}
+	return -1
+}
+
+// isComment reports whether line is a comment line.
+func isComment(line []byte) bool {
+	// A comment line starts either with "#" or a "-- ". A "--" is
+	// also a valid comment line.
+	//
+	// Reference: http://dev.mysql.com/doc/refman/5.5/en/comments.html
+	return len(line) == 0 ||
+		bytes.Equal(line, []byte("--")) ||
+		bytes.HasPrefix(line, []byte("-- ")) ||
+		bytes.HasPrefix(line, []byte("#"))
+}
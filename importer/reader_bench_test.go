@@ -0,0 +1,82 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package importer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+// Representative dumps of about 8MB each, built once.
+var (
+	extendedInserts = benchDump(func(b *bytes.Buffer, i int) {
+		// mysqldump --extended-insert: many rows per statement.
+		b.WriteString("INSERT INTO `orders` VALUES ")
+		for j := 0; j < 200; j++ {
+			if j > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(b, "(%d,%d,'2014-06-01 12:00:00',%d.%02d,NULL)", i*200+j, j%97, j, j%100)
+		}
+		b.WriteString(";\n")
+	})
+	quotedStrings = benchDump(func(b *bytes.Buffer, i int) {
+		// Strings holding escapes, quotes and would-be terminators.
+		fmt.Fprintf(b, "INSERT INTO `notes` VALUES (%d,'it\\'s a \\\"note\\\"; -- not a comment',%s,'%s');\n",
+			i, "'multi\nline; text'", strings.Repeat("x\\\\y", 50))
+	})
+	comments = benchDump(func(b *bytes.Buffer, i int) {
+		// Conditional comments, comment lines and trailing comments.
+		fmt.Fprintf(b, "--\n-- Table structure for table `t%d`\n--\n\n", i)
+		fmt.Fprintf(b, "/*!40101 SET @saved_cs_client = @@character_set_client */;\n")
+		fmt.Fprintf(b, "CREATE TABLE `t%d` (\n  `id` int NOT NULL, /* key; */\n  PRIMARY KEY (`id`)\n) ENGINE=InnoDB; -- done\n", i)
+	})
+)
+
+func benchDump(stmt func(b *bytes.Buffer, i int)) []byte {
+	var b bytes.Buffer
+	for i := 0; b.Len() < 8<<20; i++ {
+		stmt(&b, i)
+	}
+	return b.Bytes()
+}
+
+func benchmarkReader(b *testing.B, dump []byte) {
+	b.SetBytes(int64(len(dump)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r := NewReader(bytes.NewReader(dump), 0)
+		for {
+			_, err := r.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		if r.Pos != int64(len(dump)) {
+			b.Fatalf("read %d bytes of %d", r.Pos, len(dump))
+		}
+	}
+}
+
+func BenchmarkReaderExtendedInserts(b *testing.B) { benchmarkReader(b, extendedInserts) }
+func BenchmarkReaderQuotedStrings(b *testing.B)   { benchmarkReader(b, quotedStrings) }
+func BenchmarkReaderComments(b *testing.B)        { benchmarkReader(b, comments) }
@@ -0,0 +1,95 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package importer
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+// readAll returns the statements of dump and the error ending them.
+func readAll(dump string) ([]string, error) {
+	r := NewReader(strings.NewReader(dump), 0)
+	var stmts []string
+	for {
+		stmt, err := r.Next()
+		if err != nil {
+			return stmts, err
+		}
+		stmts = append(stmts, string(stmt))
+	}
+}
+
+func TestReaderEnd(t *testing.T) {
+	tests := []struct {
+		name, dump string
+		stmts      []string
+		err        error
+	}{
+		{"newline", "SELECT 1;\n", []string{"SELECT 1;"}, io.EOF},
+		{"no newline", "SELECT 1;", []string{"SELECT 1;"}, io.EOF},
+		{"dash comment without newline", "SELECT 1;\n--", []string{"SELECT 1;"}, io.EOF},
+		{"dash comment line without newline", "SELECT 1;\n-- done", []string{"SELECT 1;"}, io.EOF},
+		{"truncated", "SELECT 1;\nSELECT", []string{"SELECT 1;"}, ErrTruncated},
+		{"unterminated quote", "SELECT 1;\nSELECT 'a;\n", []string{"SELECT 1;"}, ErrUnterminated},
+		{"double dash without blank", "SELECT 1;\nSELECT 1--1", []string{"SELECT 1;"}, ErrTruncated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stmts, err := readAll(tt.dump)
+			if err != tt.err {
+				t.Errorf("error %v, want %v", err, tt.err)
+			}
+			if strings.Join(stmts, "|") != strings.Join(tt.stmts, "|") {
+				t.Errorf("statements %q, want %q", stmts, tt.stmts)
+			}
+		})
+	}
+}
+
+func TestReaderStatementsOnOneLine(t *testing.T) {
+	dump := "INSERT INTO t VALUES (1);INSERT INTO t VALUES ('a;b'); INSERT INTO t VALUES (3); -- c\n" +
+		"SELECT 1; /* c */\n" +
+		"SELECT 2; SELECT\n3;\n"
+	want := []struct {
+		stmt       string
+		start, pos int64
+	}{
+		{"INSERT INTO t VALUES (1);", 0, 25},
+		{"INSERT INTO t VALUES ('a;b');", 25, 55},
+		{"INSERT INTO t VALUES (3);", 55, 86},
+		{"SELECT 1;", 86, 104},
+		{"SELECT 2;", 104, 114},
+		{"SELECT\n3;", 114, 124},
+	}
+	r := NewReader(strings.NewReader(dump), 0)
+	for _, w := range want {
+		stmt, err := r.Next()
+		if err != nil {
+			t.Fatalf("Next: %v, want %q", err, w.stmt)
+		}
+		if string(stmt) != w.stmt || r.Start != w.start || r.Pos != w.pos {
+			t.Errorf("Next = %q at %d-%d, want %q at %d-%d", stmt, r.Start, r.Pos, w.stmt, w.start, w.pos)
+		}
+		if got := dump[r.Start:r.Pos]; !strings.HasPrefix(got, w.stmt) {
+			t.Errorf("dump[%d:%d] = %q, does not start with %q", r.Start, r.Pos, got, w.stmt)
+		}
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Errorf("Next at the end: %v, want EOF", err)
+	}
+}
@@ -0,0 +1,333 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloudsql-import/ingestpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+// The ingest service is defined in ingestpb/ingest.proto.
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative ingestpb/ingest.proto
+
+// ingestChunkSize is the size of the chunks a client streams.
+const ingestChunkSize = 1 << 20
+
+// streamID matches the stream IDs that clients may give, which name the
+// checkpoint logs of the server.
+var streamID = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*$`)
+
+// dumpFingerprint matches the fingerprints computed by fingerprint.
+var dumpFingerprint = regexp.MustCompile(`^\d+:[0-9a-f]+$`)
+
+// ingestCheckpointName returns the name of the checkpoint log of the
+// stream id of a dump with the given fingerprint: a stream resumes only
+// if the dump is the same.
+func ingestCheckpointName(id, fp string) (string, error) {
+	if !streamID.MatchString(id) {
+		return "", status.Errorf(codes.InvalidArgument, "invalid stream ID %q", id)
+	}
+	if !dumpFingerprint.MatchString(fp) {
+		return "", status.Errorf(codes.InvalidArgument, "invalid dump fingerprint %q", fp)
+	}
+	return id + "." + strings.Replace(fp, ":", "-", 1) + ".log", nil
+}
+
+// tlsConfig returns a TLS configuration with the certificate and key
+// given, and the CA certificates of the peers to verify.
+func tlsConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificate in %s", caFile)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, RootCAs: pool, ClientCAs: pool}, nil
+}
+
+// ingestDB is the target of the ingest server, which imports one dump
+// at a time since the import state is global.
+var (
+	ingestDB *target
+	ingestMu sync.Mutex
+)
+
+// ingestCmd implements "cloudsql-import ingest -listen :8443 [flags]",
+// a server importing the dumps that clients stream to it over gRPC.
+// Since it executes what it receives, clients must present a
+// certificate signed by -client-ca.
+func ingestCmd(args []string) {
+	fs := subcommandFlags("ingest")
+	listen := fs.String("listen", ":8443", "Address to listen on")
+	certFile := fs.String("listen-cert", "", "Certificate of the server")
+	keyFile := fs.String("listen-key", "", "Key of the server")
+	clientCA := fs.String("client-ca", "", "CA certificate that client certificates must be signed by")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s ingest -listen-cert cert.pem -listen-key key.pem -client-ca ca.pem [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if rest := parseInterspersed(fs, args); len(rest) != 0 || *certFile == "" || *keyFile == "" || *clientCA == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if len(breakAtTable) > 0 || len(breakMatch) > 0 {
+		// Pausing exits the process, which would stop the server.
+		log.Fatalf("ingest: breakpoints are not supported")
+	}
+	cfg, err := tlsConfig(*certFile, *keyFile, *clientCA)
+	if err != nil {
+		log.Fatalf("ingest: %v", err)
+	}
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+
+	ingestDB = connect()
+	defer ingestDB.close()
+	inspectTarget(context.Background(), ingestDB.db, 0)
+	detectPacketLimit(ingestDB)
+
+	l, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Fatalf("ingest: %v", err)
+	}
+	s := grpc.NewServer(grpc.Creds(credentials.NewTLS(cfg)))
+	ingestpb.RegisterIngestServer(s, ingestServer{})
+	log.Printf("ingest: listening on %s", *listen)
+	log.Fatal(s.Serve(l))
+}
+
+// streamReader reads the dump bytes of a stream of chunks.
+type streamReader struct {
+	stream ingestpb.Ingest_ImportServer
+	data   []byte
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	for len(r.data) == 0 {
+		c, err := r.stream.Recv()
+		if err != nil {
+			return 0, err
+		}
+		r.data = c.Data
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// ingestServer implements the ingest service.
+type ingestServer struct {
+	ingestpb.UnimplementedIngestServer
+}
+
+// Import imports the dump a client streams, resuming from the checkpoint
+// log of its stream ID and fingerprint.
+func (ingestServer) Import(stream ingestpb.Ingest_ImportServer) error {
+	ingestMu.Lock()
+	defer ingestMu.Unlock()
+
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	name := first.StreamId
+	logFilename, err := ingestCheckpointName(first.StreamId, first.Fingerprint)
+	if err != nil {
+		return err
+	}
+	cp, err := recover(logFilename)
+	if err != nil {
+		return fmt.Errorf("recover from log: %v", err)
+	}
+	breaksHit = cp.Breaks
+	progress = &frontier{pos: cp.Position, done: cp.Done}
+	if err := ingestDB.restoreSession(cp.Session); err != nil {
+		return fmt.Errorf("restore session: %v", err)
+	}
+	logFile, err := openLog(logFilename, cp)
+	if err != nil {
+		return fmt.Errorf("open checkpoint log: %v", err)
+	}
+	defer logFile.Close()
+	defer closeLog(logFile)
+	log.Printf("ingest: importing %s from %d", name, cp.Position)
+	if err := stream.Send(&ingestpb.Status{Position: cp.Position}); err != nil {
+		return err
+	}
+
+	r := newStmtReader(&streamReader{stream: stream, data: first.Data}, cp.Position)
+	r.SetDelimiter(cp.Delimiter)
+	replayReader = r
+	lastStatus := time.Now()
+	for {
+		prev := r.Pos
+		stmt, err := r.Next()
+		if err == io.EOF && first.Size >= 0 && r.Pos != first.Size {
+			err = fmt.Errorf("the stream ended at %d, before the end of the dump at %d", r.Pos, first.Size)
+		}
+		if err == io.EOF {
+			flushLog()
+			log.Printf("ingest: imported %s", name)
+			return stream.Send(&ingestpb.Status{Position: progress.pos, Done: true})
+		}
+		if err != nil {
+			return stream.Send(&ingestpb.Status{Position: progress.pos, Error: err.Error()})
+		}
+		if progress.replayed(r.Start, r.Pos) {
+			continue
+		}
+		if err := replay(ingestDB, nil, logFile, stmt, r.Start, r.Pos, first.Size); err != nil {
+			flushLog()
+			log.Printf("ingest: %s: %v", name, err)
+			return stream.Send(&ingestpb.Status{Position: progress.pos, Error: err.Error()})
+		}
+		session := sessionStatement(stmt)
+		if session != "" {
+			ingestDB.setSession(session)
+		}
+		progress.complete(prev, r.Pos)
+		if err := save(logFile, logLine{Position: progress.pos, Done: progress.done, Session: session}); err != nil {
+			return fmt.Errorf("save checkpoint: %v", err)
+		}
+		if time.Since(lastStatus) >= time.Second {
+			lastStatus = time.Now()
+			if err := stream.Send(&ingestpb.Status{Position: progress.pos}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// sendCmd implements "cloudsql-import send -server host:8443 dump.sql",
+// the client of the ingest server, which streams the dump from where the
+// server's checkpoint says to. The server resumes a stream, named by
+// -stream-id, only with a dump of the same fingerprint.
+func sendCmd(args []string) {
+	fs := flag.NewFlagSet("send", flag.ExitOnError)
+	server := fs.String("server", "", "Address of the ingest server, as host:port")
+	serverCA := fs.String("server-ca", "", "CA certificate that the server certificate must be signed by")
+	certFile := fs.String("client-cert", "", "Certificate of the client")
+	keyFile := fs.String("client-key", "", "Key of the client")
+	id := fs.String("stream-id", "", "Name of the stream, under which the server keeps its checkpoint (default the name of the dump file)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s send -server host:port -server-ca ca.pem -client-cert cert.pem -client-key key.pem dump.sql\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	dumps := parseInterspersed(fs, args)
+	if len(dumps) != 1 || *server == "" || *serverCA == "" || *certFile == "" || *keyFile == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	cfg, err := tlsConfig(*certFile, *keyFile, *serverCA)
+	if err != nil {
+		log.Fatalf("send: %v", err)
+	}
+	f, err := openDump(dumps[0])
+	if err != nil {
+		log.Fatalf("open dump: %v", err)
+	}
+	defer f.Close()
+	size, err := f.Size()
+	if err != nil {
+		log.Fatalf("dump size: %v", err)
+	}
+	dumpID, err := identify(f)
+	if err != nil || dumpID == nil {
+		log.Fatalf("send: cannot fingerprint the dump: %v", err)
+	}
+	if *id == "" {
+		*id = filepath.Base(f.Name())
+	}
+
+	conn, err := grpc.Dial(*server, grpc.WithTransportCredentials(credentials.NewTLS(cfg)))
+	if err != nil {
+		log.Fatalf("send: %v", err)
+	}
+	defer conn.Close()
+	stream, err := ingestpb.NewIngestClient(conn).Import(context.Background())
+	if err != nil {
+		log.Fatalf("send: %v", err)
+	}
+	if err := stream.Send(&ingestpb.Chunk{StreamId: *id, Fingerprint: dumpID.Fingerprint, Size: size}); err != nil {
+		log.Fatalf("send: %v", err)
+	}
+	st, err := stream.Recv()
+	if err != nil {
+		log.Fatalf("send: %v", err)
+	}
+	if _, err := f.Seek(st.Position, io.SeekStart); err != nil {
+		log.Fatalf("Seek: %v", err)
+	}
+	log.Printf("send: streaming %s from %d", filepath.Base(f.Name()), st.Position)
+
+	go func() {
+		buf := make([]byte, ingestChunkSize)
+		for {
+			n, err := f.Read(buf)
+			if n > 0 {
+				if serr := stream.Send(&ingestpb.Chunk{Data: buf[:n]}); serr != nil {
+					// The server ended the stream; its status says why.
+					return
+				}
+			}
+			if err == io.EOF {
+				stream.CloseSend()
+				return
+			}
+			if err != nil {
+				log.Fatalf("read %s: %v", filepath.Base(f.Name()), err)
+			}
+		}
+	}()
+
+	for {
+		if st, err = stream.Recv(); err != nil {
+			log.Fatalf("send: %v", err)
+		}
+		switch {
+		case st.Error != "":
+			log.Fatalf("send: the import failed at %d: %s", st.Position, st.Error)
+		case st.Done:
+			log.Printf("send: imported %s", filepath.Base(f.Name()))
+			return
+		}
+		log.Printf("%s imported", progressMark(st.Position, size))
+	}
+}
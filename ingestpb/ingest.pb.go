@@ -0,0 +1,240 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.11
+// 	protoc        v5.28.3
+// source: ingestpb/ingest.proto
+
+package ingestpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// Chunk is a message of a client streaming a dump. The first names the
+// dump; each holds the bytes following those of the previous.
+type Chunk struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// stream_id names the stream, so that the server resumes the import
+	// of the same dump from its checkpoint. Set in the first message.
+	StreamId string `protobuf:"bytes,1,opt,name=stream_id,json=streamId,proto3" json:"stream_id,omitempty"`
+	// fingerprint identifies the contents of the dump, which must not
+	// change between the attempts of a stream. Set in the first message.
+	Fingerprint string `protobuf:"bytes,2,opt,name=fingerprint,proto3" json:"fingerprint,omitempty"`
+	// size is the size of the dump. Set in the first message.
+	Size          int64  `protobuf:"varint,3,opt,name=size,proto3" json:"size,omitempty"`
+	Data          []byte `protobuf:"bytes,4,opt,name=data,proto3" json:"data,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Chunk) Reset() {
+	*x = Chunk{}
+	mi := &file_ingestpb_ingest_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Chunk) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Chunk) ProtoMessage() {}
+
+func (x *Chunk) ProtoReflect() protoreflect.Message {
+	mi := &file_ingestpb_ingest_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Chunk.ProtoReflect.Descriptor instead.
+func (*Chunk) Descriptor() ([]byte, []int) {
+	return file_ingestpb_ingest_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Chunk) GetStreamId() string {
+	if x != nil {
+		return x.StreamId
+	}
+	return ""
+}
+
+func (x *Chunk) GetFingerprint() string {
+	if x != nil {
+		return x.Fingerprint
+	}
+	return ""
+}
+
+func (x *Chunk) GetSize() int64 {
+	if x != nil {
+		return x.Size
+	}
+	return 0
+}
+
+func (x *Chunk) GetData() []byte {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+// Status is a message of the server.
+type Status struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Position      int64                  `protobuf:"varint,1,opt,name=position,proto3" json:"position,omitempty"`
+	Done          bool                   `protobuf:"varint,2,opt,name=done,proto3" json:"done,omitempty"`
+	Error         string                 `protobuf:"bytes,3,opt,name=error,proto3" json:"error,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Status) Reset() {
+	*x = Status{}
+	mi := &file_ingestpb_ingest_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Status) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Status) ProtoMessage() {}
+
+func (x *Status) ProtoReflect() protoreflect.Message {
+	mi := &file_ingestpb_ingest_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Status.ProtoReflect.Descriptor instead.
+func (*Status) Descriptor() ([]byte, []int) {
+	return file_ingestpb_ingest_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *Status) GetPosition() int64 {
+	if x != nil {
+		return x.Position
+	}
+	return 0
+}
+
+func (x *Status) GetDone() bool {
+	if x != nil {
+		return x.Done
+	}
+	return false
+}
+
+func (x *Status) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
+var File_ingestpb_ingest_proto protoreflect.FileDescriptor
+
+const file_ingestpb_ingest_proto_rawDesc = "" +
+	"\n" +
+	"\x15ingestpb/ingest.proto\x12\x0ecloudsqlimport\"n\n" +
+	"\x05Chunk\x12\x1b\n" +
+	"\tstream_id\x18\x01 \x01(\tR\bstreamId\x12 \n" +
+	"\vfingerprint\x18\x02 \x01(\tR\vfingerprint\x12\x12\n" +
+	"\x04size\x18\x03 \x01(\x03R\x04size\x12\x12\n" +
+	"\x04data\x18\x04 \x01(\fR\x04data\"N\n" +
+	"\x06Status\x12\x1a\n" +
+	"\bposition\x18\x01 \x01(\x03R\bposition\x12\x12\n" +
+	"\x04done\x18\x02 \x01(\bR\x04done\x12\x14\n" +
+	"\x05error\x18\x03 \x01(\tR\x05error2E\n" +
+	"\x06Ingest\x12;\n" +
+	"\x06Import\x12\x15.cloudsqlimport.Chunk\x1a\x16.cloudsqlimport.Status(\x010\x01B9Z7github.com/GoogleCloudPlatform/cloudsql-import/ingestpbb\x06proto3"
+
+var (
+	file_ingestpb_ingest_proto_rawDescOnce sync.Once
+	file_ingestpb_ingest_proto_rawDescData []byte
+)
+
+func file_ingestpb_ingest_proto_rawDescGZIP() []byte {
+	file_ingestpb_ingest_proto_rawDescOnce.Do(func() {
+		file_ingestpb_ingest_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_ingestpb_ingest_proto_rawDesc), len(file_ingestpb_ingest_proto_rawDesc)))
+	})
+	return file_ingestpb_ingest_proto_rawDescData
+}
+
+var file_ingestpb_ingest_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
+var file_ingestpb_ingest_proto_goTypes = []any{
+	(*Chunk)(nil),  // 0: cloudsqlimport.Chunk
+	(*Status)(nil), // 1: cloudsqlimport.Status
+}
+var file_ingestpb_ingest_proto_depIdxs = []int32{
+	0, // 0: cloudsqlimport.Ingest.Import:input_type -> cloudsqlimport.Chunk
+	1, // 1: cloudsqlimport.Ingest.Import:output_type -> cloudsqlimport.Status
+	1, // [1:2] is the sub-list for method output_type
+	0, // [0:1] is the sub-list for method input_type
+	0, // [0:0] is the sub-list for extension type_name
+	0, // [0:0] is the sub-list for extension extendee
+	0, // [0:0] is the sub-list for field type_name
+}
+
+func init() { file_ingestpb_ingest_proto_init() }
+func file_ingestpb_ingest_proto_init() {
+	if File_ingestpb_ingest_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_ingestpb_ingest_proto_rawDesc), len(file_ingestpb_ingest_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   2,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_ingestpb_ingest_proto_goTypes,
+		DependencyIndexes: file_ingestpb_ingest_proto_depIdxs,
+		MessageInfos:      file_ingestpb_ingest_proto_msgTypes,
+	}.Build()
+	File_ingestpb_ingest_proto = out.File
+	file_ingestpb_ingest_proto_goTypes = nil
+	file_ingestpb_ingest_proto_depIdxs = nil
+}
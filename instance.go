@@ -0,0 +1,156 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var instanceName = flag.String("instance", "", "Cloud SQL instance, as project:instance or project:region:instance, to look up with the Cloud SQL Admin API")
+
+// sqlInstance is the part of the Cloud SQL Admin API's DatabaseInstance
+// resource that the import looks at.
+type sqlInstance struct {
+	Name            string
+	DatabaseVersion string
+	Region          string
+	State           string
+	Settings        struct {
+		Tier                   string
+		DataDiskSizeGb         string
+		StorageAutoResize      bool
+		StorageAutoResizeLimit string
+		DatabaseFlags          []databaseFlag
+	}
+}
+
+// databaseFlag is a database flag set on a Cloud SQL instance.
+type databaseFlag struct {
+	Name  string `json:"name"`
+	Value string `json:"value,omitempty"`
+}
+
+// parseInstanceName splits -instance into a project and an instance.
+func parseInstanceName(s string) (project, instance string, err error) {
+	parts := strings.Split(s, ":")
+	switch len(parts) {
+	case 2:
+		return parts[0], parts[1], nil
+	case 3:
+		return parts[0], parts[2], nil
+	case 4:
+		// Domain-scoped projects, as in "example.com:project:region:instance".
+		return parts[0] + ":" + parts[1], parts[3], nil
+	}
+	return "", "", fmt.Errorf("invalid Cloud SQL instance %q", s)
+}
+
+// sqlAdminURL returns the Admin API URL of the -instance resource.
+func sqlAdminURL() (string, error) {
+	project, instance, err := parseInstanceName(*instanceName)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("https://sqladmin.googleapis.com/v1/projects/%s/instances/%s", project, instance), nil
+}
+
+// getInstance fetches the -instance resource from the Admin API.
+func getInstance(ctx context.Context) (*sqlInstance, error) {
+	url, err := sqlAdminURL()
+	if err != nil {
+		return nil, err
+	}
+	client, err := googleClient(ctx, scopeCloudPlatform)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s: %s", url, resp.Status, body)
+	}
+	inst := &sqlInstance{}
+	if err := json.Unmarshal(body, inst); err != nil {
+		return nil, err
+	}
+	return inst, nil
+}
+
+// inspectTarget logs what the target looks like before the import
+// starts, and warns when a dump of dumpSize bytes will obviously not fit
+// in its storage. Failures are logged but do not stop the import.
+func inspectTarget(ctx context.Context, db *sql.DB, dumpSize int64) {
+	var version, sqlMode, charset string
+	var maxPacket, bufferPool int64
+	err := db.QueryRowContext(ctx, "SELECT VERSION(), @@sql_mode, @@character_set_server, @@max_allowed_packet, @@innodb_buffer_pool_size").
+		Scan(&version, &sqlMode, &charset, &maxPacket, &bufferPool)
+	if err != nil {
+		log.Printf("target: cannot query server variables: %v", err)
+		return
+	}
+	log.Printf("target: MySQL %s, max_allowed_packet=%d, innodb_buffer_pool_size=%d, character_set_server=%s, sql_mode=%q",
+		version, maxPacket, bufferPool, charset, sqlMode)
+
+	var used int64
+	err = db.QueryRowContext(ctx, "SELECT COALESCE(SUM(data_length + index_length), 0) FROM information_schema.TABLES").Scan(&used)
+	if err != nil {
+		log.Printf("target: cannot query data size: %v", err)
+	} else if dumpSize < 0 {
+		log.Printf("target: %d bytes of data and indexes, dump size unknown", used)
+	} else {
+		log.Printf("target: %d bytes of data and indexes, dump is %d bytes", used, dumpSize)
+	}
+
+	if *instanceName == "" {
+		return
+	}
+	inst, err := getInstance(ctx)
+	if err != nil {
+		log.Printf("target: cannot query the Cloud SQL Admin API: %v", err)
+		return
+	}
+	s := inst.Settings
+	log.Printf("target: instance %s (%s, %s) in %s, tier %s, %s GB of storage, auto-resize %v",
+		inst.Name, inst.DatabaseVersion, inst.State, inst.Region, s.Tier, s.DataDiskSizeGb, s.StorageAutoResize)
+	for _, f := range s.DatabaseFlags {
+		log.Printf("target: flag %s=%s", f.Name, f.Value)
+	}
+
+	disk, _ := strconv.ParseInt(s.DataDiskSizeGb, 10, 64)
+	if s.StorageAutoResize {
+		// A limit of 0 means there is none.
+		disk, _ = strconv.ParseInt(s.StorageAutoResizeLimit, 10, 64)
+	}
+	if free := disk<<30 - used; disk > 0 && dumpSize > free {
+		log.Printf("WARNING: the dump is %d bytes but the instance only has about %d bytes of storage left", dumpSize, free)
+	}
+}
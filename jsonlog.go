@@ -0,0 +1,105 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+var logFormat = choiceFlag("log-format", "text", "Format of the log written to the standard error; json writes one record per line, as Cloud Logging expects", "text", "json")
+
+// logRecord is the line of the log with -log-format=json for a
+// statement or the start or end of the import. Lines logged through
+// the log package are records with only a time, severity and message.
+type logRecord struct {
+	Time     time.Time `json:"time"`
+	Severity string    `json:"severity"`
+	// Event is "statement", or the outcome of the import: "started",
+	// "completed", "paused", "interrupted", "stopped" or "failed".
+	Event string `json:"event,omitempty"`
+	// Start and Position are the offsets in the dump of the statement,
+	// or Position that of the import for other events.
+	Start           int64  `json:"start,omitempty"`
+	Position        int64  `json:"position"`
+	DurationMS      int64  `json:"duration_ms"`
+	Bytes           int    `json:"bytes,omitempty"`
+	StatementPrefix string `json:"statement_prefix,omitempty"`
+	Table           string `json:"table,omitempty"`
+	Error           string `json:"error,omitempty"`
+	ErrorCode       uint16 `json:"error_code,omitempty"`
+}
+
+// jsonLog reports whether the log is written as JSON records.
+func jsonLog() bool {
+	return *logFormat == "json"
+}
+
+// setLogFormat installs the -log-format on the log package.
+func setLogFormat() {
+	if !jsonLog() {
+		return
+	}
+	log.SetFlags(0)
+	// Secrets are redacted before JSON escapes them.
+	log.SetOutput(&redactingWriter{w: jsonLogWriter{stderr}})
+}
+
+// jsonLogWriter turns the lines written by the log package into
+// records.
+type jsonLogWriter struct {
+	w io.Writer
+}
+
+func (w jsonLogWriter) Write(p []byte) (int, error) {
+	writeRecord(w.w, struct {
+		Time     time.Time `json:"time"`
+		Severity string    `json:"severity"`
+		Message  string    `json:"message"`
+	}{time.Now(), "INFO", string(bytes.TrimSuffix(p, []byte("\n")))})
+	return len(p), nil
+}
+
+// writeRecord writes r to w as a line of JSON.
+func writeRecord(w io.Writer, r interface{}) {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	w.Write(append(b, '\n'))
+}
+
+// logEvent logs a record for the statement or the import event, with
+// the MySQL error number of err if any.
+func logEvent(r logRecord, err error) {
+	r.Time, r.Severity = time.Now(), "INFO"
+	if err != nil {
+		r.Severity = "ERROR"
+		if isDuplicate(err) {
+			r.Severity = "WARNING"
+		}
+		r.Error = string(redact([]byte(err.Error())))
+		if merr, ok := err.(*mysql.MySQLError); ok {
+			r.ErrorCode = merr.Number
+		}
+	}
+	writeRecord(&redactingWriter{w: stderr}, r)
+}
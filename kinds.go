@@ -0,0 +1,43 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"flag"
+	"log"
+)
+
+var (
+	dataOnly   = flag.Bool("data-only", false, "Only replay the INSERT, REPLACE and LOAD DATA statements of the dump, with the statements setting up the session and locking tables, into a schema that already exists")
+	schemaOnly = flag.Bool("schema-only", false, "Skip the INSERT, REPLACE and LOAD DATA statements of the dump, creating its databases, tables, views, triggers and routines empty")
+)
+
+// skippedKind reports whether stmt is of a kind that -data-only or
+// -schema-only leaves out.
+func skippedKind(stmt []byte) bool {
+	if !*dataOnly && !*schemaOnly {
+		return false
+	}
+	if *dataOnly && *schemaOnly {
+		log.Fatalf("-data-only and -schema-only cannot be used together")
+	}
+	kind := classify(stmt).Kind
+	data := kind == "INSERT" || kind == "REPLACE" || kind == "LOAD DATA" || isTableLock(kind)
+	if *schemaOnly {
+		return data
+	}
+	return !data && !isSessionStatement(kind)
+}
@@ -0,0 +1,340 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// loadReader is the name of the reader handler through which LOAD DATA
+// LOCAL INFILE reads the chunk being loaded.
+const loadReader = "cloudsql-import-chunk"
+
+// loadChunk is the part of a file loaded by the LOAD DATA statement
+// being executed. The handler opens it anew for each attempt, as retries
+// read it again.
+var loadChunk struct {
+	f          *os.File
+	start, end int64
+}
+
+// loadTable is the target of a CSV or TSV file.
+type loadTable struct {
+	table string
+	tsv   bool
+	// columns are the columns of the header line, if any.
+	columns []string
+	// crlf is whether lines end with "\r\n".
+	crlf    bool
+	charset string
+}
+
+// loadCmd implements "cloudsql-import load dir", which loads the CSV and
+// TSV files of dir with LOAD DATA LOCAL INFILE, in chunks of rows after
+// each of which the checkpoint is saved.
+func loadCmd(args []string) {
+	fs := subcommandFlags("load")
+	var tables stringList
+	fs.Var(&tables, "table", "Load the files matching a glob into a table, as \"orders-*.csv=shop.orders\" (may be repeated; default the table their name gives, as \"shop.orders.csv\")")
+	header := fs.Bool("header", false, "The first line of each file names the columns")
+	chunkRows := fs.Int("chunk-rows", 100000, "Rows loaded by each LOAD DATA statement, after which the checkpoint is saved")
+	charset := fs.String("character-set", "utf8mb4", "Character set of the files")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s load [flags] dir\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	dirs := parseInterspersed(fs, args)
+	if len(dirs) != 1 || *chunkRows <= 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	dir := dirs[0]
+	files, err := loadFiles(dir, tables)
+	if err != nil {
+		log.Fatalf("load: %v", err)
+	}
+
+	logName := *cpPath
+	if logName == "" {
+		logName = filepath.Base(dir) + ".load.log"
+	}
+	cp, err := recover(logName)
+	if err != nil {
+		log.Fatalf("recover from log: %v", err)
+	}
+	start := 0
+	if cp.File != "" {
+		for start < len(files) && files[start] != cp.File {
+			start++
+		}
+		if start == len(files) {
+			log.Fatalf("the checkpoint log is at %q, which is not one of the files to load", cp.File)
+		}
+		log.Printf("resuming at row offset %d of %q", cp.Position, cp.File)
+	}
+	logFile, err := openLog(logName, cp)
+	if err != nil {
+		log.Fatalf("open checkpoint log: %v", err)
+	}
+	defer logFile.Close()
+
+	db := connect()
+	defer db.close()
+	registerLoadReader()
+	catchSignals()
+	for i, name := range files[start:] {
+		pos := int64(0)
+		if i == 0 && cp.File == name {
+			pos = cp.Position
+		} else if err := save(logFile, logLine{File: name}); err != nil {
+			log.Fatalf("Error saving to log: %v", err)
+		}
+		t, err := fileTable(name, tables, *header)
+		if err != nil {
+			log.Fatalf("load: %v", err)
+		}
+		t.charset = *charset
+		if err := loadFile(db, logFile, name, pos, t, *chunkRows); err != nil {
+			closeLog(logFile)
+			log.Fatalf("load %q: %v", name, err)
+		}
+	}
+	if err := closeLog(logFile); err != nil {
+		log.Fatalf("close checkpoint log: %v", err)
+	}
+}
+
+// registerLoadReader registers the reader handler through which LOAD
+// DATA reads loadChunk.
+func registerLoadReader() {
+	mysql.RegisterReaderHandler(loadReader, func() io.Reader {
+		return io.NewSectionReader(loadChunk.f, loadChunk.start, loadChunk.end-loadChunk.start)
+	})
+}
+
+// loadFiles returns the CSV and TSV files of dir, in order.
+func loadFiles(dir string, tables stringList) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, e := range entries {
+		if ext := filepath.Ext(e.Name()); !e.IsDir() && (ext == ".csv" || ext == ".tsv") {
+			files = append(files, filepath.Join(dir, e.Name()))
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no .csv or .tsv files in %q", dir)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// fileTable returns the table the file name is loaded into, from the
+// first -table glob it matches or else its name, with the columns of
+// its header line if header is set.
+func fileTable(name string, tables stringList, header bool) (*loadTable, error) {
+	base := filepath.Base(name)
+	t := &loadTable{tsv: filepath.Ext(name) == ".tsv"}
+	for _, m := range tables {
+		i := strings.LastIndex(m, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("-table %q is not of the form glob=db.table", m)
+		}
+		if ok, err := filepath.Match(m[:i], base); err != nil {
+			return nil, err
+		} else if ok {
+			t.table = m[i+1:]
+			break
+		}
+	}
+	if t.table == "" {
+		t.table = strings.TrimSuffix(base, filepath.Ext(base))
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	first, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	t.crlf = strings.HasSuffix(first, "\r\n")
+	if header {
+		if t.tsv {
+			t.columns = strings.Split(strings.TrimRight(first, "\r\n"), "\t")
+		} else {
+			r := csv.NewReader(strings.NewReader(first))
+			if t.columns, err = r.Read(); err != nil {
+				return nil, fmt.Errorf("header: %v", err)
+			}
+		}
+	}
+	return t, nil
+}
+
+// statement returns the LOAD DATA statement loading the chunk into t.
+func (t *loadTable) statement() string {
+	var table []string
+	for _, p := range strings.SplitN(t.table, ".", 2) {
+		table = append(table, quoteIdent(p))
+	}
+	s := "LOAD DATA LOCAL INFILE 'Reader::" + loadReader + "' INTO TABLE " + strings.Join(table, ".") + " CHARACTER SET " + t.charset
+	if !t.tsv {
+		s += ` FIELDS TERMINATED BY ',' OPTIONALLY ENCLOSED BY '"' ESCAPED BY ''`
+	}
+	if t.crlf {
+		s += ` LINES TERMINATED BY '\r\n'`
+	}
+	if len(t.columns) > 0 {
+		var cols []string
+		for _, c := range t.columns {
+			cols = append(cols, quoteIdent(c))
+		}
+		s += " (" + strings.Join(cols, ", ") + ")"
+	}
+	return s
+}
+
+// loadFile loads the file name from the byte offset pos, the start of a
+// row, in chunks of the given rows, saving the offset reached after
+// each.
+func loadFile(db *target, logFile *os.File, name string, pos int64, t *loadTable, rows int) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if pos == 0 && len(t.columns) > 0 {
+		// Skip the header line.
+		first, err := bufio.NewReader(f).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		pos = int64(len(first))
+	}
+	if _, err := f.Seek(pos, io.SeekStart); err != nil {
+		return err
+	}
+	next := rowBoundaries(bufio.NewReaderSize(f, 1<<20), pos, t.tsv, rows)
+	stmt := t.statement()
+	for {
+		stopIfInterrupted(logFile, pos)
+		end, n, err := next()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+		loadChunk.f, loadChunk.start, loadChunk.end = f, pos, end
+		waitTurn(1, int(end-pos))
+		start := time.Now()
+		if err := db.exec(stmt); err != nil {
+			return fmt.Errorf("rows at offset %d: %v", pos, err)
+		}
+		log.Printf("%s: loaded %d rows (%s) into %s in %v", filepath.Base(name), n, humanSize(end-pos), t.table, time.Since(start).Round(time.Millisecond))
+		pos = end
+		if err := save(logFile, logLine{Position: pos}); err != nil {
+			return err
+		}
+	}
+}
+
+// rowBoundaries returns a function returning the offset of the end of
+// the next chunk of up to rows rows read from r, which starts at offset
+// pos, and the number of rows in it. A CSV row may span lines within
+// quotes, and a TSV row lines ending with a newline escaped by a
+// backslash, as SELECT ... INTO OUTFILE and mysqldump --tab write them.
+func rowBoundaries(r io.Reader, pos int64, tsv bool, rows int) func() (int64, int, error) {
+	if tsv {
+		br := bufio.NewReader(r)
+		return func() (int64, int, error) {
+			n := 0
+			// inRow is whether a row was started, and backslashes the
+			// number of backslashes ending what was read of it.
+			inRow, backslashes := false, 0
+			for n < rows {
+				line, err := br.ReadSlice('\n')
+				pos += int64(len(line))
+				if len(line) > 0 {
+					inRow = true
+				}
+				if err == bufio.ErrBufferFull {
+					backslashes = trailingBackslashes(line, backslashes)
+					continue
+				}
+				if err == io.EOF {
+					if inRow {
+						n++
+					}
+					break
+				}
+				if err != nil {
+					return 0, 0, err
+				}
+				if trailingBackslashes(line[:len(line)-1], backslashes)%2 == 1 {
+					backslashes = 0
+					continue
+				}
+				n++
+				inRow, backslashes = false, 0
+			}
+			return pos, n, nil
+		}
+	}
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord, cr.ReuseRecord = -1, true
+	return func() (int64, int, error) {
+		n := 0
+		for n < rows {
+			if _, err := cr.Read(); err == io.EOF {
+				break
+			} else if err != nil {
+				return 0, 0, err
+			}
+			n++
+		}
+		return pos + cr.InputOffset(), n, nil
+	}
+}
+
+// trailingBackslashes returns the number of backslashes ending b, which
+// follows n of them if b is made only of backslashes.
+func trailingBackslashes(b []byte, n int) int {
+	i := len(b)
+	for i > 0 && b[i-1] == '\\' {
+		i--
+	}
+	if i == 0 {
+		return n + len(b)
+	}
+	return len(b) - i
+}
@@ -0,0 +1,152 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"flag"
+	"log"
+	"time"
+)
+
+var (
+	logEveryN      = flag.Int("log-every-n", 1, "Log one summary line per this many statements rather than one line per statement")
+	logPerTable    = flag.Bool("log-per-table", false, "Log one summary line per table rather than one line per statement")
+	redactLiterals = flag.Bool("redact-literals", false, "Replace string and numeric literals with ? in logged statements")
+)
+
+// logSummary accumulates the statements replayed since the last
+// summary line was logged.
+type logSummary struct {
+	table      string
+	statements int
+	bytes      int64
+	exec       time.Duration
+	slowest    time.Duration
+	at         string
+}
+
+var summary logSummary
+
+// logStatement logs that stmt, between start and pos of a dump of the
+// given size, was replayed in d with the error err, either on its own
+// line or as part of a summary, or as a record with -log-format=json.
+func logStatement(stmt []byte, start, pos, size int64, d time.Duration, err error) {
+	logTelemetry()
+	countProgress(pos, 1)
+	observeStatement(stmt, pos, err)
+	if jsonLog() {
+		logEvent(logRecord{Event: "statement", Start: start, Position: pos, DurationMS: int64(d / time.Millisecond),
+			Bytes: len(stmt), StatementPrefix: excerpt(stmt), Table: classify(stmt).Table}, err)
+		return
+	}
+	at := progressMark(pos, size)
+	if *logEveryN <= 1 && !*logPerTable {
+		if !*verbose && *progressInterval > 0 {
+			return
+		}
+		log.Printf("%s %7dms %7d %q", at, d/time.Millisecond, len(stmt), excerpt(stmt))
+		return
+	}
+
+	if *logPerTable {
+		if t := classify(stmt).Table; t != "" && t != summary.table {
+			flushLog()
+			summary.table = t
+		}
+	}
+	summary.statements++
+	summary.bytes += int64(len(stmt))
+	summary.exec += d
+	if d > summary.slowest {
+		summary.slowest = d
+	}
+	summary.at = at
+	if *logEveryN > 1 && summary.statements >= *logEveryN {
+		flushLog()
+	}
+}
+
+// flushLog logs the summary of the statements not logged yet.
+func flushLog() {
+	s := summary
+	if s.statements == 0 {
+		return
+	}
+	summary = logSummary{table: s.table}
+	log.Printf("%s %7d statements %10d bytes %7dms total %7dms slowest %s",
+		s.at, s.statements, s.bytes, s.exec/time.Millisecond, s.slowest/time.Millisecond, s.table)
+}
+
+// redactedExcerpt returns the start of stmt for logging, with its
+// quoted strings and numbers replaced by "?". Unlike excerpt, it does
+// not show the end of long statements, which might be in the middle of
+// a literal.
+func redactedExcerpt(stmt []byte) string {
+	const max = 80
+	var out []byte
+	for i := 0; i < len(stmt); {
+		if len(out) > max {
+			return string(out[:max-5]) + "[...]"
+		}
+		c := stmt[i]
+		switch {
+		case c == '\'' || c == '"':
+			// Skip to the closing quote, which may be escaped with a
+			// backslash or by doubling it.
+			i++
+			for i < len(stmt) {
+				if stmt[i] == '\\' {
+					i += 2
+					continue
+				}
+				if stmt[i] == c {
+					if i+1 < len(stmt) && stmt[i+1] == c {
+						i += 2
+						continue
+					}
+					break
+				}
+				i++
+			}
+			out = append(out, '?')
+			i++
+		case c == '`':
+			j := i + 1
+			for j < len(stmt) && stmt[j] != '`' {
+				j++
+			}
+			if j < len(stmt) {
+				j++
+			}
+			out = append(out, stmt[i:j]...)
+			i = j
+		case '0' <= c && c <= '9' && (i == 0 || !isIdentByte(stmt[i-1])):
+			for i < len(stmt) && (isIdentByte(stmt[i]) || stmt[i] == '.' ||
+				(stmt[i] == '+' || stmt[i] == '-') && (stmt[i-1] == 'e' || stmt[i-1] == 'E')) {
+				i++
+			}
+			out = append(out, '?')
+		default:
+			out = append(out, c)
+			i++
+		}
+	}
+	return string(out)
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || c == '$' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || c >= 0x80
+}
@@ -17,33 +17,26 @@
 // is gained by saving the current state after each query.
 package main
 
-// TODO: save the /*!... */ queries and replay them when restarting from a checkpoint.
-// TODO: speed up the replay by issuing queries concurrently.
-
 import (
 	"bufio"
-	"bytes"
-	"crypto/tls"
-	"crypto/x509"
-	"database/sql"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
-	"syscall"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-sql-driver/mysql"
-	"golang.org/x/crypto/ssh/terminal"
 )
 
 var (
-	dump       = flag.String("dump", "", "MySQL dump file")
 	dsn        = flag.String("dsn", "user:password@tcp(0.0.0.0:3306)/", "MySQL Data Source Name")
 	enableSsl  = flag.Bool("enable_ssl", false, "Connect to MySQL with SSL")
 	prompt     = flag.Bool("prompt", false, "Prompt for password rather than specifying in the command. Change dsn format to 'user@tcp(0.0.0.0:3306)/'")
@@ -51,228 +44,755 @@ var (
 	sslCert    = flag.String("ssl_cert", "client-cert.pem", "MySQL Client PEM cert file")
 	sslKey     = flag.String("ssl_key", "client-key.pem", "MySQL Client PEM key file")
 	serverName = flag.String("server_name", "project:instance", "Cloud SQL project and instance name")
+	teeOut     = flag.String("tee", "", "Also write every replayed statement to this file")
+	noExec     = flag.Bool("no-exec", false, "Do not connect to MySQL; only write statements to the -tee file")
+	cpPath     = flag.String("checkpoint", "", "Checkpoint log file (default \"<dump>.log\" in the current directory)")
 )
 
+// checkpointName returns the name of the checkpoint log of the dump.
+// Several dumps share the log of the first, and the files of a mydumper
+// or mysqldump --tab directory that of the directory.
+func checkpointName(dumpName string) string {
+	if *cpPath != "" {
+		return *cpPath
+	}
+	if *dumpFormat != "sql" {
+		dumpName = dumpFlags[0]
+	} else if len(dumpNames) > 1 {
+		dumpName = dumpNames[0]
+	}
+	return filepath.Base(dumpName) + ".log"
+}
+
 type logLine struct {
 	Position int64
+	// Break names the breakpoint that paused the import at Position.
+	Break string `json:",omitempty"`
+	// Done lists the ranges of the dump after Position that parallel
+	// workers already replayed.
+	Done [][2]int64 `json:",omitempty"`
+	// Session is the session statement, such as SET NAMES, replayed
+	// just before Position, in the form it was executed.
+	Session string `json:",omitempty"`
+	// Dump identifies the dump, on the first line of the log.
+	Dump *dumpIdentity `json:",omitempty"`
+	// File names the dump, of several given by -dump, whose import
+	// starts at this line.
+	File string `json:",omitempty"`
+	// Delimiter is the statement delimiter in effect at Position, when
+	// inside a DELIMITER block.
+	Delimiter string `json:",omitempty"`
+	// Resume is the access point of a compressed dump, at or before
+	// Position, that decompression restarts from on resume, when it
+	// changed.
+	Resume *accessPoint `json:",omitempty"`
 }
 
-// recover recovers the last checkpoint offset.
-func recover(filename string) (int64, error) {
+// checkpoint is the import state recovered from the log.
+type checkpoint struct {
+	Position int64
+	// Breaks holds the breakpoints that already paused the import,
+	// which must not pause it again.
+	Breaks map[string]bool
+	// Done lists the ranges of the dump after Position that were
+	// already replayed.
+	Done [][2]int64
+	// Session holds the session statements in effect at Position, to
+	// execute again before resuming.
+	Session []string
+	// Dump identifies the dump the log was written for, if recorded.
+	Dump *dumpIdentity
+	// File is the dump being imported, of several given by -dump.
+	File string
+	// Delimiter is the statement delimiter in effect at Position, or ""
+	// for ";".
+	Delimiter string
+	// Resume is the access point of a compressed dump to resume from.
+	Resume *accessPoint
+	// found and compressed tell whether the log exists, and whether
+	// it is gzip-compressed.
+	found, compressed bool
+}
+
+// apply updates cp with the log line ll.
+func (cp *checkpoint) apply(ll *logLine) {
+	cp.Position, cp.Done, cp.Delimiter = ll.Position, ll.Done, ll.Delimiter
+	if ll.Break != "" {
+		cp.Breaks[ll.Break] = true
+	}
+	if ll.Session != "" {
+		cp.Session = addToPrelude(cp.Session, ll.Session)
+	}
+	if ll.Dump != nil {
+		cp.Dump = ll.Dump
+	}
+	if ll.Resume != nil {
+		cp.Resume = ll.Resume
+	}
+	if ll.File != "" {
+		if cp.File != "" && ll.File != cp.File {
+			// The state of the previous dump does not carry over.
+			cp.Breaks, cp.Session, cp.Dump, cp.Resume = map[string]bool{}, nil, nil, nil
+		}
+		cp.File = ll.File
+	}
+}
+
+// recover recovers the last checkpoint.
+func recover(filename string) (*checkpoint, error) {
+	cp := &checkpoint{Breaks: map[string]bool{}}
 	f, err := os.Open(filename)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return 0, nil
+			return cp, nil
 		}
-		return 0, err
+		return nil, err
 	}
 	defer f.Close()
-	s := bufio.NewScanner(f)
-	last := int64(0)
-	for s.Scan() {
+	cp.found = true
+	r, compressed, err := logReader(f)
+	if err != nil {
+		return nil, err
+	}
+	cp.compressed = compressed
+	s := bufio.NewScanner(r)
+	for first := true; s.Scan(); first = false {
+		line := s.Bytes()
+		if first {
+			header, err := readLogHeader(line)
+			if err != nil {
+				return nil, err
+			}
+			if header {
+				continue
+			}
+		}
+		if logCipher != nil {
+			if line, err = openLine(line); err != nil {
+				return nil, err
+			}
+		}
 		ll := &logLine{}
-		err = json.Unmarshal(s.Bytes(), ll)
+		err = json.Unmarshal(line, ll)
 		if err != nil {
-			return 0, err
+			return nil, err
 		}
-		last = ll.Position
+		cp.apply(ll)
 	}
-	if err := s.Err(); err != nil {
-		return 0, err
+	// A compressed log ends with a stream that was flushed, not closed.
+	if err := s.Err(); err != nil && !(compressed && err == io.ErrUnexpectedEOF) {
+		return nil, err
 	}
-	return last, nil
+	return cp, nil
 }
 
-func save(f *os.File, pos int64) error {
-	b, err := json.Marshal(logLine{Position: pos})
-	if err != nil {
+// saveBuf is reused by save to avoid allocating for every statement.
+var saveBuf []byte
+
+func save(f *os.File, ll logLine) error {
+	b := saveBuf[:0]
+	if ll.Delimiter == "" {
+		ll.Delimiter = delimiterAt(ll.Position)
+	}
+	if ll.Resume == nil && replayDump != nil {
+		ll.Resume = replayDump.resumePoint(ll.Position)
+	}
+	if ll.Break == "" && len(ll.Done) == 0 && ll.Session == "" && ll.Dump == nil && ll.File == "" && ll.Delimiter == "" && ll.Resume == nil {
+		// The common case, written after every statement, is encoded
+		// by hand. It is the same as what json.Marshal produces.
+		b = append(b, `{"Position":`...)
+		b = strconv.AppendInt(b, ll.Position, 10)
+		b = append(b, '}')
+	} else {
+		m, err := json.Marshal(ll)
+		if err != nil {
+			return err
+		}
+		b = append(b, m...)
+	}
+	if logCipher != nil {
+		sealed, err := sealLine(b)
+		if err != nil {
+			return err
+		}
+		b = append(b[:0], sealed...)
+	}
+	saveBuf = append(b, '\n')
+	if err := writeLog(f, saveBuf, ll.Break != ""); err != nil {
 		return err
 	}
-	_, err = f.Write(append(b, '\n'))
-	if err != nil {
+	if err := logged(f, &ll, len(saveBuf)); err != nil {
 		return err
 	}
-	return f.Sync()
+	observeCheckpoint(ll.Position)
+	return saveToTable(&ll)
 }
 
-// replay replays a MySQL line. Returns false if more data is needed.
-func replay(db *sql.DB, line []byte, pos int64, size int64) bool {
-	// A comment line starts either with "#" or a "-- ". A "--" is
-	// also a valid comment line. A regular line ends with a ";",
-	//
-	// Reference: http://dev.mysql.com/doc/refman/5.5/en/comments.html
-	if len(line) == 0 ||
-		bytes.Equal(line, []byte("--")) ||
-		bytes.HasPrefix(line, []byte("-- ")) ||
-		bytes.HasPrefix(line, []byte("#")) {
-		return true
+// excerpt shortens a statement for logging, without converting all of
+// it to a string. With -redact-literals, its literals are masked.
+func excerpt(b []byte) string {
+	if *redactLiterals {
+		return redactedExcerpt(b)
 	}
-
-	if line[len(line)-1] != ';' {
-		return false
+	if len(b) > 80 {
+		return string(b[:60]) + "[...]" + string(b[len(b)-10:])
 	}
+	return string(b)
+}
+
+// teeBuf is reused by replay to write statements to the tee file.
+var teeBuf []byte
 
-	s := string(line)
-	start := time.Now()
-	_, err := db.Exec(s)
-	since := time.Since(start)
-	if len(s) > 80 {
-		s = s[:60] + "[...]" + s[len(s)-10:]
+// replay replays the MySQL statement line, which spans the bytes from
+// start to pos of the dump. The statement is written to tee when it is
+// not nil, and only executed when db is not nil. Breakpoints are only
+// honored when logFile is not nil. The error returned is fatal.
+func replay(db *target, tee io.Writer, logFile *os.File, line []byte, start, pos, size int64) error {
+	stmt := rewrite(line)
+	if stmt == nil {
+		log.Printf("%s skipping %q", progressMark(pos, size), excerpt(line))
+		recordError(start, pos, line, nil, "skipped")
+		return nil
 	}
-	log.Printf("%.2f %7dms %7d %q", float64(pos)/float64(size), since/time.Millisecond, len(line), s)
 
-	if err != nil {
-		if merr, ok := err.(*mysql.MySQLError); ok && merr.Number == 1062 {
-			log.Printf(`ignoring "duplicate entry" error`)
-		} else {
-			log.Fatal(err)
+	if logFile != nil {
+		stopName := stopBefore(start, pos)
+		breakName := ""
+		if stopName == "" {
+			breakName = breakpoint(stmt)
+		}
+		if stopName != "" || breakName != "" || atomic.LoadInt32(&interrupted) != 0 {
+			if err := flushBeforeHalt(db, logFile, start, size); err != nil {
+				return err
+			}
 		}
+		stopIfInterrupted(logFile, start)
+		if stopName != "" {
+			stop(logFile, start, stopName)
+		}
+		if breakName != "" {
+			pause(logFile, start, breakName)
+		}
+	}
+	if db != nil {
+		waitForStorage(db)
 	}
 
-	return true
+	parts := splitStatement(stmt)
+	if parts == nil {
+		return execute(db, tee, stmt, start, pos, size)
+	}
+	log.Printf("splitting %d-byte statement into %d statements", len(stmt), len(parts))
+	for _, p := range parts {
+		if err := execute(db, tee, p, start, pos, size); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func main() {
-	flag.Parse()
-
-	if *dump == "" {
-		log.Fatalf("no -dump file specified")
+// execute writes stmt to the tee file and executes it on the target.
+func execute(db *target, tee io.Writer, stmt []byte, start, pos, size int64) error {
+	if tee != nil {
+		// A single Write per statement, as chunkWriter expects.
+		teeBuf = appendStatement(teeBuf[:0], stmt)
+		if _, err := tee.Write(teeBuf); err != nil {
+			log.Fatalf("Error writing to tee file: %v", err)
+		}
 	}
 
-	var finalDsn = *dsn
-	if *enableSsl {
-		pem, err := ioutil.ReadFile(*sslCa)
-		if err != nil {
-			log.Fatalln("ioutil.Readline:", err)
+	if *dryRun {
+		dryRunStatements++
+		dryRunBytes += int64(len(stmt))
+		countProgress(pos, 1)
+		log.Printf("dry-run: bytes %d to %d, %d bytes: %q", start, pos, len(stmt), excerpt(stmt))
+		return nil
+	}
+	if db != nil {
+		if batchable(stmt) {
+			return addToBatch(db, stmt, start, pos, size)
 		}
-		rootCertPool := x509.NewCertPool()
-		if ok := rootCertPool.AppendCertsFromPEM(pem); !ok {
-			log.Fatal("Failed to append CA certificate PEM.")
+		if err := flushBatch(db, size); err != nil {
+			return err
 		}
-		clientCert := []tls.Certificate{}
-		certs, err := tls.LoadX509KeyPair(*sslCert, *sslKey)
+	}
+	return executeNow(db, stmt, start, pos, size)
+}
+
+// executeNow executes stmt on the target, if any.
+func executeNow(db *target, stmt []byte, start, pos, size int64) error {
+	t := time.Now()
+	var err error
+	if db != nil {
+		waitTurn(1, len(stmt))
+		t = time.Now()
+		err = db.exec(string(stmt))
+	}
+	since := time.Since(t)
+	logStatement(stmt, start, pos, size, since, err)
+	if db != nil {
+		trackStatement(stmt, start, pos, since, err)
+	}
+
+	if err != nil {
+		if isDuplicate(err) {
+			log.Printf(`ignoring "duplicate entry" error`)
+			recordError(start, pos, stmt, err, "ignored")
+		} else if skipError(stmt, err) {
+			recordError(start, pos, stmt, err, "ignored")
+		} else {
+			recordError(start, pos, stmt, err, "aborted")
+			return err
+		}
+	}
+	return nil
+}
+
+// connect opens the connection to MySQL described by the flags,
+// prompting for the password if needed.
+func connect() *target {
+	socketDSN()
+	addSecret(dsnPassword(*dsn))
+	setupIAMAuth()
+	setupConnector()
+	watchReplicaLag()
+	checkPoolFlags()
+	params := append(append(sessionParams(), iamParams()...), poolParams()...)
+	params = append(params, packetParams()...)
+	if sslEnabled() {
+		cfg, err := sslConfig()
 		if err != nil {
-			log.Fatalln("tls.LoadX509KeyPair:", err)
+			log.Fatalln(err)
 		}
-		clientCert = append(clientCert, certs)
 		const customTLSName = "custom"
-		tlserr := mysql.RegisterTLSConfig(customTLSName, &tls.Config{
-			RootCAs:      rootCertPool,
-			Certificates: clientCert,
-			ServerName:   *serverName,
-		})
+		tlserr := mysql.RegisterTLSConfig(customTLSName, cfg)
 		if tlserr != nil {
 			log.Fatalln("mysql.RegisterTLSConfig:", tlserr)
 		}
-		finalDsn = strings.Join([]string{finalDsn, "?tls=", customTLSName}, "")
+		params = append(params, "tls="+customTLSName)
 	}
 
+	// DSN strings look like:
+	//     user:password@tcp(0.0.0.0:3306)/
+	// With -prompt the user can avoid typing their password:
+	//     user@tcp(0.0.0.0:3306)/
+	// Save text before ':' and after '@' so we can insert the password
+	// to create a proper DSN string.
+	dsnRegex := regexp.MustCompile(`(\w*):?\w*(@.+)`)
+	var password []byte
 	if *prompt {
-		// DSN strings look like:
-		//     user:password@tcp(0.0.0.0:3306)/
-		// With this flag the user can avoid typing their password:
-		//     user@tcp(0.0.0.0:3306)/
-		// Save text before ':' and after '@' so we can insert the password
-		// to create a proper DSN string.
-		dsnRegex := regexp.MustCompile(`(\w*):?\w*(@.+)`)
-		matches := dsnRegex.FindStringSubmatch(finalDsn)
-		if matches == nil {
+		if !dsnRegex.MatchString(*dsn) {
 			fmt.Print("Incorrect format for dsn. Usage:\n")
 			flag.PrintDefaults()
 			os.Exit(1)
 		}
 
-		fmt.Print("Enter password: ")
-		// Don't echo password to screen during input.
-		password, err := terminal.ReadPassword(int(syscall.Stdin))
-		if err != nil {
+		var err error
+		if password, err = readPassword(); err != nil {
 			log.Fatalln("Error reading password:", err)
 		}
-		// ReadPassword() leaves cursor on the input line,
-		// so begin output on the next line
-		fmt.Print("\n")
+		addSecret(string(password))
+	}
+
+	flagPw, hasFlagPw := flagPassword()
+	var vaultUser, vaultPassword string
+	if *vaultPath != "" {
+		var err error
+		if vaultUser, vaultPassword, err = vaultCredentials(); err != nil {
+			log.Fatalln("read MySQL credentials from Vault:", err)
+		}
+	}
 
-		// Insert password into the connection string.
-		finalDsn = strings.Join([]string{matches[1], ":", string(password), matches[2]}, "")
+	// completeDSN adds the TLS configuration, the session variables,
+	// the prompted, Vault or -password-env/-password-file credentials
+	// and the -cloudsql-instance to a DSN given on the command line.
+	completeDSN := func(d string) string {
+		for _, p := range params {
+			if strings.Contains(d, "?") {
+				d += "&" + p
+			} else {
+				d += "?" + p
+			}
+		}
+		if matches := dsnRegex.FindStringSubmatch(d); *prompt && matches != nil {
+			// Insert password into the connection string.
+			d = strings.Join([]string{matches[1], ":", string(password), matches[2]}, "")
+		}
+		if *vaultPath != "" {
+			var err error
+			if d, err = withCredentials(d, vaultUser, vaultPassword); err != nil {
+				log.Fatalln("DSN:", err)
+			}
+		}
+		if hasFlagPw {
+			var err error
+			if d, err = withPassword(d, flagPw); err != nil {
+				log.Fatalln("DSN:", err)
+			}
+		}
+		d, err := connectorDSN(d)
+		if err != nil {
+			log.Fatalln("DSN:", err)
+		}
+		return d
+	}
+	dsns := []string{completeDSN(*dsn)}
+	if *failoverDsn != "" {
+		addSecret(dsnPassword(*failoverDsn))
+		dsns = append(dsns, completeDSN(*failoverDsn))
 	}
 
-	db, err := sql.Open("mysql", finalDsn)
+	db, err := openTarget(dsns)
 	if err != nil {
 		log.Fatalln("sql.Open:", err)
 	}
-	defer db.Close()
+	return db
+}
+
+func main() {
+	log.SetOutput(&redactingWriter{w: stderr})
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "transform":
+			transformCmd(os.Args[2:])
+			return
+		case "plan":
+			planCmd(os.Args[2:])
+			return
+		case "history":
+			historyCmd(os.Args[2:])
+			return
+		case "estimate":
+			estimateCmd(os.Args[2:])
+			return
+		case "validate":
+			validateCmd(os.Args[2:])
+			return
+		case "verify":
+			verifyCmd(os.Args[2:])
+			return
+		case "serve":
+			serveCmd(os.Args[2:])
+			return
+		case "ingest":
+			ingestCmd(os.Args[2:])
+			return
+		case "send":
+			sendCmd(os.Args[2:])
+			return
+		case "coordinate":
+			coordinateCmd(os.Args[2:])
+			return
+		case "agent":
+			agentCmd(os.Args[2:])
+			return
+		case "load":
+			loadCmd(os.Args[2:])
+			return
+		}
+	}
+	flag.Parse()
+	useCanaryDSN()
+	setLogFormat()
+	setupFastImport()
+	serveMetrics()
+	serveStatus()
 
-	f, err := os.Open(*dump)
+	if err := expandDumps(); err != nil {
+		log.Fatalf("-dump: %v", err)
+	}
+	if len(dumpNames) == 0 {
+		log.Fatalf("no -dump file specified")
+	}
+	if *tableConcurrency > 1 && *dumpFormat == "sql" {
+		log.Fatalf("-table-concurrency needs -format=mydumper or -format=tab")
+	}
+	*dump = dumpNames[0]
+	if *dialect == "postgres" {
+		importPostgres()
+		return
+	}
+	if *noExec {
+		if *teeOut == "" {
+			log.Fatalf("-no-exec requires a -tee file")
+		}
+		// Nothing reaches the database, so the checkpoint log of a
+		// real import must be neither consulted nor advanced.
+		transformDump(*dump, *teeOut)
+		return
+	}
+	if *tuneFlags && !*dryRun && os.Getenv(tunedEnv) == "" {
+		os.Exit(importWithTunedFlags())
+	}
+	names := dumpsToImport()
+	for i := 0; i < len(names); i++ {
+		*dump = names[i]
+		if dataTable(names[i]) != "" && concurrentTables() {
+			j := i
+			for j < len(names) && dataTable(names[j]) != "" {
+				j++
+			}
+			importTables(names[i:j])
+			i = j - 1
+			continue
+		}
+		if isTabData(names[i]) {
+			importTabData()
+			continue
+		}
+		importDump()
+	}
+}
+
+// importDump imports -dump.
+func importDump() {
+	f, err := openDump(*dump)
 	if err != nil {
-		log.Fatalf("os.Open: %v", err)
+		log.Fatalf("open dump: %v", err)
 	}
 	defer f.Close()
-	dumpInfo, err := f.Stat()
+	size, err := f.Size()
 	if err != nil {
-		log.Fatalf("Stat: %v", err)
+		log.Fatalf("dump size: %v", err)
+	}
+	if f.piped() {
+		// These read the dump before or after the import.
+		for name, set := range map[string]bool{
+			"plan":               *planFile != "",
+			"canary-dsn":         *canaryDsn != "",
+			"changed-only":       *changedOnly != "",
+			"skip-to-table":      *skipToTable != "",
+			"defer-foreign-keys": *deferForeignKeys,
+			"verify-sample":      *verifySample > 0,
+			"verify":             *verifyMode != "none",
+			"start-offset":       *startOffset >= 0,
+		} {
+			if set {
+				log.Fatalf("-%s cannot be used with a piped dump", name)
+			}
+		}
+	}
+
+	if *planFile != "" {
+		if err := checkPlan(*planFile, f); err != nil {
+			log.Fatalf("-plan %q: %v", *planFile, err)
+		}
+		log.Printf("dump and flags match the plan in %q", *planFile)
+	}
+	if *dryRun {
+		dryRunImport(f, size)
+		return
+	}
+	if *canaryDsn != "" && os.Getenv(canaryEnv) == "" {
+		importCanary(f, size)
+	}
+
+	db := connect()
+	defer db.close()
+
+	inspectTarget(context.Background(), db.db, size)
+	detectPacketLimit(db)
+	if f.piped() {
+		log.Printf("compatibility: not checked for a piped dump")
+	} else {
+		checkCompatibility(db.db, f.from(0))
 	}
-	size := dumpInfo.Size()
 
-	logFilename := fmt.Sprintf("%s.log", dumpInfo.Name())
-	pos, err := recover(logFilename)
+	logFilename := checkpointName(f.Name())
+	if err := recoverFromTable(db, logFilename); err != nil {
+		log.Fatalf("recover from -checkpoint-table: %v", err)
+	}
+	cp, err := recover(logFilename)
 	if err != nil {
 		log.Fatalf("recover from log: %v", err)
 	}
+	if dumpIndex(cp.File) > dumpIndex(*dump) {
+		log.Printf("%q was imported before %q, skipping it", *dump, cp.File)
+		return
+	}
+	newFile := len(dumpNames) > 1 && cp.File != *dump
+	if newFile && !(cp.File == "" && *dump == dumpNames[0]) {
+		cp = cp.startFile(*dump)
+	}
+	if *startOffset >= 0 {
+		full, err := f.decompressedSize()
+		if err != nil {
+			log.Fatalf("dump size: %v", err)
+		}
+		cp = startAt(f, full, cp)
+	}
+	startTableCheckpoint(cp)
+	id := checkResume(f, cp)
+	pos := cp.Position
+	f.resumeFrom(cp.Resume)
+	breaksHit = cp.Breaks
+	startDelimiter = cp.Delimiter
+	progress = &frontier{pos: pos, done: cp.Done}
+	if pos != 0 && !f.piped() {
+		findSourceDB(f)
+	}
+	if err := db.restoreSession(cp.Session); err != nil {
+		log.Fatalf("restore session: %v", err)
+	}
+	if err := useDatabase(db); err != nil {
+		log.Fatalf("select the database of %q: %v", *dump, err)
+	}
+	var digests map[string]*tableDigest
+	if *changedOnly != "" {
+		digests = skipUnchangedTables(db, f)
+	}
+	if *skipToTable != "" {
+		skipTo(f)
+	}
+	checkStatementSizes(f, pos)
 	if pos != 0 {
 		log.Printf("seeking to %d in %q", pos, f.Name())
-		if _, err = f.Seek(pos, os.SEEK_SET); err != nil {
+		if _, err = f.Seek(pos, io.SeekStart); err != nil {
 			log.Fatalf("Seek: %v", err)
 		}
 	}
 
-	logFile, err := os.OpenFile(logFilename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	logFile, err := openLog(logFilename, cp)
 	if err != nil {
-		log.Fatalf("os.OpenFile: %v", err)
+		log.Fatalf("open checkpoint log: %v", err)
 	}
 	defer logFile.Close()
+	if newFile {
+		if err := save(logFile, logLine{Position: progress.pos, File: *dump}); err != nil {
+			log.Fatalf("Error saving to log: %v", err)
+		}
+	}
+	if *startOffset >= 0 {
+		if err := save(logFile, logLine{Position: pos}); err != nil {
+			log.Fatalf("Error saving to log: %v", err)
+		}
+	}
+	if id != nil && (cp.Dump == nil || *cp.Dump != *id) {
+		if err := save(logFile, logLine{Position: progress.pos, Done: progress.done, Dump: id}); err != nil {
+			log.Fatalf("Error saving to log: %v", err)
+		}
+	}
 
-	// buf[i:j] are the bytes that have been read from f but not
-	// yet replayed. k indicates up to where we read in a
-	// multi-line query.
-	buf := make([]byte, 1024*1024)
-	i, j, k, readErr := 0, 0, 0, error(nil)
+	catchSignals()
+	startRun(f, pos)
+	if jsonLog() {
+		logEvent(logRecord{Event: "started", Position: pos}, nil)
+	}
+	if err := openErrorReport(pos != 0); err != nil {
+		log.Fatalf("open error report: %v", err)
+	}
+
+	var tee io.Writer
+	if *teeOut != "" {
+		// Statements before the checkpoint were already teed by the
+		// previous run, so only truncate when starting from scratch.
+		teeFile, err := createOutput(*teeOut, pos != 0)
+		if err != nil {
+			log.Fatalf("create tee file: %v", err)
+		}
+		defer teeFile.Close()
+		tee = teeFile
+	}
+
+	run(db, tee, f, pos, size, logFile)
+	if err := closeLog(logFile); err != nil {
+		log.Fatalf("close checkpoint log: %v", err)
+	}
+	endFastImport(db)
+	if digests != nil {
+		writeManifest(digests)
+	}
+	if *deferForeignKeys {
+		validateForeignKeys(db, f)
+	}
+	if *verifySample > 0 {
+		verifySampledRows(db, f)
+	}
+	if *verifyMode == "rowcount" {
+		verifyRowCounts(db, f)
+	}
+}
+
+// run replays the statements of f, which is positioned at pos, until
+// EOF. The checkpoint is saved to logFile after each statement unless
+// logFile is nil.
+func run(db *target, tee io.Writer, f *dumpFile, pos, size int64, logFile *os.File) {
+	if maxWorkers() > 1 && db != nil && logFile != nil {
+		runParallel(db, tee, f, pos, size, logFile)
+		return
+	}
+	replayDump = f
+	if f.compressed() {
+		compressedProgress = f.compressedProgress
+	}
+	startProgress(pos, size)
+	observeCheckpoint(pos)
+	r := newStmtReader(f, pos)
+	r.SetDelimiter(startDelimiter)
+	replayReader = r
+	fail := func(start, end int64, err error) {
+		flushLog()
+		if logFile != nil {
+			closeLog(logFile)
+			reportFailure(db, f, start, end, err)
+		}
+		recordRun("failed", start, err)
+		log.Fatal(err)
+	}
+	batching = *batchSize > 1
 	for {
-		if p := bytes.IndexByte(buf[k:j], '\n'); p >= 0 {
-			k += p + 1 // The +1 is for the trailing '\n'.
-			pos += int64(p + 1)
-			if replay(db, buf[i:k-1], pos, size) {
-				i = k
-				err = save(logFile, pos)
-				if err != nil {
+		stmt, err := r.Next()
+		if err == io.EOF && batchPending() {
+			// The last batch is executed before the checkpoint
+			// reaches the end of the dump.
+			last := batch.stmts[len(batch.stmts)-1]
+			if err := flushBatch(db, size); err != nil {
+				fail(last.start, last.pos, err)
+			}
+			if logFile != nil {
+				progress.complete(progress.pos, r.Pos)
+				if err := save(logFile, logLine{Position: progress.pos, Done: progress.done}); err != nil {
 					log.Fatalf("Error saving to log: %v", err)
 				}
 			}
+		}
+		if err == io.EOF {
+			flushLog()
+			stopProgress()
+			if db != nil {
+				logSkippedErrors()
+			}
+			recordRun("completed", r.Pos, nil)
+			return
+		}
+		if err != nil {
+			recordRun("failed", r.Start, err)
+			log.Fatalf("%q: %v", f.Name(), err)
+		}
+		if progress != nil && progress.replayed(r.Start, r.Pos) {
 			continue
 		}
-
-		if readErr != nil {
-			if readErr == io.EOF {
-				if i != j {
-					log.Println(i, j)
-					log.Fatalf(`The contents of %q do not end with a "\n"`, *dump)
-				}
-				return
+		warnBinary(r, size)
+		if err := replay(db, tee, logFile, stmt, r.Start, r.Pos, size); err != nil {
+			fail(r.Start, r.Pos, err)
+		}
+		if batchPending() {
+			// The checkpoint only moves past batches once executed.
+			continue
+		}
+		session := ""
+		if db != nil {
+			if session = sessionStatement(stmt); session != "" {
+				db.setSession(session)
 			}
-			log.Fatal(readErr)
-		}
-
-		// First, make sure at least half of the buffer is empty. If we can do
-		// that by moving the contents of buf[i:j] to the start of the existing
-		// buffer, that's great. Otherwise, allocate a bigger buffer.
-		newBuf := buf
-		if j-i > len(buf)/2 {
-			newBuf = make([]byte, len(buf)*2)
-		}
-		i, j, k = 0, copy(newBuf, buf[i:j]), k-i
-		buf = newBuf
-		// Read some more bytes.
-		var n int
-		n, readErr = f.Read(buf[j:])
-		j += n
+		}
+		if logFile != nil {
+			// Everything before the statement was replayed, including
+			// the batched statements executed with it.
+			progress.complete(progress.pos, r.Pos)
+			if err := save(logFile, logLine{Position: progress.pos, Done: progress.done, Session: session}); err != nil {
+				log.Fatalf("Error saving to log: %v", err)
+			}
+		}
 	}
 }
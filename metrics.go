@@ -0,0 +1,167 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+var metricsAddr = flag.String("metrics-addr", "", "Address (e.g. :9100) on which to serve Prometheus metrics at /metrics")
+
+// throughputWindow is the period over which the throughput metric is
+// measured.
+const throughputWindow = 10 * time.Second
+
+// metrics holds the figures published at /metrics.
+var metrics struct {
+	sync.Mutex
+	bytes, statements int64
+	errors            map[uint16]int64
+	// pos is the end of the last statement replayed, and checkpoint
+	// the position last saved to the checkpoint log.
+	pos, checkpoint int64
+	lastStatement   time.Time
+	lastPrefix      string
+	lastCheckpoint  time.Time
+	windowStart     time.Time
+	windowBytes     int64
+	throughput      float64
+}
+
+// observeStatement updates the metrics for the statement stmt ending at
+// pos, replayed with the error err.
+func observeStatement(stmt []byte, pos int64, err error) {
+	if *metricsAddr == "" && *statusAddr == "" {
+		return
+	}
+	n := len(stmt)
+	prefix := ""
+	if *statusAddr != "" {
+		prefix = excerpt(stmt)
+	}
+	now := time.Now()
+	metrics.Lock()
+	defer metrics.Unlock()
+	metrics.lastPrefix = prefix
+	metrics.bytes += int64(n)
+	metrics.statements++
+	if err != nil {
+		var code uint16
+		if merr, ok := err.(*mysql.MySQLError); ok {
+			code = merr.Number
+		}
+		if metrics.errors == nil {
+			metrics.errors = map[uint16]int64{}
+		}
+		metrics.errors[code]++
+	}
+	if pos > metrics.pos {
+		metrics.pos = pos
+	}
+	metrics.lastStatement = now
+	if metrics.windowStart.IsZero() {
+		metrics.windowStart = now
+	}
+	metrics.windowBytes += int64(n)
+	if d := now.Sub(metrics.windowStart); d >= throughputWindow {
+		metrics.throughput = float64(metrics.windowBytes) / d.Seconds()
+		metrics.windowStart, metrics.windowBytes = now, 0
+	}
+}
+
+// observeCheckpoint records that the checkpoint was saved at pos.
+func observeCheckpoint(pos int64) {
+	if *metricsAddr == "" && *statusAddr == "" {
+		return
+	}
+	metrics.Lock()
+	metrics.checkpoint, metrics.lastCheckpoint = pos, time.Now()
+	if pos > metrics.pos {
+		metrics.pos = pos
+	}
+	metrics.Unlock()
+}
+
+// serveMetrics starts serving the metrics at -metrics-addr, if set.
+func serveMetrics() {
+	if *metricsAddr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", writeMetrics)
+	if *statusAddr == *metricsAddr {
+		mux.HandleFunc("/status", writeStatus)
+	}
+	go func() {
+		log.Fatalf("metrics: %v", http.ListenAndServe(*metricsAddr, mux))
+	}()
+}
+
+// writeMetrics writes the metrics in the Prometheus text format.
+func writeMetrics(w http.ResponseWriter, r *http.Request) {
+	metrics.Lock()
+	defer metrics.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metric := func(name, kind, help string, value interface{}) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+	}
+	metric("cloudsql_import_bytes_total", "counter", "Bytes of statements replayed.", metrics.bytes)
+	metric("cloudsql_import_statements_total", "counter", "Statements replayed.", metrics.statements)
+
+	fmt.Fprintf(w, "# HELP cloudsql_import_errors_total Statements that failed, by MySQL error number (0 for other errors).\n# TYPE cloudsql_import_errors_total counter\n")
+	var codes []int
+	for c := range metrics.errors {
+		codes = append(codes, int(c))
+	}
+	sort.Ints(codes)
+	for _, c := range codes {
+		fmt.Fprintf(w, "cloudsql_import_errors_total{code=\"%d\"} %d\n", c, metrics.errors[uint16(c)])
+	}
+
+	metric("cloudsql_import_throughput_bytes_per_second", "gauge", "Bytes replayed per second over the last 10 seconds.", currentThroughput())
+	metric("cloudsql_import_position_bytes", "gauge", "Offset in the dump of the end of the last statement replayed.", metrics.pos)
+	meter.Lock()
+	dumpSize := meter.size
+	meter.Unlock()
+	metric("cloudsql_import_dump_size_bytes", "gauge", "Size of the dump, or -1 if unknown.", dumpSize)
+	metric("cloudsql_import_checkpoint_lag_bytes", "gauge", "Bytes replayed past the position saved in the checkpoint.", metrics.pos-metrics.checkpoint)
+	metric("cloudsql_import_last_statement_timestamp_seconds", "gauge", "Time the last statement was replayed.", unixTime(metrics.lastStatement))
+	metric("cloudsql_import_last_checkpoint_timestamp_seconds", "gauge", "Time the checkpoint was last saved.", unixTime(metrics.lastCheckpoint))
+}
+
+// currentThroughput returns the throughput over the last window, or 0 if
+// no statement was replayed since. metrics must be locked.
+func currentThroughput() float64 {
+	if time.Since(metrics.lastStatement) >= throughputWindow {
+		return 0
+	}
+	return metrics.throughput
+}
+
+func unixTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
@@ -0,0 +1,134 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	dumpFlags stringList
+	// dumpNames are the dumps to import, in order, with the globs of
+	// -dump expanded, and dump the one being imported.
+	dumpNames []string
+	dump      = new(string)
+)
+
+func init() {
+	flag.Var(&dumpFlags, "dump", "MySQL dump file; repeat it, or give a glob such as \"dumps/*.sql\", to import several dumps in order")
+}
+
+// multiDumpFlags are the flags that cannot be used with several dumps,
+// since they name a single output or apply to a single dump.
+var multiDumpFlags = []string{"no-exec", "tee", "plan", "changed-only", "skip-to-table", "start-offset", "stop-offset"}
+
+// expandDumps sets dumpNames from -dump, expanding the globs among the
+// local dump names, or listing the files of a mydumper or mysqldump
+// --tab directory.
+func expandDumps() error {
+	dumpNames = nil
+	if *dumpFormat != "sql" && len(dumpFlags) > 0 {
+		if len(dumpFlags) > 1 {
+			return fmt.Errorf("-format=%s takes a single directory", *dumpFormat)
+		}
+		list := mydumperFiles
+		if *dumpFormat == "tab" {
+			list = tabFiles
+		}
+		var err error
+		if dumpNames, err = list(dumpFlags[0]); err != nil {
+			return err
+		}
+	} else {
+		for _, d := range dumpFlags {
+			if isRemoteDump(d) || !strings.ContainsAny(d, "*?[") {
+				dumpNames = append(dumpNames, d)
+				continue
+			}
+			matches, err := filepath.Glob(d)
+			if err != nil {
+				return err
+			}
+			if len(matches) == 0 {
+				return fmt.Errorf("no dump matches %q", d)
+			}
+			dumpNames = append(dumpNames, matches...)
+		}
+	}
+	if files := os.Getenv(tableFilesEnv); files != "" {
+		// A child process of -table-concurrency.
+		dumpNames = filepath.SplitList(files)
+	}
+	if len(dumpNames) <= 1 {
+		return nil
+	}
+	var err error
+	flag.Visit(func(f *flag.Flag) {
+		for _, name := range multiDumpFlags {
+			if f.Name == name {
+				err = fmt.Errorf("-%s cannot be used with several dumps", name)
+			}
+		}
+	})
+	if err == nil && *dialect == "postgres" {
+		err = fmt.Errorf("-dialect=postgres imports a single dump")
+	}
+	return err
+}
+
+// dumpIndex returns the position of the dump name in dumpNames, or -1.
+func dumpIndex(name string) int {
+	for i, d := range dumpNames {
+		if d == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// dumpsToImport returns the dumps left to import: those from the one
+// the shared checkpoint log was at.
+func dumpsToImport() []string {
+	if len(dumpNames) == 1 {
+		return dumpNames
+	}
+	cp, err := recover(checkpointName(dumpNames[0]))
+	if err != nil {
+		log.Fatalf("recover from log: %v", err)
+	}
+	if cp.File == "" {
+		return dumpNames
+	}
+	i := dumpIndex(cp.File)
+	if i < 0 {
+		log.Fatalf("the checkpoint log is at %q, which is not one of the -dump files; give the same dumps in the same order to resume", cp.File)
+	}
+	if i > 0 {
+		log.Printf("resuming at %q, dump %d of %d", cp.File, i+1, len(dumpNames))
+	}
+	return dumpNames[i:]
+}
+
+// startFile returns the checkpoint of the start of the dump name, the
+// one following the dump cp is a checkpoint of.
+func (cp *checkpoint) startFile(name string) *checkpoint {
+	return &checkpoint{Breaks: map[string]bool{}, File: name, found: cp.found, compressed: cp.compressed}
+}
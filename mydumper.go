@@ -0,0 +1,125 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var dumpFormat = choiceFlag("format", "sql", "Layout of -dump; mydumper imports a mydumper output directory, schema files first, and tab the output directory of mysqldump --tab", "sql", "mydumper", "tab")
+
+// mydumperDatabases maps the files of a mydumper directory to the
+// database their statements apply to, which they do not select
+// themselves.
+var mydumperDatabases = map[string]string{}
+
+// mydumperTables maps the data files of a mydumper directory to their
+// table, as "db.table".
+var mydumperTables = map[string]string{}
+
+// mydumperPhases orders the files of a mydumper directory by their
+// suffix: databases, then tables, their data, views, triggers, and
+// routines and events. Data files have no suffix of their own.
+var mydumperPhases = []struct {
+	suffix string
+	phase  int
+}{
+	{"-schema-create.sql", 0},
+	{"-schema-sequence.sql", 1},
+	{"-schema.sql", 1},
+	{"-schema-view.sql", 3},
+	{"-schema-triggers.sql", 4},
+	{"-schema-post.sql", 5},
+}
+
+// mydumperFiles returns the SQL files of the mydumper directory dir in
+// the order they are imported, and records their database.
+func mydumperFiles(dir string) ([]string, error) {
+	if isRemoteDump(dir) {
+		return nil, fmt.Errorf("-format=mydumper needs a local directory")
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	type file struct {
+		name  string
+		phase int
+	}
+	var files []file
+	for _, e := range entries {
+		name := e.Name()
+		base := strings.TrimSuffix(name, filepath.Ext(name))
+		if e.IsDir() || !strings.HasSuffix(name, ".sql") && !strings.HasSuffix(base, ".sql") {
+			// The metadata file, checksums and the like.
+			continue
+		}
+		if !strings.HasSuffix(name, ".sql") {
+			// A compressed file, as "db.table.sql.gz".
+			name = base
+		}
+		phase, database := 2, strings.SplitN(name, ".", 2)[0]
+		for _, p := range mydumperPhases {
+			if strings.HasSuffix(name, p.suffix) {
+				phase = p.phase
+				if p.phase == 0 {
+					database = strings.TrimSuffix(name, p.suffix)
+				}
+				break
+			}
+		}
+		path := filepath.Join(dir, e.Name())
+		if phase != 0 {
+			// The database is created by its own schema file.
+			mydumperDatabases[path] = database
+		}
+		if phase == 2 {
+			mydumperTables[path] = strings.Join(strings.SplitN(name, ".", 3)[:2], ".")
+		}
+		files = append(files, file{path, phase})
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no SQL files in %q", dir)
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].phase < files[j].phase
+	})
+	var names []string
+	for _, f := range files {
+		names = append(names, f.name)
+	}
+	return names, nil
+}
+
+// useDatabase selects the database of the mydumper file being
+// imported, if any, keeping it in the session that a new connection
+// restores.
+func useDatabase(db *target) error {
+	database := mydumperDatabases[*dump]
+	if database == "" {
+		return nil
+	}
+	stmt := "USE " + quoteIdent(database)
+	if err := db.exec(stmt); err != nil {
+		return err
+	}
+	db.setSession(stmt)
+	return nil
+}
@@ -0,0 +1,86 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var notifyURL = flag.String("notify-url", "", "POST a JSON summary of the run to this URL, such as a Slack incoming webhook, when it completes, fails, or is paused, interrupted or stopped")
+
+// notifyTimeout bounds the request to -notify-url.
+const notifyTimeout = 30 * time.Second
+
+// notification is the payload posted to -notify-url. Text is what chat
+// webhooks such as Slack's display.
+type notification struct {
+	Text            string  `json:"text"`
+	Status          string  `json:"status"`
+	Dump            string  `json:"dump"`
+	Target          string  `json:"target"`
+	Position        int64   `json:"position"`
+	BytesReplayed   int64   `json:"bytes_replayed"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	Error           string  `json:"error,omitempty"`
+}
+
+// notify posts the outcome of the run r to -notify-url. Failing to do so
+// is logged but not fatal.
+func notify(r *runRecord) {
+	if *notifyURL == "" {
+		return
+	}
+	n := notification{
+		Status:          r.Outcome,
+		Dump:            r.Dump,
+		Target:          r.Target,
+		Position:        r.FinalOffset,
+		BytesReplayed:   r.FinalOffset - r.StartOffset,
+		DurationSeconds: r.End.Sub(r.Start).Seconds(),
+		Error:           r.Error,
+	}
+	n.Text = fmt.Sprintf("cloudsql-import of %s %s at offset %d: %s replayed in %s",
+		r.Dump, r.Outcome, r.FinalOffset, humanSize(n.BytesReplayed), r.End.Sub(r.Start).Round(time.Second))
+	if r.Error != "" {
+		n.Text += ": " + r.Error
+	}
+	b, err := json.Marshal(n)
+	if err != nil {
+		log.Printf("notify: %v", err)
+		return
+	}
+	client := &http.Client{Timeout: notifyTimeout}
+	resp, err := client.Post(*notifyURL, "application/json", bytes.NewReader(b))
+	if err != nil {
+		// Webhook URLs embed a secret, which is not logged.
+		if ue, ok := err.(*url.Error); ok {
+			err = ue.Err
+		}
+		log.Printf("notify: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		log.Printf("notify: the webhook returned %s", resp.Status)
+	}
+}
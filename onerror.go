@@ -0,0 +1,169 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+var (
+	onError    = choiceFlag("on-error", "abort", "What to do when a statement fails, but for \"duplicate entry\" errors, which are always ignored", "abort", "skip", "prompt")
+	onErrorFor = kindActions{}
+	ignoreErrs = errorCodes{}
+)
+
+func init() {
+	flag.Var(onErrorFor, "on-error-for", "Override -on-error for a kind of statement, as \"CREATE TRIGGER=skip\" (may be repeated)")
+	flag.Var(ignoreErrs, "ignore-errors", "Comma-separated MySQL error numbers, such as 1050,1146, after which the import goes on, whatever -on-error says")
+}
+
+// errorCodes is a flag.Value holding a set of MySQL error numbers.
+type errorCodes map[uint16]bool
+
+func (c errorCodes) String() string {
+	var s []int
+	for n := range c {
+		s = append(s, int(n))
+	}
+	sort.Ints(s)
+	return strings.Trim(fmt.Sprint(s), "[]")
+}
+
+func (c errorCodes) Set(v string) error {
+	for _, f := range strings.Split(v, ",") {
+		n, err := strconv.ParseUint(strings.TrimSpace(f), 10, 16)
+		if err != nil {
+			return fmt.Errorf("%q is not a MySQL error number", f)
+		}
+		c[uint16(n)] = true
+	}
+	return nil
+}
+
+// kindActions is a flag.Value mapping kinds of statements, as classify
+// names them, to what to do when one fails.
+type kindActions map[string]string
+
+func (k kindActions) String() string {
+	var s []string
+	for kind, action := range k {
+		s = append(s, kind+"="+action)
+	}
+	sort.Strings(s)
+	return strings.Join(s, ",")
+}
+
+func (k kindActions) Set(v string) error {
+	i := strings.LastIndex(v, "=")
+	if i < 0 {
+		return fmt.Errorf("%q is not of the form KIND=ACTION", v)
+	}
+	kind, action := strings.Join(strings.Fields(strings.ToUpper(v[:i])), " "), v[i+1:]
+	switch action {
+	case "abort", "skip", "prompt":
+	default:
+		return fmt.Errorf("action %q is not one of abort, skip, prompt", action)
+	}
+	k[kind] = action
+	return nil
+}
+
+// skippedErrors counts the failed statements skipped, by kind.
+var skippedErrors = map[string]int{}
+
+// skipError reports whether the import goes on past stmt, which failed
+// with err, as -ignore-errors, -on-error and -on-error-for tell, in
+// which case the statement is logged and counted.
+func skipError(stmt []byte, err error) bool {
+	kind := classify(stmt).Kind
+	if merr, ok := err.(*mysql.MySQLError); ok && ignoreErrs[merr.Number] {
+		log.Printf("ignoring error %d (-ignore-errors): %v", merr.Number, err)
+		skippedErrors[kind]++
+		return true
+	}
+	action, ok := onErrorFor[kind]
+	if !ok {
+		action = *onError
+	}
+	if action == "prompt" {
+		action = promptError(stmt, kind, err)
+	}
+	if action != "skip" {
+		return false
+	}
+	log.Printf("skipping failed statement: %v", err)
+	skippedErrors[kind]++
+	return true
+}
+
+// promptError asks on the terminal whether to skip stmt, of the given
+// kind, which failed with err, and returns "abort" or "skip". Answers
+// may also skip all further failures, or those of the same kind.
+func promptError(stmt []byte, kind string, err error) string {
+	tty, terr := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if terr != nil {
+		log.Printf("-on-error=prompt: cannot open the terminal: %v", terr)
+		return "abort"
+	}
+	defer tty.Close()
+	in := bufio.NewReader(tty)
+	for {
+		fmt.Fprintf(stderr, "statement failed: %v\n  %s\n[a]bort, [s]kip, skip all failed %s statements [k], skip all failed statements [A]? ", err, excerpt(stmt), kind)
+		answer, rerr := in.ReadString('\n')
+		if rerr != nil {
+			return "abort"
+		}
+		switch strings.TrimSpace(answer) {
+		case "a":
+			return "abort"
+		case "s":
+			return "skip"
+		case "k":
+			onErrorFor[kind] = "skip"
+			return "skip"
+		case "A":
+			*onError = "skip"
+			for k := range onErrorFor {
+				onErrorFor[k] = "skip"
+			}
+			return "skip"
+		}
+	}
+}
+
+// logSkippedErrors logs how many failed statements were skipped.
+func logSkippedErrors() {
+	if len(skippedErrors) == 0 {
+		return
+	}
+	var kinds []string
+	total := 0
+	for k, n := range skippedErrors {
+		kinds = append(kinds, fmt.Sprintf("%s: %d", k, n))
+		total += n
+	}
+	sort.Strings(kinds)
+	log.Printf("skipped %d failed statements (%s)", total, strings.Join(kinds, ", "))
+}
@@ -0,0 +1,374 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+var workers = flag.Int("workers", 1, "Number of connections replaying INSERT and REPLACE statements concurrently")
+
+// checkpointInterval is how often the parallel replay saves its
+// checkpoint.
+const checkpointInterval = time.Second
+
+// frontier tracks which parts of the dump have been replayed: all of
+// it before pos, and the ranges in done, which all lie after pos.
+// Resuming from a frontier skips the statements within done instead of
+// falling back to pos and replaying them again.
+type frontier struct {
+	pos  int64
+	done [][2]int64
+}
+
+// progress is the frontier of the import.
+var progress *frontier
+
+// complete marks the range from start to end as replayed.
+func (f *frontier) complete(start, end int64) {
+	i := sort.Search(len(f.done), func(i int) bool { return f.done[i][0] >= start })
+	f.done = append(f.done, [2]int64{})
+	copy(f.done[i+1:], f.done[i:])
+	f.done[i] = [2]int64{start, end}
+
+	// Merge adjacent ranges, and those reaching pos into it.
+	merged := f.done[:0]
+	for _, d := range f.done {
+		if d[0] <= f.pos {
+			if d[1] > f.pos {
+				f.pos = d[1]
+			}
+			continue
+		}
+		if n := len(merged); n > 0 && d[0] <= merged[n-1][1] {
+			if d[1] > merged[n-1][1] {
+				merged[n-1][1] = d[1]
+			}
+			continue
+		}
+		merged = append(merged, d)
+	}
+	f.done = merged
+}
+
+// replayed reports whether the range from start to end was replayed.
+func (f *frontier) replayed(start, end int64) bool {
+	if end <= f.pos {
+		return true
+	}
+	for _, d := range f.done {
+		if d[0] <= start && end <= d[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// job is a statement handed to a worker. The statement spans stmtStart
+// to end in the dump, and start is the end of the previous statement,
+// so that the ranges of consecutive jobs are contiguous. A statement
+// too large for the target is executed as parts instead. Concurrent
+// jobs run alongside others.
+type job struct {
+	stmt                  []byte
+	parts                 [][]byte
+	concurrent            bool
+	start, stmtStart, end int64
+	d                     time.Duration
+	err                   error
+}
+
+// isSessionStatement reports whether a statement of the given kind
+// changes the state of the session it runs in, and so must run on
+// every worker connection.
+func isSessionStatement(kind string) bool {
+	return kind == "SET" || kind == "USE"
+}
+
+// isTableLock reports whether a statement of the given kind is one of
+// the LOCK TABLES and UNLOCK TABLES statements that mysqldump wraps the
+// rows of each table in. They are skipped when replaying concurrently,
+// as a lock held by one connection would block the others' INSERTs.
+func isTableLock(kind string) bool {
+	return kind == "LOCK TABLES" || kind == "UNLOCK"
+}
+
+// runParallel is run with -workers: consecutive INSERT and REPLACE
+// statements are executed concurrently on separate connections, while
+// every other statement waits for them to complete and runs alone.
+// Session statements run on every connection. Since statements may
+// complete out of order, the checkpoint holds the frontier of the
+// replay rather than a single position.
+func runParallel(db *target, tee io.Writer, f *dumpFile, pos, size int64, logFile *os.File) {
+	ctx := context.Background()
+	conns := make([]*sql.Conn, maxWorkers())
+	for i := range conns {
+		c, err := db.db.Conn(ctx)
+		if err != nil {
+			log.Fatalf("connect worker %d: %v", i, err)
+		}
+		defer c.Close()
+		if err := replaySession(c, db.session); err != nil {
+			log.Fatalf("worker %d: restore session: %v", i, err)
+		}
+		conns[i] = c
+	}
+
+	jobs := make(chan *job)
+	results := make(chan *job, len(conns))
+	for _, c := range conns {
+		go func(c *sql.Conn) {
+			for j := range jobs {
+				waitTurn(len(j.statements()), len(j.stmt))
+				t := time.Now()
+				j.err = j.exec(ctx, c)
+				j.d = time.Since(t)
+				results <- j
+			}
+		}(c)
+	}
+
+	inFlight := 0
+	limit := func() int { return len(conns) }
+	var tune *tuner
+	if *autoTune {
+		tune = newTuner(db.db, len(conns))
+		limit = func() int { return tune.limit }
+	}
+	lastSave := time.Now()
+	checkpoint := func(force bool) {
+		if !force && time.Since(lastSave) < checkpointInterval {
+			return
+		}
+		if err := save(logFile, logLine{Position: progress.pos, Done: progress.done}); err != nil {
+			log.Fatalf("Error saving to log: %v", err)
+		}
+		lastSave = time.Now()
+	}
+	fail := func(j *job) {
+		close(jobs)
+		for ; inFlight > 0; inFlight-- {
+			if k := <-results; k.err == nil || isDuplicate(k.err) {
+				progress.complete(k.start, k.end)
+			}
+		}
+		checkpoint(true)
+		closeLog(logFile)
+		flushLog()
+		reportFailure(db, f, j.stmtStart, j.end, j.err)
+		recordRun("failed", progress.pos, j.err)
+		log.Fatal(j.err)
+	}
+	finish := func(j *job) {
+		if tune != nil && j.concurrent {
+			tune.observe(len(j.stmt), j.d, j.err)
+		}
+		logStatement(j.stmt, j.stmtStart, j.end, size, j.d, j.err)
+		trackStatement(j.stmt, j.stmtStart, j.end, j.d, j.err)
+		if j.err != nil {
+			switch {
+			case isDuplicate(j.err):
+				log.Printf(`ignoring "duplicate entry" error`)
+			case !skipError(j.stmt, j.err):
+				recordError(j.stmtStart, j.end, j.stmt, j.err, "aborted")
+				fail(j)
+			}
+			recordError(j.stmtStart, j.end, j.stmt, j.err, "ignored")
+		}
+		progress.complete(j.start, j.end)
+		checkpoint(false)
+	}
+	receive := func() {
+		j := <-results
+		inFlight--
+		finish(j)
+	}
+	drain := func() {
+		for inFlight > 0 {
+			receive()
+		}
+	}
+
+	r := newStmtReader(f, pos)
+	r.SetDelimiter(startDelimiter)
+	replayReader, replayDump = r, f
+	for {
+		prev := r.Pos
+		line, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			drain()
+			checkpoint(true)
+			recordRun("failed", progress.pos, err)
+			log.Fatalf("%q: %v", f.Name(), err)
+		}
+		if progress.replayed(r.Start, r.Pos) {
+			continue
+		}
+		warnBinary(r, size)
+
+		stmt := rewrite(line)
+		kind := ""
+		if stmt != nil {
+			kind = classify(stmt).Kind
+		}
+		if stmt == nil || isTableLock(kind) {
+			log.Printf("%s skipping %q", progressMark(r.Pos, size), excerpt(line))
+			recordError(r.Start, r.Pos, line, nil, "skipped")
+			progress.complete(prev, r.Pos)
+			if s := sessionStatement(line); s != "" {
+				db.setSession(s)
+				if err := save(logFile, logLine{Position: progress.pos, Done: progress.done, Session: s}); err != nil {
+					log.Fatalf("Error saving to log: %v", err)
+				}
+			}
+			continue
+		}
+		if atomic.LoadInt32(&interrupted) != 0 {
+			drain()
+			checkpoint(true)
+			stopIfInterrupted(logFile, progress.pos)
+		}
+		if name := stopBefore(r.Start, r.Pos); name != "" {
+			drain()
+			checkpoint(true)
+			stop(logFile, progress.pos, name)
+		}
+		if name := breakpoint(stmt); name != "" {
+			drain()
+			checkpoint(true)
+			pause(logFile, r.Start, name)
+		}
+		waitForStorage(db)
+
+		// The reader reuses its buffer, so the statement is copied.
+		j := &job{stmt: append([]byte(nil), stmt...), start: prev, stmtStart: r.Start, end: r.Pos}
+		j.parts = splitStatement(j.stmt)
+		if j.parts != nil {
+			log.Printf("splitting %d-byte statement into %d statements", len(stmt), len(j.parts))
+		}
+		if tee != nil {
+			for _, s := range j.statements() {
+				teeBuf = appendStatement(teeBuf[:0], s)
+				if _, err := tee.Write(teeBuf); err != nil {
+					log.Fatalf("Error writing to tee file: %v", err)
+				}
+			}
+		}
+		if kind == "INSERT" || kind == "REPLACE" {
+			j.concurrent = true
+			for inFlight >= limit() {
+				receive()
+			}
+			if tune != nil {
+				tune.begin()
+			}
+			jobs <- j
+			inFlight++
+			// Collect whatever already completed.
+			for done := false; !done; {
+				select {
+				case k := <-results:
+					inFlight--
+					finish(k)
+				default:
+					done = true
+				}
+			}
+			continue
+		}
+
+		drain()
+		targets := conns[:1]
+		if isSessionStatement(kind) {
+			targets = conns
+		}
+		waitTurn(1, len(j.stmt))
+		t := time.Now()
+		for _, c := range targets {
+			if _, j.err = c.ExecContext(ctx, string(j.stmt)); j.err != nil {
+				break
+			}
+		}
+		j.d = time.Since(t)
+		finish(j)
+		if isSessionStatement(kind) {
+			db.setSession(string(j.stmt))
+			if err := save(logFile, logLine{Position: progress.pos, Done: progress.done, Session: string(j.stmt)}); err != nil {
+				log.Fatalf("Error saving to log: %v", err)
+			}
+		}
+	}
+
+	drain()
+	close(jobs)
+	checkpoint(true)
+	flushLog()
+	stopProgress()
+	logSkippedErrors()
+	recordRun("completed", progress.pos, nil)
+}
+
+// statements returns the statements to execute for j.
+func (j *job) statements() [][]byte {
+	if j.parts != nil {
+		return j.parts
+	}
+	return [][]byte{j.stmt}
+}
+
+// exec executes j on c. "Duplicate entry" errors in one part do not
+// prevent executing the others.
+func (j *job) exec(ctx context.Context, c *sql.Conn) error {
+	var dup error
+	for _, s := range j.statements() {
+		_, err := c.ExecContext(ctx, string(s))
+		// A lost connection cannot be retried on, but a lock error
+		// can.
+		for retry := 1; err != nil && isLockError(err) && retry < *maxAttempts; retry++ {
+			d := backoff(retry)
+			log.Printf("%v, retrying in %v (attempt %d of %d)", err, d, retry+1, *maxAttempts)
+			time.Sleep(d)
+			_, err = c.ExecContext(ctx, string(s))
+		}
+		if err != nil {
+			if !isDuplicate(err) {
+				return err
+			}
+			dup = err
+		}
+	}
+	return dup
+}
+
+// isDuplicate reports whether err is a "duplicate entry" error, which
+// replaying a statement a second time causes.
+func isDuplicate(err error) bool {
+	merr, ok := err.(*mysql.MySQLError)
+	return ok && merr.Number == 1062
+}
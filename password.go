@@ -0,0 +1,69 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+var (
+	passwordEnv  = flag.String("password-env", "", "Environment variable holding the MySQL password, set in -dsn and -failover_dsn, e.g. for cron or Kubernetes Jobs")
+	passwordFile = flag.String("password-file", "", "File holding the MySQL password, set in -dsn and -failover_dsn; a trailing newline is ignored")
+)
+
+// flagPassword returns the password given by -password-env or
+// -password-file, and whether either is set.
+func flagPassword() (string, bool) {
+	switch {
+	case *passwordEnv != "" && *passwordFile != "":
+		log.Fatalf("-password-env and -password-file cannot be used together")
+	case *passwordEnv == "" && *passwordFile == "":
+		return "", false
+	case *prompt || *vaultPath != "" || *iamAuth:
+		log.Fatalf("-password-env and -password-file cannot be used with -prompt, -vault-path or -iam-auth")
+	}
+	if *passwordEnv != "" {
+		p, ok := os.LookupEnv(*passwordEnv)
+		if !ok {
+			log.Fatalf("-password-env: $%s is not set", *passwordEnv)
+		}
+		addSecret(p)
+		return p, true
+	}
+	b, err := ioutil.ReadFile(*passwordFile)
+	if err != nil {
+		log.Fatalf("-password-file: %v", err)
+	}
+	p := strings.TrimRight(string(b), "\r\n")
+	addSecret(p)
+	return p, true
+}
+
+// withPassword returns dsn with the given password.
+func withPassword(dsn, password string) (string, error) {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return "", err
+	}
+	cfg.Passwd = password
+	return cfg.FormatDSN(), nil
+}
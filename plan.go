@@ -0,0 +1,275 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+var planFile = flag.String("plan", "", "Only import the dump if it and the flags match this plan, as written by the plan subcommand")
+
+// importPlan is a reviewable description of what importing a dump does.
+// An import run with -plan refuses to start unless the dump and the
+// flags affecting the import are exactly those the plan was made for.
+type importPlan struct {
+	Dump        string
+	Size        int64
+	SHA256      string
+	Flags       map[string]string
+	Databases   []string
+	Tables      []*planTable
+	Skipped     []planStatement
+	Transformed []planStatement
+}
+
+// planTable describes the statements of a table, in import order.
+type planTable struct {
+	Database   string
+	Name       string
+	Bytes      int64
+	Statements int
+}
+
+// planStatement identifies a statement of the dump.
+type planStatement struct {
+	Offset    int64
+	Bytes     int
+	Statement string
+}
+
+// planImportFlags are the flags that change which statements an import
+// executes, or what they hold, and so must be the same when planning
+// and importing. The others, which name the target and its credentials,
+// or tune, log or report on the import, may differ; none of them is
+// written to the plan, so that secrets, such as those of -dsn or
+// -notify-url, stay out of it.
+var planImportFlags = map[string]bool{
+	"format":                true,
+	"dialect":               true,
+	"tab-character-set":     true,
+	"databases":             true,
+	"include-tables":        true,
+	"exclude-tables":        true,
+	"data-only":             true,
+	"schema-only":           true,
+	"skip-to-table":         true,
+	"skip-keep-ddl":         true,
+	"changed-only":          true,
+	"start-offset":          true,
+	"stop-offset":           true,
+	"stop-after-bytes":      true,
+	"stop-after-statements": true,
+	"rewrite":               true,
+	"rewrite-file":          true,
+	"rename-table":          true,
+	"target-db":             true,
+	"strip-definer":         true,
+	"compat-rewrites":       true,
+	"mysql80-rewrites":      true,
+	"generated-columns":     true,
+	"srid":                  true,
+	"utf8-as":               true,
+	"split-size":            true,
+	"defer-foreign-keys":    true,
+	"fast-import":           true,
+	"on-error":              true,
+	"on-error-for":          true,
+	"ignore-errors":         true,
+	"checkpoint-table":      true,
+}
+
+// planFlags returns the explicitly set flags visited by visit that
+// affect the import.
+func planFlags(visit func(func(*flag.Flag))) map[string]string {
+	m := map[string]string{}
+	visit(func(f *flag.Flag) {
+		if planImportFlags[f.Name] {
+			m[f.Name] = f.Value.String()
+		}
+	})
+	return m
+}
+
+// makePlan reads the dump name and describes how it would be imported.
+func makePlan(name string, flags map[string]string) (*importPlan, error) {
+	f, err := openDump(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	p := &importPlan{Dump: name, Flags: flags}
+	tables := map[[2]string]*planTable{}
+	db := ""
+	h := sha256.New()
+	r := newStmtReader(io.TeeReader(f, h), 0)
+	for {
+		line, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		info := classify(line)
+		switch info.Kind {
+		case "USE":
+			db = info.Database
+		case "CREATE DATABASE":
+			p.Databases = append(p.Databases, info.Database)
+		}
+		if info.Table != "" {
+			key := [2]string{info.Database, info.Table}
+			if key[0] == "" {
+				key[0] = db
+			}
+			t := tables[key]
+			if t == nil {
+				t = &planTable{Database: key[0], Name: key[1]}
+				tables[key] = t
+				p.Tables = append(p.Tables, t)
+			}
+			t.Bytes += int64(len(line))
+			t.Statements++
+		}
+
+		ps := planStatement{Offset: r.Start, Bytes: len(line), Statement: excerpt(line)}
+		if out := rewrite(line); out == nil {
+			p.Skipped = append(p.Skipped, ps)
+		} else if !bytes.Equal(out, line) {
+			p.Transformed = append(p.Transformed, ps)
+		}
+	}
+	// The reader consumed the whole dump.
+	p.Size = r.Pos
+	p.SHA256 = hex.EncodeToString(h.Sum(nil))
+	return p, nil
+}
+
+// print writes the plan in a human-readable form to w.
+func (p *importPlan) print(w io.Writer) {
+	fmt.Fprintf(w, "Plan for %s (%d bytes, sha256 %s)\n", p.Dump, p.Size, p.SHA256)
+	if len(p.Flags) > 0 {
+		var names []string
+		for name := range p.Flags {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(w, "\nFlags:\n")
+		for _, name := range names {
+			fmt.Fprintf(w, "  -%s=%s\n", name, p.Flags[name])
+		}
+	}
+	fmt.Fprintf(w, "\nDatabases to create: %s\n", strings.Join(p.Databases, ", "))
+	fmt.Fprintf(w, "\nTables, in import order:\n")
+	for _, t := range p.Tables {
+		name := t.Name
+		if t.Database != "" {
+			name = t.Database + "." + t.Name
+		}
+		fmt.Fprintf(w, "  %-40s %12d bytes %8d statements\n", name, t.Bytes, t.Statements)
+	}
+	for _, l := range []struct {
+		title string
+		stmts []planStatement
+	}{
+		{"Statements to skip", p.Skipped},
+		{"Statements to transform", p.Transformed},
+	} {
+		fmt.Fprintf(w, "\n%s: %d\n", l.title, len(l.stmts))
+		for _, s := range l.stmts {
+			fmt.Fprintf(w, "  at %d (%d bytes): %q\n", s.Offset, s.Bytes, s.Statement)
+		}
+	}
+}
+
+// planCmd implements "cloudsql-import plan dump.sql -out plan.json".
+func planCmd(args []string) {
+	fs := subcommandFlags("plan")
+	out := fs.String("out", "", "Output file for the plan")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s plan [flags] dump.sql -out plan.json\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	in := parseInterspersed(fs, args)
+	if len(in) != 1 || *out == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	p, err := makePlan(in[0], planFlags(fs.Visit))
+	if err != nil {
+		log.Fatalf("plan %q: %v", in[0], err)
+	}
+	b, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		log.Fatalf("json.Marshal: %v", err)
+	}
+	if err := ioutil.WriteFile(*out, append(b, '\n'), 0644); err != nil {
+		log.Fatalf("write plan: %v", err)
+	}
+	p.print(os.Stdout)
+}
+
+// checkPlan verifies that importing f with the current flags is what
+// the plan in filename describes. f is left positioned at its start.
+func checkPlan(filename string, f *dumpFile) error {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	p := &importPlan{}
+	if err := json.Unmarshal(b, p); err != nil {
+		return err
+	}
+
+	flags := planFlags(flag.Visit)
+	for name, v := range p.Flags {
+		if planImportFlags[name] && flags[name] != v {
+			return fmt.Errorf("the plan was made with -%s=%s", name, redactDSNs(v))
+		}
+	}
+	for name, v := range flags {
+		if _, ok := p.Flags[name]; !ok {
+			return fmt.Errorf("the plan was made without -%s=%s", name, redactDSNs(v))
+		}
+	}
+
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, os.SEEK_SET); err != nil {
+		return err
+	}
+	if n != p.Size || hex.EncodeToString(h.Sum(nil)) != p.SHA256 {
+		return fmt.Errorf("%q is not the dump the plan was made for", f.Name())
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+)
+
+var (
+	maxOpenConns      = flag.Int("max-open-conns", 0, "Maximum number of connections open to MySQL (0 for no limit); at least -workers")
+	maxIdleConns      = flag.Int("max-idle-conns", 2, "Maximum number of idle connections kept open to MySQL; at least 1, since the session of the dump lives on its connection")
+	connMaxLifetime   = flag.Duration("conn-max-lifetime", 0, "Replace connections to MySQL once this old (0 to keep them); the session statements of the dump replayed so far are executed on the new ones")
+	dialTimeout       = flag.Duration("dial-timeout", 0, "Timeout for connecting to MySQL (0 for the driver default)")
+	readTimeout       = flag.Duration("read-timeout", 0, "Timeout for reading a response from MySQL, which must exceed the longest statement (0 for none)")
+	writeTimeout      = flag.Duration("write-timeout", 0, "Timeout for writing a statement to MySQL (0 for none)")
+	interpolateParams = flag.Bool("interpolate-params", false, "Have the driver interpolate query arguments instead of preparing the query, saving a round trip")
+)
+
+// checkPoolFlags exits if the pool flags cannot be honored.
+func checkPoolFlags() {
+	switch {
+	case *maxIdleConns < 1:
+		log.Fatalf("-max-idle-conns must be at least 1: without an idle connection, every statement would run on a new connection, without the session of the dump")
+	case *maxOpenConns > 0 && *maxOpenConns < maxWorkers():
+		log.Fatalf("-max-open-conns %d is less than the %d connections of -workers", *maxOpenConns, maxWorkers())
+	}
+}
+
+// poolParams returns the DSN parameters set by the pool flags.
+func poolParams() []string {
+	var params []string
+	for _, p := range []struct {
+		name string
+		d    time.Duration
+	}{{"timeout", *dialTimeout}, {"readTimeout", *readTimeout}, {"writeTimeout", *writeTimeout}} {
+		if p.d > 0 {
+			params = append(params, fmt.Sprintf("%s=%s", p.name, p.d))
+		}
+	}
+	if *interpolateParams {
+		params = append(params, "interpolateParams=true")
+	}
+	return params
+}
+
+// configurePool sizes and ages the pool db as the pool flags say.
+func configurePool(db *sql.DB) {
+	db.SetMaxOpenConns(*maxOpenConns)
+	db.SetMaxIdleConns(*maxIdleConns)
+	db.SetConnMaxLifetime(*connMaxLifetime)
+}
+
+// sessionConnector executes the session statements of the dump replayed
+// so far on each connection it opens, so that the connections the pool
+// opens after the first, to replace a broken connection, one older than
+// -conn-max-lifetime, or for a batch, carry on with the same session.
+type sessionConnector struct {
+	driver.Connector
+	session func() []string
+}
+
+func (c *sessionConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ex, ok := conn.(driver.ExecerContext)
+	if !ok {
+		return conn, nil
+	}
+	for _, s := range c.session() {
+		if rewrite([]byte(s)) == nil {
+			continue
+		}
+		if _, err := ex.ExecContext(ctx, s, nil); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("restore session: %q: %v", excerpt([]byte(s)), err)
+		}
+	}
+	return conn, nil
+}
@@ -0,0 +1,178 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"log"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloudsql-import/importer"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+var dialect = choiceFlag("dialect", "mysql", "Kind of dump and server; postgres replays a plain-format pg_dump, with -dsn a PostgreSQL connection string", "mysql", "postgres")
+
+// postgresFlags are the flags that apply with -dialect=postgres.
+var postgresFlags = map[string]bool{
+	"dump": true, "dsn": true, "dialect": true, "checkpoint": true, "force": true,
+	"progress-interval": true, "v": true, "log-format": true, "metrics-addr": true,
+}
+
+// pgSession matches the statements setting the session, which a
+// resumed import executes again.
+var pgSession = regexp.MustCompile(`(?is)^(?:SET\s|SELECT\s+pg_catalog\.set_config\()`)
+
+// pgPassword returns the password in the PostgreSQL connection string
+// dsn, a URL or keyword/value pairs.
+func pgPassword(dsn string) string {
+	if u, err := url.Parse(dsn); err == nil && u.User != nil {
+		p, _ := u.User.Password()
+		return p
+	}
+	if m := regexp.MustCompile(`(?:^|\s)password\s*=\s*('(?:[^'\\]|\\.)*'|\S+)`).FindStringSubmatch(dsn); m != nil {
+		return strings.Trim(m[1], "'")
+	}
+	return ""
+}
+
+// importPostgres replays the plain-format pg_dump -dump to -dsn, with
+// the same checkpoint log as a MySQL import. A COPY statement and its
+// data are replayed as one statement.
+func importPostgres() {
+	flag.Visit(func(fl *flag.Flag) {
+		if !postgresFlags[fl.Name] {
+			log.Fatalf("-%s cannot be used with -dialect=postgres", fl.Name)
+		}
+	})
+	f, err := openDump(*dump)
+	if err != nil {
+		log.Fatalf("open dump: %v", err)
+	}
+	defer f.Close()
+	size, err := f.Size()
+	if err != nil {
+		log.Fatalf("dump size: %v", err)
+	}
+	addSecret(pgPassword(*dsn))
+	ctx := context.Background()
+	conn, err := pgconn.Connect(ctx, *dsn)
+	if err != nil {
+		log.Fatalf("connect to PostgreSQL: %v", err)
+	}
+	defer conn.Close(ctx)
+
+	logFilename := checkpointName(f.Name())
+	cp, err := recover(logFilename)
+	if err != nil {
+		log.Fatalf("recover from log: %v", err)
+	}
+	id := checkResume(f, cp)
+	pos := cp.Position
+	if len(cp.Session) > 0 {
+		log.Printf("replaying %d session statements from the checkpoint", len(cp.Session))
+	}
+	for _, s := range cp.Session {
+		if _, err := conn.Exec(ctx, s).ReadAll(); err != nil {
+			log.Fatalf("restore session: %q: %v", excerpt([]byte(s)), err)
+		}
+	}
+	if pos != 0 {
+		log.Printf("seeking to %d in %q", pos, f.Name())
+		if _, err = f.Seek(pos, io.SeekStart); err != nil {
+			log.Fatalf("Seek: %v", err)
+		}
+	}
+	logFile, err := openLog(logFilename, cp)
+	if err != nil {
+		log.Fatalf("open checkpoint log: %v", err)
+	}
+	defer logFile.Close()
+	if id != nil && (cp.Dump == nil || *cp.Dump != *id) {
+		if err := save(logFile, logLine{Position: pos, Dump: id}); err != nil {
+			log.Fatalf("Error saving to log: %v", err)
+		}
+	}
+
+	catchSignals()
+	startRun(f, pos)
+	if jsonLog() {
+		logEvent(logRecord{Event: "started", Position: pos}, nil)
+	}
+	startProgress(pos, size)
+	observeCheckpoint(pos)
+	r := importer.NewPostgresReader(f, pos)
+	for {
+		stopIfInterrupted(logFile, r.Pos)
+		stmt, err := r.Next()
+		if err == io.EOF {
+			flushLog()
+			stopProgress()
+			recordRun("completed", r.Pos, nil)
+			break
+		}
+		if err != nil {
+			recordRun("failed", r.Start, err)
+			log.Fatalf("%q: %v", f.Name(), err)
+		}
+		waitTurn(1, len(stmt))
+		start := time.Now()
+		err = execPostgres(ctx, conn, r, stmt)
+		logStatement(stmt, r.Start, r.Pos, size, time.Since(start), err)
+		if err != nil {
+			flushLog()
+			closeLog(logFile)
+			recordRun("failed", r.Start, err)
+			log.Fatalf("statement at offset %d: %q: %v", r.Start, excerpt(stmt), err)
+		}
+		session := ""
+		if pgSession.Match(stmt) {
+			session = string(stmt)
+		}
+		if err := save(logFile, logLine{Position: r.Pos, Session: session}); err != nil {
+			log.Fatalf("Error saving to log: %v", err)
+		}
+	}
+	if err := closeLog(logFile); err != nil {
+		log.Fatalf("close checkpoint log: %v", err)
+	}
+}
+
+// execPostgres executes stmt, read from r, streaming the data of a COPY
+// statement from the dump.
+func execPostgres(ctx context.Context, conn *pgconn.PgConn, r *importer.PostgresReader, stmt []byte) error {
+	if stmt[0] == '\\' {
+		switch cmd := strings.Fields(string(stmt))[0]; cmd {
+		case `\restrict`, `\unrestrict`:
+			// pg_dump protects the dump from injected meta-commands
+			// with these, which psql alone needs.
+			return nil
+		default:
+			log.Fatalf("the psql meta-command %s is not supported; import the dump of each database on its own", cmd)
+		}
+	}
+	if r.Copying() {
+		_, err := conn.CopyFrom(ctx, r.CopyData(), string(stmt))
+		return err
+	}
+	_, err := conn.Exec(ctx, string(stmt)).ReadAll()
+	return err
+}
@@ -0,0 +1,210 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	progressInterval = flag.Duration("progress-interval", 10*time.Second, "Report the bytes replayed, throughput and estimated time remaining this often (0 to log every statement instead)")
+	verbose          = flag.Bool("v", false, "Log every statement replayed, in addition to the progress report")
+)
+
+// meter tracks the progress of the replay for the progress report.
+var meter struct {
+	sync.Mutex
+	start              time.Time
+	startPos, pos      int64
+	size               int64
+	statements         int64
+	stop               chan struct{}
+	lastReport         time.Time
+	lastPos, lastStmts int64
+	// rawStart is the position in the compressed dump at the start.
+	rawStart int64
+}
+
+// compressedProgress, set for a compressed dump, returns the position
+// in the dump as stored and its size, or -1 if unknown, against which
+// progress is reported, since the decompressed size is unknown.
+var compressedProgress func() (pos, size int64)
+
+// startProgress starts reporting the progress of a replay starting at
+// pos of a dump of the given size, or -1 if unknown.
+func startProgress(pos, size int64) {
+	meter.Lock()
+	defer meter.Unlock()
+	now := time.Now()
+	meter.start, meter.startPos, meter.pos, meter.size = now, pos, pos, size
+	meter.lastReport, meter.lastPos = now, pos
+	if compressedProgress != nil {
+		meter.rawStart, _ = compressedProgress()
+	}
+	if *progressInterval <= 0 {
+		return
+	}
+	meter.stop = make(chan struct{})
+	go func(stop chan struct{}) {
+		t := time.NewTicker(*progressInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				reportProgress()
+			case <-stop:
+				return
+			}
+		}
+	}(meter.stop)
+}
+
+// stopProgress stops the progress report and reports the final figures.
+func stopProgress() {
+	meter.Lock()
+	stop := meter.stop
+	meter.stop = nil
+	meter.Unlock()
+	if stop == nil {
+		return
+	}
+	close(stop)
+	reportProgress()
+	stderr.clear()
+}
+
+// countProgress records that the replay reached pos after n statements.
+func countProgress(pos int64, n int) {
+	meter.Lock()
+	if pos > meter.pos {
+		meter.pos = pos
+	}
+	meter.statements += int64(n)
+	meter.Unlock()
+}
+
+// reportProgress reports the bytes replayed, the throughput over the
+// last interval and the time remaining at the average throughput.
+func reportProgress() {
+	meter.Lock()
+	now := time.Now()
+	since := now.Sub(meter.lastReport).Seconds()
+	if since <= 0 {
+		meter.Unlock()
+		return
+	}
+	done := meter.pos - meter.startPos
+	rate := float64(meter.pos-meter.lastPos) / since
+	stmtRate := float64(meter.statements-meter.lastStmts) / since
+	line := fmt.Sprintf("progress: %s", humanSize(meter.pos))
+	if meter.size > 0 {
+		line += fmt.Sprintf(" of %s (%.1f%%)", humanSize(meter.size), 100*float64(meter.pos)/float64(meter.size))
+	}
+	rawPos, rawSize := int64(0), int64(-1)
+	if compressedProgress != nil {
+		rawPos, rawSize = compressedProgress()
+	}
+	if rawSize > 0 {
+		line += fmt.Sprintf(" (%s of %s compressed, %.1f%%)", humanSize(rawPos), humanSize(rawSize), 100*float64(rawPos)/float64(rawSize))
+	}
+	line += fmt.Sprintf(", %s/s, %.0f statements/s", humanSize(int64(rate)), stmtRate)
+	if limits := throttleLimits(); limits != "" {
+		line += " (limited to " + limits + ")"
+	}
+	if elapsed := now.Sub(meter.start); meter.size > 0 && done > 0 {
+		left := time.Duration(float64(meter.size-meter.pos) / float64(done) * float64(elapsed))
+		line += ", " + left.Round(time.Second).String() + " left"
+	} else if rawDone := rawPos - meter.rawStart; rawSize > 0 && rawDone > 0 {
+		left := time.Duration(float64(rawSize-rawPos) / float64(rawDone) * float64(elapsed))
+		line += ", " + left.Round(time.Second).String() + " left"
+	}
+	meter.lastReport, meter.lastPos, meter.lastStmts = now, meter.pos, meter.statements
+	meter.Unlock()
+
+	if stderr.isTerminal && !jsonLog() {
+		stderr.show(line)
+	} else {
+		log.Print(line)
+	}
+}
+
+// humanSize formats a number of bytes for the progress report.
+func humanSize(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return strconv.FormatFloat(float64(n)/(1<<30), 'f', 1, 64) + "GB"
+	case n >= 1<<20:
+		return strconv.FormatFloat(float64(n)/(1<<20), 'f', 1, 64) + "MB"
+	case n >= 1<<10:
+		return strconv.FormatFloat(float64(n)/(1<<10), 'f', 1, 64) + "KB"
+	}
+	return strconv.FormatInt(n, 10) + "B"
+}
+
+// statusWriter is the standard error, on which the progress report is
+// redrawn in place when it is a terminal. Log lines are written above
+// it.
+type statusWriter struct {
+	mu         sync.Mutex
+	w          io.Writer
+	isTerminal bool
+	line       string
+}
+
+var stderr = newStatusWriter(os.Stderr)
+
+func newStatusWriter(f *os.File) *statusWriter {
+	fi, err := f.Stat()
+	return &statusWriter{w: f, isTerminal: err == nil && fi.Mode()&os.ModeCharDevice != 0}
+}
+
+func (s *statusWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.line != "" {
+		io.WriteString(s.w, "\r\033[K")
+	}
+	n, err := s.w.Write(p)
+	if s.line != "" {
+		io.WriteString(s.w, s.line)
+	}
+	return n, err
+}
+
+// show replaces the status line with line.
+func (s *statusWriter) show(line string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.line = line
+	io.WriteString(s.w, "\r\033[K"+line)
+}
+
+// clear ends the status line, leaving it on the screen.
+func (s *statusWriter) clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.line != "" {
+		io.WriteString(s.w, "\n")
+		s.line = ""
+	}
+}
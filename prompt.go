@@ -0,0 +1,67 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// promptedPassword is the -prompt password once read, as the imports of
+// every dump, and the child processes of -table-concurrency, share it.
+var promptedPassword []byte
+
+// readPassword returns the -prompt password, reading it the first time.
+func readPassword() ([]byte, error) {
+	if promptedPassword == nil {
+		password, err := askPassword()
+		if err != nil {
+			return nil, err
+		}
+		promptedPassword = password
+	}
+	return promptedPassword, nil
+}
+
+// askPassword reads the -prompt password from the standard input:
+// without echoing it when it is a terminal, or as its first line
+// otherwise, so that scripts can pipe it in.
+func askPassword() ([]byte, error) {
+	// os.Stdin.Fd() is the handle term expects on every platform,
+	// including Windows, unlike syscall.Stdin.
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		if *dump == "-" {
+			return nil, fmt.Errorf("the standard input holds the dump")
+		}
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			return nil, err
+		}
+		return []byte(strings.TrimRight(line, "\r\n")), nil
+	}
+	fmt.Print("Enter password: ")
+	password, err := term.ReadPassword(fd)
+	// ReadPassword() leaves cursor on the input line,
+	// so begin output on the next line
+	fmt.Print("\n")
+	return password, err
+}
@@ -0,0 +1,28 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"io"
+
+	"github.com/GoogleCloudPlatform/cloudsql-import/importer"
+)
+
+// newStmtReader returns a reader of the statements of r, which is
+// positioned at offset pos of the dump.
+func newStmtReader(r io.Reader, pos int64) *importer.Reader {
+	return importer.NewReader(r, pos)
+}
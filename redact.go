@@ -0,0 +1,118 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+)
+
+// secrets holds the credentials that must never be written out. IAM
+// tokens are added as connections are opened, hence the lock.
+var (
+	secretsMu sync.RWMutex
+	secrets   [][]byte
+)
+
+// addSecret registers s as a credential to redact from all output.
+func addSecret(s string) {
+	if s == "" {
+		return
+	}
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	for _, old := range secrets {
+		if string(old) == s {
+			return
+		}
+	}
+	secrets = append(secrets, []byte(s))
+}
+
+// dsnPassword returns the password of a MySQL DSN, which has the form
+// [user[:password]@][net[(addr)]]/dbname[?params]. It is parsed the way
+// the driver does, so that passwords containing "@", ":" or "/" are
+// found as well.
+func dsnPassword(dsn string) string {
+	i := strings.LastIndex(dsn, "/")
+	if i < 0 {
+		return ""
+	}
+	j := strings.LastIndex(dsn[:i], "@")
+	if j < 0 {
+		return ""
+	}
+	k := strings.Index(dsn[:j], ":")
+	if k < 0 {
+		return ""
+	}
+	return dsn[k+1 : j]
+}
+
+// redactDSNs masks the passwords of the comma-separated DSNs in v, for
+// messages written before connect registers them as secrets.
+func redactDSNs(v string) string {
+	parts := strings.Split(v, ",")
+	for i, p := range parts {
+		if pw := dsnPassword(p); pw != "" {
+			parts[i] = strings.Replace(p, pw, "****", -1)
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// redact replaces the registered secrets in b.
+func redact(b []byte) []byte {
+	secretsMu.RLock()
+	defer secretsMu.RUnlock()
+	for _, s := range secrets {
+		if bytes.Contains(b, s) {
+			b = bytes.Replace(b, s, []byte("****"), -1)
+		}
+	}
+	return b
+}
+
+// redactingWriter redacts the registered secrets from what is written
+// to w. It is installed as the output of the log package, through which
+// all errors and progress are reported. Output is passed on a line at
+// a time, so that a secret split across writes is redacted too; the
+// log package ends each of its writes with a newline.
+type redactingWriter struct {
+	w       io.Writer
+	mu      sync.Mutex
+	pending []byte
+}
+
+func (w *redactingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.pending = append(w.pending, p...)
+	i := bytes.LastIndexByte(w.pending, '\n')
+	if i < 0 {
+		return len(p), nil
+	}
+	line := w.pending[:i+1]
+	rest := w.pending[i+1:]
+	_, err := w.w.Write(redact(line))
+	w.pending = append(w.pending[:0], rest...)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
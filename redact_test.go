@@ -0,0 +1,107 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestRedactingWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "redact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	passwordPath := filepath.Join(dir, "password")
+	if err := ioutil.WriteFile(passwordPath, []byte("file-s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		secret string
+		// register registers the secret the way the import does.
+		register func()
+		// writes are written to the writer in turn.
+		writes []string
+	}{{
+		name:     "DSN password",
+		secret:   "p@ss:w/rd",
+		register: func() { addSecret(dsnPassword("user:p@ss:w/rd@tcp(10.0.0.1:3306)/db")) },
+		writes:   []string{"connect: " + (&mysql.MySQLError{Number: 1045, Message: "Access denied for user 'user' with p@ss:w/rd"}).Error() + "\n"},
+	}, {
+		name:     "IAM token",
+		secret:   "ya29.a0AfH6SMBxToken",
+		register: func() { addSecret("ya29.a0AfH6SMBxToken") },
+		writes:   []string{"Error 1045: Access denied for user 'sa'@'10.0.0.2' (using password: ya29.a0AfH6SMBxToken)\n"},
+	}, {
+		name:   "password file",
+		secret: "file-s3cret",
+		register: func() {
+			*passwordFile = passwordPath
+			defer func() { *passwordFile = "" }()
+			flagPassword()
+		},
+		writes: []string{"retrying with file-s3cret\n"},
+	}, {
+		name:     "split across writes",
+		secret:   "split-s3cret",
+		register: func() { addSecret("split-s3cret") },
+		writes:   []string{"connect with split-s3", "cret failed\n"},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(old [][]byte) { secrets = old }(secrets)
+			secrets = nil
+			tt.register()
+			var out bytes.Buffer
+			w := &redactingWriter{w: &out}
+			for _, s := range tt.writes {
+				if n, err := w.Write([]byte(s)); n != len(s) || err != nil {
+					t.Fatalf("Write(%q) = %d, %v", s, n, err)
+				}
+			}
+			got := out.String()
+			if strings.Contains(got, tt.secret) || !strings.Contains(got, "****") {
+				t.Errorf("output %q is not redacted", got)
+			}
+			if want := strings.Replace(strings.Join(tt.writes, ""), tt.secret, "****", -1); got != want {
+				t.Errorf("output %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestRedactingWriterLog(t *testing.T) {
+	defer func(old [][]byte) { secrets = old }(secrets)
+	secrets = nil
+	addSecret(dsnPassword("root:hunter2@tcp(db)/"))
+	var out bytes.Buffer
+	l := log.New(&redactingWriter{w: &out}, "", 0)
+	l.Printf("open: %v", fmt.Errorf("dial root:hunter2@tcp(db)/: connection refused"))
+	if got, want := out.String(), "open: dial root:****@tcp(db)/: connection refused\n"; got != want {
+		t.Errorf("log output %q, want %q", got, want)
+	}
+}
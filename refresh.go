@@ -0,0 +1,143 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+var changedOnly = flag.String("changed-only", "", "Manifest file recording the tables of the last import: only re-import the tables of the dump that changed since, or, for tables it does not list, whose row count differs on the target; the manifest is updated once the import completes")
+
+// tableDigest summarizes the statements of a table in a dump.
+type tableDigest struct {
+	Hash string
+	Rows int64
+	h    hash.Hash
+	// ranges are the parts of the dump holding the statements.
+	ranges [][2]int64
+}
+
+// digestTables reads the dump r and returns the digest of each table.
+func digestTables(r io.Reader) (map[string]*tableDigest, error) {
+	digests := map[string]*tableDigest{}
+	db := ""
+	sr := newStmtReader(r, 0)
+	for {
+		prev := sr.Pos
+		stmt, err := sr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		info := classify(stmt)
+		if info.Kind == "USE" {
+			db = info.Database
+		}
+		if info.Table == "" {
+			continue
+		}
+		if info.Database == "" {
+			info.Database = db
+		}
+		name := qualifiedName(info.Database, info.Table)
+		d := digests[name]
+		if d == nil {
+			d = &tableDigest{h: sha256.New()}
+			digests[name] = d
+		}
+		d.h.Write(stmt)
+		if info.Kind == "INSERT" || info.Kind == "REPLACE" {
+			_, rows, _ := insertRows(stmt)
+			d.Rows += int64(len(rows))
+		}
+		if n := len(d.ranges); n > 0 && d.ranges[n-1][1] == prev {
+			d.ranges[n-1][1] = sr.Pos
+		} else {
+			d.ranges = append(d.ranges, [2]int64{prev, sr.Pos})
+		}
+	}
+	for _, d := range digests {
+		d.Hash = hex.EncodeToString(d.h.Sum(nil))
+	}
+	return digests, nil
+}
+
+// skipUnchangedTables marks the statements of the tables of the dump f
+// that need not be imported again as replayed, and returns the digests
+// to record in the manifest once the import completes.
+func skipUnchangedTables(db *target, f *dumpFile) map[string]*tableDigest {
+	digests, err := digestTables(f.from(0))
+	if err != nil {
+		log.Fatalf("digest tables: %v", err)
+	}
+	manifest := map[string]*tableDigest{}
+	if b, err := ioutil.ReadFile(*changedOnly); err == nil {
+		if err := json.Unmarshal(b, &manifest); err != nil {
+			log.Fatalf("-changed-only %q: %v", *changedOnly, err)
+		}
+	} else if !os.IsNotExist(err) {
+		log.Fatalf("-changed-only: %v", err)
+	}
+
+	changed := 0
+	for name, d := range digests {
+		if old := manifest[name]; old != nil {
+			if old.Hash != d.Hash {
+				log.Printf("%s changed since the last import", name)
+				changed++
+				continue
+			}
+		} else {
+			var n int64
+			if err := db.db.QueryRow("SELECT COUNT(*) FROM " + name).Scan(&n); err != nil {
+				log.Printf("%s: cannot count the rows of the target: %v", name, err)
+				changed++
+				continue
+			}
+			if n != d.Rows {
+				log.Printf("%s has %d rows on the target and %d in the dump", name, n, d.Rows)
+				changed++
+				continue
+			}
+		}
+		for _, r := range d.ranges {
+			progress.complete(r[0], r[1])
+		}
+	}
+	log.Printf("re-importing %d of %d tables", changed, len(digests))
+	return digests
+}
+
+// writeManifest records the digests of the tables just imported.
+func writeManifest(digests map[string]*tableDigest) {
+	b, err := json.MarshalIndent(digests, "", "  ")
+	if err != nil {
+		log.Fatalf("write manifest: %v", err)
+	}
+	if err := ioutil.WriteFile(*changedOnly, b, 0644); err != nil {
+		log.Fatalf("write manifest: %v", err)
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/cloudsql-import/importer"
+)
+
+var targetDB = flag.String("target-db", "", "Import the database of the dump under this name, rewriting its CREATE DATABASE and USE statements and the names qualified with it (e.g. to restore a copy of prod as prod_copy on the same instance)")
+
+// sourceDB is the database of the dump renamed to -target-db, that of
+// its first CREATE DATABASE or USE statement.
+var sourceDB string
+
+var (
+	alterDatabase = regexp.MustCompile(`(?is)^(?:/\*!\d*\s*)?ALTER\s+(?:DATABASE|SCHEMA)\b`)
+	// insertValues matches the VALUES keyword ending the head of an
+	// INSERT or REPLACE statement, which is all that can name a table.
+	insertValues = regexp.MustCompile(`(?i)\bVALUES?\s*\(`)
+)
+
+// findSourceDB sets sourceDB from the dump f, so that
+// a resumed import renames the database before reaching its USE
+// statement again.
+func findSourceDB(f *dumpFile) {
+	if *targetDB == "" {
+		return
+	}
+	r := newStmtReader(f.from(0), 0)
+	for {
+		stmt, err := r.Next()
+		if err == io.EOF || err == importer.ErrTruncated || err == importer.ErrUnterminated {
+			return
+		}
+		if err != nil {
+			log.Fatalf("-target-db: %v", err)
+		}
+		if info := classify(stmt); (info.Kind == "USE" || info.Kind == "CREATE DATABASE") && databaseSelected(info.Database) {
+			sourceDB = info.Database
+			return
+		}
+	}
+}
+
+// renameDatabase renames the database of the dump to -target-db in
+// stmt.
+func renameDatabase(stmt []byte) []byte {
+	if *targetDB == "" || stmt == nil {
+		return stmt
+	}
+	info := classify(stmt)
+	switch info.Kind {
+	case "USE", "CREATE DATABASE":
+		if sourceDB == "" {
+			sourceDB = info.Database
+		}
+		if info.Database != sourceDB {
+			log.Fatalf("-target-db: the dump holds several databases, %q and %q; select one with -databases", sourceDB, info.Database)
+		}
+		fallthrough
+	case "DROP DATABASE":
+		return mapIdents(stmt, func(name, qualifier []byte, part int, qualifies bool) []byte {
+			return renamed(name, sourceDB, *targetDB)
+		})
+	}
+	if sourceDB == "" {
+		return stmt
+	}
+	if info.Kind == "ALTER" && alterDatabase.Match(bytes.TrimSpace(stmt)) {
+		return mapIdents(stmt, func(name, qualifier []byte, part int, qualifies bool) []byte {
+			return renamed(name, sourceDB, *targetDB)
+		})
+	}
+	return mapIdents(stmt, func(name, qualifier []byte, part int, qualifies bool) []byte {
+		if part > 0 || !qualifies {
+			return nil
+		}
+		return renamed(name, sourceDB, *targetDB)
+	})
+}
+
+// tableRenames is a flag.Value for repeated -rename-table mappings.
+type tableRenames map[string]string
+
+var renameTable = tableRenames{}
+
+func init() {
+	flag.Var(renameTable, "rename-table", "Import the table old as new, \"old:new\" (e.g. \"orders:orders_restore\"), rewriting its name wherever it appears outside string literals, in every database (may be repeated)")
+}
+
+func (m tableRenames) String() string {
+	var s []string
+	for old, new := range m {
+		s = append(s, old+":"+new)
+	}
+	sort.Strings(s)
+	return strings.Join(s, ",")
+}
+
+func (m tableRenames) Set(v string) error {
+	i := strings.Index(v, ":")
+	if i <= 0 || i == len(v)-1 || strings.Contains(v, ".") {
+		return fmt.Errorf("%q is not of the form old:new", v)
+	}
+	m[v[:i]] = v[i+1:]
+	return nil
+}
+
+// renameTables renames the tables of stmt named by -rename-table. The
+// second part of a qualified name is taken for a column rather than a
+// table when the first is a renamed table, and the third is always a
+// column; a column named as a renamed table elsewhere is renamed too.
+func renameTables(stmt []byte) []byte {
+	if len(renameTable) == 0 || stmt == nil {
+		return stmt
+	}
+	return mapIdents(stmt, func(name, qualifier []byte, part int, qualifies bool) []byte {
+		new, ok := renameTable[unquoteIdent(name)]
+		if !ok || part > 1 {
+			return nil
+		}
+		if _, ok := renameTable[unquoteIdent(qualifier)]; ok && part == 1 && !qualifies {
+			return nil
+		}
+		return []byte(quoteIdent(new))
+	})
+}
+
+// renamed returns the identifier name quoted as to if it names from, or
+// nil.
+func renamed(name []byte, from, to string) []byte {
+	if unquoteIdent(name) != from {
+		return nil
+	}
+	return []byte(quoteIdent(to))
+}
+
+// mapIdents returns stmt with the identifiers outside string literals
+// replaced by what f returns for them, unless nil. f is given each
+// identifier, quoted or not, its part in a qualified name such as
+// db.table.col, from 0, with the part before it, and whether it
+// qualifies the next, being followed by a ".". Keywords are passed as
+// identifiers too. Only the head of INSERT and REPLACE statements is
+// looked at, to leave their data alone.
+func mapIdents(stmt []byte, f func(name, qualifier []byte, part int, qualifies bool) []byte) []byte {
+	head, tail := stmt, []byte(nil)
+	if kind := classify(stmt).Kind; kind == "INSERT" || kind == "REPLACE" {
+		if loc := insertValues.FindIndex(stmt); loc != nil {
+			head, tail = stmt[:loc[0]], stmt[loc[0]:]
+		}
+	}
+	var out, qualifier []byte
+	last, part, dot := 0, 0, -1
+	for i := 0; i < len(head); i++ {
+		c := head[i]
+		var end int
+		switch {
+		case c == '\'' || c == '"':
+			if i = closingQuote(head, i); i < 0 {
+				return stmt
+			}
+			continue
+		case c == '`':
+			if end = closingQuote(head, i); end < 0 {
+				return stmt
+			}
+			end++
+		case isIdentByte(c):
+			if i > 0 && isIdentByte(head[i-1]) {
+				continue
+			}
+			for end = i; end < len(head) && isIdentByte(head[end]); end++ {
+			}
+		default:
+			continue
+		}
+		if dot < 0 || len(bytes.TrimSpace(head[dot+1:i])) > 0 {
+			qualifier, part = nil, 0
+		}
+		next := end
+		for next < len(head) && (head[next] == ' ' || head[next] == '\t' || head[next] == '\n') {
+			next++
+		}
+		qualifies := next < len(head) && head[next] == '.'
+		if repl := f(head[i:end], qualifier, part, qualifies); repl != nil {
+			out = append(append(out, head[last:i]...), repl...)
+			last = end
+		}
+		dot = -1
+		if qualifies {
+			qualifier, part, dot = head[i:end], part+1, next
+		}
+		i = end - 1
+	}
+	if out == nil {
+		return stmt
+	}
+	return append(append(out, head[last:]...), tail...)
+}
@@ -0,0 +1,156 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	replicaDsns        stringList
+	maxReplicaLag      = flag.Duration("max-replica-lag", 30*time.Second, "With -replica-dsn, pause the replay while a replica lags further behind than this")
+	replicaLagQuery    = flag.String("replica-lag-query", "", "Query returning the lag of a replica in seconds, instead of SHOW SLAVE STATUS")
+	replicaLagInterval = flag.Duration("replica-lag-interval", 5*time.Second, "How often the lag of the -replica-dsn replicas is checked")
+)
+
+func init() {
+	flag.Var(&replicaDsns, "replica-dsn", "MySQL Data Source Name of a read replica of the target whose lag slows the replay (may be repeated)")
+}
+
+// replicaLag is the state of the replicas of the target.
+var replicaLag struct {
+	sync.Mutex
+	// behind is set while a replica lags more than -max-replica-lag.
+	behind bool
+	// resumed is closed when the replicas catch up.
+	resumed chan struct{}
+}
+
+var watchReplicas sync.Once
+
+// watchReplicaLag starts checking the lag of the -replica-dsn replicas,
+// once.
+func watchReplicaLag() {
+	if len(replicaDsns) == 0 {
+		return
+	}
+	watchReplicas.Do(func() {
+		var replicas []*sql.DB
+		for _, d := range replicaDsns {
+			addSecret(dsnPassword(d))
+			db, err := sql.Open("mysql", d)
+			if err != nil {
+				log.Fatalf("-replica-dsn: %v", err)
+			}
+			replicas = append(replicas, db)
+		}
+		go func() {
+			for {
+				checkReplicaLag(replicas)
+				time.Sleep(*replicaLagInterval)
+			}
+		}()
+	})
+}
+
+// checkReplicaLag pauses the replay if one of replicas lags more than
+// -max-replica-lag, and resumes it once none does.
+func checkReplicaLag(replicas []*sql.DB) {
+	var worst time.Duration
+	for i, db := range replicas {
+		lag, err := queryReplicaLag(db)
+		if err != nil {
+			log.Printf("replica #%d: cannot query the lag: %v", i+1, err)
+			continue
+		}
+		if lag > worst {
+			worst = lag
+		}
+	}
+	replicaLag.Lock()
+	defer replicaLag.Unlock()
+	switch behind := worst > *maxReplicaLag; {
+	case behind && !replicaLag.behind:
+		log.Printf("replicas lag %v behind, over -max-replica-lag %v: pausing the replay until they catch up", worst, *maxReplicaLag)
+		replicaLag.behind, replicaLag.resumed = true, make(chan struct{})
+	case !behind && replicaLag.behind:
+		log.Printf("replicas lag %v behind, resuming the replay", worst)
+		replicaLag.behind = false
+		close(replicaLag.resumed)
+	}
+}
+
+// queryReplicaLag returns the lag of the replica db, from
+// -replica-lag-query or SHOW SLAVE STATUS.
+func queryReplicaLag(db *sql.DB) (time.Duration, error) {
+	if *replicaLagQuery != "" {
+		var seconds float64
+		if err := db.QueryRow(*replicaLagQuery).Scan(&seconds); err != nil {
+			return 0, err
+		}
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	rows, err := db.Query("SHOW SLAVE STATUS")
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+	if !rows.Next() {
+		return 0, fmt.Errorf("not a replica")
+	}
+	values := make([]sql.RawBytes, len(cols))
+	dest := make([]interface{}, len(cols))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return 0, err
+	}
+	for i, c := range cols {
+		if c != "Seconds_Behind_Master" && c != "Seconds_Behind_Source" {
+			continue
+		}
+		if values[i] == nil {
+			return 0, fmt.Errorf("replication is not running")
+		}
+		seconds, err := strconv.ParseInt(string(values[i]), 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(seconds) * time.Second, nil
+	}
+	return 0, fmt.Errorf("SHOW SLAVE STATUS has no Seconds_Behind_Master column")
+}
+
+// waitForReplicas blocks while the replicas lag too far behind.
+func waitForReplicas() {
+	replicaLag.Lock()
+	behind, resumed := replicaLag.behind, replicaLag.resumed
+	replicaLag.Unlock()
+	if behind {
+		<-resumed
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"flag"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+var (
+	maxAttempts  = flag.Int("retries", 5, "Attempts at a statement failing with a transient error, such as a lost connection, a deadlock or a lock wait timeout, before giving up")
+	retryBackoff = flag.Duration("retry-backoff", time.Second, "Wait before the first retry of a statement; it doubles with every attempt, up to a minute")
+)
+
+// maxBackoff caps the wait between retries.
+const maxBackoff = time.Minute
+
+// isLockError reports whether err is a deadlock or a lock wait timeout,
+// after which the statement can be executed again on the same
+// connection.
+func isLockError(err error) bool {
+	merr, ok := err.(*mysql.MySQLError)
+	return ok && (merr.Number == 1205 || // ER_LOCK_WAIT_TIMEOUT
+		merr.Number == 1213) // ER_LOCK_DEADLOCK
+}
+
+// isTransient reports whether a statement failing with err may succeed
+// if executed again.
+func isTransient(err error) bool {
+	return isConnectionError(err) || isLockError(err)
+}
+
+// backoff returns how long to wait before the given retry, counting
+// from 1.
+func backoff(retry int) time.Duration {
+	d := *retryBackoff
+	for i := 1; i < retry && d < maxBackoff; i++ {
+		d *= 2
+	}
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	return d
+}
@@ -0,0 +1,140 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"io"
+	"log"
+	"os"
+)
+
+var (
+	verifyMode      = choiceFlag("verify", "none", "After the import, check the tables of the dump on the target; rowcount compares their number of rows with the rows inserted by the dump, or with the tables of -verify-source-dsn", "none", "rowcount")
+	verifySourceDSN = flag.String("verify-source-dsn", "", "MySQL Data Source Name of the server the dump was taken from, whose tables -verify=rowcount counts the rows of instead of the dump's")
+)
+
+// exitRowCountMismatch is the exit status of an import that completed
+// but whose tables do not have the expected number of rows.
+const exitRowCountMismatch = 8
+
+// tableCount is the number of rows a table of the dump is expected to
+// have.
+type tableCount struct {
+	// source and target are the quoted names of the table in the dump
+	// and, once rewritten, on the target.
+	source, target string
+	rows           int64
+}
+
+// dumpRowCounts reads the dump r and returns the tables it creates or
+// inserts into, in order, with the number of rows it inserts.
+func dumpRowCounts(r io.Reader) ([]*tableCount, error) {
+	var tables []*tableCount
+	byName := map[string]*tableCount{}
+	sourceDB, targetDB := "", ""
+	sr := newStmtReader(r, 0)
+	for {
+		line, err := sr.Next()
+		if err == io.EOF {
+			return tables, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		stmt := rewrite(line)
+		if stmt == nil {
+			continue
+		}
+		src, info := classify(line), classify(stmt)
+		switch info.Kind {
+		case "USE":
+			sourceDB, targetDB = src.Database, info.Database
+			continue
+		case "CREATE TABLE", "INSERT", "REPLACE":
+		default:
+			continue
+		}
+		if src.Database == "" {
+			src.Database = sourceDB
+		}
+		if info.Database == "" {
+			info.Database = targetDB
+		}
+		name := qualifiedName(info.Database, info.Table)
+		t := byName[name]
+		if t == nil {
+			t = &tableCount{source: qualifiedName(src.Database, src.Table), target: name}
+			tables = append(tables, t)
+			byName[name] = t
+		}
+		if info.Kind != "CREATE TABLE" {
+			_, rows, _ := insertRows(stmt)
+			t.rows += int64(len(rows))
+		}
+	}
+}
+
+// verifyRowCounts checks that the tables of the dump f have as many rows
+// on the target as the dump inserts, or as on -verify-source-dsn, and
+// exits with a distinct status if some do not.
+func verifyRowCounts(db *target, f *dumpFile) {
+	tables, err := dumpRowCounts(f.from(0))
+	if err != nil {
+		log.Fatalf("count the rows of the dump: %v", err)
+	}
+	var source *sql.DB
+	if *verifySourceDSN != "" {
+		addSecret(dsnPassword(*verifySourceDSN))
+		if source, err = sql.Open("mysql", *verifySourceDSN); err != nil {
+			log.Fatalf("-verify-source-dsn: %v", err)
+		}
+		defer source.Close()
+	}
+	count := func(db *sql.DB, name string) (int64, error) {
+		var n int64
+		err := db.QueryRow("SELECT COUNT(*) FROM " + name).Scan(&n)
+		return n, err
+	}
+	failed := 0
+	for _, t := range tables {
+		want, from := t.rows, "the dump"
+		if source != nil {
+			if want, err = count(source, t.source); err != nil {
+				log.Printf("count the rows of %s on the source: %v", t.source, err)
+				failed++
+				continue
+			}
+			from = "the source"
+		}
+		got, err := count(db.db, t.target)
+		if err != nil {
+			log.Printf("count the rows of %s: %v", t.target, err)
+			failed++
+			continue
+		}
+		if got != want {
+			log.Printf("MISMATCH: %s has %d rows on the target and %d in %s", t.target, got, want, from)
+			failed++
+		}
+	}
+	if failed > 0 {
+		log.Printf("%d of %d tables do not have the expected number of rows", failed, len(tables))
+		os.Exit(exitRowCountMismatch)
+	}
+	log.Printf("all %d tables have the expected number of rows", len(tables))
+}
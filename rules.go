@@ -0,0 +1,109 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// rewriteRule replaces the matches of re in a statement with repl, in
+// which $1 or ${name} stand for the submatches.
+type rewriteRule struct {
+	re   *regexp.Regexp
+	repl []byte
+}
+
+// rewriteRules is a flag.Value for repeated -rewrite rules.
+type rewriteRules []rewriteRule
+
+var userRules rewriteRules
+
+func init() {
+	flag.Var(&userRules, "rewrite", "Rewrite statements with this rule, 'regex=>replacement' (e.g. '(?i)ENGINE=MyISAM=>ENGINE=InnoDB'); repeat it for several rules, applied in order")
+	flag.Var(&rulesFile{rules: &userRules}, "rewrite-file", "File of -rewrite rules, one per line; blank lines and lines starting with # are ignored")
+}
+
+func (l *rewriteRules) String() string {
+	var s []string
+	for _, r := range *l {
+		s = append(s, r.re.String()+"=>"+string(r.repl))
+	}
+	return strings.Join(s, ",")
+}
+
+func (l *rewriteRules) Set(v string) error {
+	i := strings.Index(v, "=>")
+	if i < 0 {
+		return fmt.Errorf("%q is not of the form 'regex=>replacement'", v)
+	}
+	re, err := regexp.Compile(v[:i])
+	if err != nil {
+		return err
+	}
+	*l = append(*l, rewriteRule{re, []byte(v[i+2:])})
+	return nil
+}
+
+// rulesFile is a flag.Value adding the rules of a file to rules.
+type rulesFile struct {
+	rules *rewriteRules
+	names []string
+}
+
+func (f *rulesFile) String() string {
+	return strings.Join(f.names, ",")
+}
+
+func (f *rulesFile) Set(name string) error {
+	f.names = append(f.names, name)
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	s := bufio.NewScanner(file)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := f.rules.Set(line); err != nil {
+			return fmt.Errorf("%s:%d: %v", name, n, err)
+		}
+	}
+	return s.Err()
+}
+
+// applyRules applies the -rewrite rules to stmt. It returns nil when
+// they leave nothing of it, so that a rule can also drop statements.
+func applyRules(stmt []byte) []byte {
+	if len(userRules) == 0 {
+		return stmt
+	}
+	for _, r := range userRules {
+		stmt = r.re.ReplaceAll(stmt, r.repl)
+	}
+	if len(bytes.TrimSpace(stmt)) == 0 {
+		return nil
+	}
+	return stmt
+}
@@ -0,0 +1,124 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+var (
+	s3Region   = flag.String("s3-region", "", "Region of the S3 bucket of an s3:// dump (default that of the AWS configuration, or us-east-1)")
+	s3Endpoint = flag.String("s3-endpoint", "", "Endpoint of an S3-compatible store holding an s3:// dump, e.g. https://storage.example.com, addressed with path-style URLs")
+)
+
+// s3Path splits an s3://bucket/key location.
+func s3Path(loc string) (bucket, key string, ok bool) {
+	if !strings.HasPrefix(loc, "s3://") {
+		return "", "", false
+	}
+	loc = strings.TrimPrefix(loc, "s3://")
+	i := strings.Index(loc, "/")
+	if i < 0 {
+		return loc, "", true
+	}
+	return loc[:i], loc[i+1:], true
+}
+
+// s3Dump is a dump stored in Amazon S3.
+type s3Dump struct {
+	bucket, key string
+}
+
+func (s s3Dump) size() (int64, error) {
+	c, err := s3Client()
+	if err != nil {
+		return 0, err
+	}
+	out, err := c.HeadObject(context.Background(), &s3.HeadObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(s.key)}, s.options)
+	if err != nil {
+		return 0, fmt.Errorf("s3://%s/%s: %v", s.bucket, s.key, err)
+	}
+	return aws.ToInt64(out.ContentLength), nil
+}
+
+func (s s3Dump) readRange(start, end int64) (io.ReadCloser, error) {
+	c, err := s3Client()
+	if err != nil {
+		return nil, err
+	}
+	out, err := c.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", start, end-1)),
+	}, s.options)
+	if err != nil {
+		return nil, fmt.Errorf("s3://%s/%s: %v", s.bucket, s.key, err)
+	}
+	return out.Body, nil
+}
+
+// options addresses the bucket with a path-style URL if its name holds
+// dots, which the wildcard certificate of virtual-hosted URLs does not
+// cover.
+func (s s3Dump) options(o *s3.Options) {
+	if strings.Contains(s.bucket, ".") {
+		o.UsePathStyle = true
+	}
+}
+
+var s3Clients struct {
+	sync.Mutex
+	c *s3.Client
+}
+
+// s3Client returns the S3 client, created on first use with the
+// default AWS configuration: its credential chain covers environment
+// variables, shared profiles including SSO and assumed roles, web
+// identity tokens and the roles of ECS tasks and EC2 instances.
+func s3Client() (*s3.Client, error) {
+	s3Clients.Lock()
+	defer s3Clients.Unlock()
+	if s3Clients.c != nil {
+		return s3Clients.c, nil
+	}
+	var opts []func(*config.LoadOptions) error
+	if *s3Region != "" {
+		opts = append(opts, config.WithRegion(*s3Region))
+	}
+	cfg, err := config.LoadDefaultConfig(context.Background(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("AWS configuration: %v", err)
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	s3Clients.c = s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if *s3Endpoint != "" {
+			o.BaseEndpoint = aws.String(*s3Endpoint)
+			o.UsePathStyle = true
+		}
+	})
+	return s3Clients.c, nil
+}
@@ -0,0 +1,291 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// scopePubSub grants access to Cloud Pub/Sub.
+const scopePubSub = "https://www.googleapis.com/auth/pubsub"
+
+// ackExtension is how long each extension of the acknowledgement
+// deadline of a message being imported lasts; it is renewed at half of
+// it.
+const ackExtension = 10 * time.Minute
+
+// retryDelay is how long a failed import waits before it is delivered
+// again, doubling with each failure up to maxRetryDelay, the longest
+// acknowledgement deadline Pub/Sub allows.
+const (
+	retryDelay    = 10 * time.Second
+	maxRetryDelay = 10 * time.Minute
+)
+
+// serveFlags are the flags of the serve subcommand itself, which are
+// not passed on to the imports.
+var serveFlags = map[string]bool{
+	"subscription":  true,
+	"checkpoints":   true,
+	"object-prefix": true,
+	"workdir":       true,
+}
+
+// pubsubDo issues a Cloud Pub/Sub API request on the subscription sub
+// and decodes the response into out, if not nil.
+func pubsubDo(sub, method string, in, out interface{}) error {
+	client, err := googleClient(context.Background(), scopePubSub)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post("https://pubsub.googleapis.com/v1/"+sub+":"+method, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("pubsub %s: %s: %s", method, resp.Status, b)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(b, out)
+}
+
+// gcsNotification is a Pub/Sub message sent by a Cloud Storage
+// notification.
+type gcsNotification struct {
+	AckID   string `json:"ackId"`
+	Message struct {
+		Attributes struct {
+			EventType        string `json:"eventType"`
+			BucketID         string `json:"bucketId"`
+			ObjectID         string `json:"objectId"`
+			ObjectGeneration string `json:"objectGeneration"`
+		} `json:"attributes"`
+	} `json:"message"`
+}
+
+// serveCmd implements "cloudsql-import serve -subscription s
+// -checkpoints gs://bucket/prefix/ [import flags]", which imports every
+// dump object that the Cloud Storage notifications of the subscription
+// announce, with the import flags. Each import runs as a separate
+// process streaming the dump from Cloud Storage, and its checkpoint log
+// is kept in Cloud Storage, so that an import interrupted by a crash of
+// the service resumes when the message is delivered again.
+func serveCmd(args []string) {
+	fs := subcommandFlags("serve")
+	subscription := fs.String("subscription", "", "Pub/Sub subscription receiving the Cloud Storage notifications, as projects/p/subscriptions/s")
+	checkpoints := fs.String("checkpoints", "", "Cloud Storage location, as gs://bucket/prefix/, of the checkpoint logs of the imports")
+	objectPrefix := fs.String("object-prefix", "", "Only import the objects whose name starts with this")
+	workdir := fs.String("workdir", filepath.Join(os.TempDir(), "cloudsql-import-serve"), "Directory holding the checkpoint logs of the imports running")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s serve -subscription projects/p/subscriptions/s -checkpoints gs://bucket/prefix/ [import flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if rest := parseInterspersed(fs, args); len(rest) != 0 || *subscription == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	cpBucket, cpPrefix, ok := gcsPath(*checkpoints)
+	if !ok {
+		log.Fatalf("-checkpoints must be a gs://bucket/prefix/ location")
+	}
+	importArgs := dropFlags(args, serveFlags)
+	// failures counts the failed imports of each object, to back off.
+	failures := map[string]int{}
+
+	log.Printf("serve: waiting for dumps on %s", *subscription)
+	for {
+		var pulled struct {
+			ReceivedMessages []gcsNotification `json:"receivedMessages"`
+		}
+		if err := pubsubDo(*subscription, "pull", map[string]interface{}{"maxMessages": 1}, &pulled); err != nil {
+			log.Printf("serve: pull: %v", err)
+			time.Sleep(10 * time.Second)
+			continue
+		}
+		for _, m := range pulled.ReceivedMessages {
+			a := m.Message.Attributes
+			if a.EventType != "OBJECT_FINALIZE" || !strings.HasPrefix(a.ObjectID, *objectPrefix) {
+				ack(*subscription, m.AckID)
+				continue
+			}
+			object := a.BucketID + "/" + a.ObjectID
+			err := serveImport(*subscription, m.AckID, a.BucketID, a.ObjectID, a.ObjectGeneration, *workdir, cpBucket, cpPrefix, importArgs)
+			if err == nil {
+				delete(failures, object)
+				ack(*subscription, m.AckID)
+				continue
+			}
+			// A failed import is delivered again, to resume from its
+			// checkpoint; a dead-letter topic bounds the attempts.
+			d := retryDelay << uint(failures[object])
+			if d > maxRetryDelay || d <= 0 {
+				d = maxRetryDelay
+			} else {
+				failures[object]++
+			}
+			log.Printf("serve: gs://%s: %v; retrying in %v", object, err, d)
+			if err := extendAck(*subscription, m.AckID, d); err != nil {
+				log.Printf("serve: %v", err)
+			}
+		}
+	}
+}
+
+// ack acknowledges a message.
+func ack(sub, ackID string) {
+	if err := pubsubDo(sub, "acknowledge", map[string]interface{}{"ackIds": []string{ackID}}, nil); err != nil {
+		log.Printf("serve: %v", err)
+	}
+}
+
+func extendAck(sub, ackID string, d time.Duration) error {
+	return pubsubDo(sub, "modifyAckDeadline", map[string]interface{}{
+		"ackIds":             []string{ackID},
+		"ackDeadlineSeconds": int(d / time.Second),
+	}, nil)
+}
+
+// serveImport imports the given generation of the object name of
+// bucket, keeping its checkpoint log in cpBucket. The message announcing
+// it is kept from being delivered again meanwhile; the deadline is no
+// longer extended once it returns.
+func serveImport(sub, ackID, bucket, name, generation, workdir, cpBucket, cpPrefix string, importArgs []string) error {
+	// An object uploaded again is a new dump, imported from the start.
+	object := bucket + "/" + name + "#" + generation
+	sum := sha256.Sum256([]byte(object))
+	dir := filepath.Join(workdir, hex.EncodeToString(sum[:8]))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	logName := path.Base(name) + ".log"
+	cpObject := cpPrefix + base64.RawURLEncoding.EncodeToString([]byte(object)) + ".log"
+
+	done, extended := make(chan struct{}), make(chan struct{})
+	defer func() {
+		close(done)
+		<-extended
+	}()
+	go func() {
+		defer close(extended)
+		t := time.NewTicker(ackExtension / 2)
+		defer t.Stop()
+		for {
+			if err := extendAck(sub, ackID, ackExtension); err != nil {
+				log.Printf("serve: %v", err)
+			}
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				saveServeCheckpoint(filepath.Join(dir, logName), cpBucket, cpObject)
+			}
+		}
+	}()
+
+	if b, err := gcsDownload(cpBucket, cpObject); err == nil {
+		log.Printf("serve: resuming gs://%s/%s from its checkpoint", bucket, name)
+		if err := ioutil.WriteFile(filepath.Join(dir, logName), b, 0644); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("serve: importing gs://%s/%s", bucket, name)
+	// The import streams the dump from Cloud Storage, so that it is the
+	// same dump, by the identity in the checkpoint log, on every
+	// delivery. It runs in the current directory, where the relative
+	// paths of its flags lead, with only its checkpoint log in dir.
+	cmd := exec.Command(os.Args[0], append(importArgs, "-dump", "gs://"+bucket+"/"+name, "-checkpoint", filepath.Join(dir, logName))...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	err := cmd.Run()
+	saveServeCheckpoint(filepath.Join(dir, logName), cpBucket, cpObject)
+	if err != nil {
+		return err
+	}
+	log.Printf("serve: imported gs://%s/%s", bucket, name)
+	return nil
+}
+
+// saveServeCheckpoint uploads the checkpoint log of an import.
+func saveServeCheckpoint(logFile, bucket, object string) {
+	b, err := ioutil.ReadFile(logFile)
+	if err != nil {
+		return
+	}
+	if err := gcsUpload(bucket, object, b); err != nil {
+		log.Printf("serve: save checkpoint: %v", err)
+	}
+}
+
+// dropFlags returns args without the flags named in drop and their
+// values. Boolean flags only take a value after "=".
+func dropFlags(args []string, drop map[string]bool) []string {
+	var out []string
+	for i := 0; i < len(args); i++ {
+		name := strings.TrimLeft(args[i], "-")
+		if !strings.HasPrefix(args[i], "-") || name == "" {
+			out = append(out, args[i])
+			continue
+		}
+		if j := strings.Index(name, "="); j >= 0 {
+			if !drop[name[:j]] {
+				out = append(out, args[i])
+			}
+			continue
+		}
+		if drop[name] {
+			if f := flag.Lookup(name); f == nil || !isBoolFlag(f) {
+				i++ // The value follows.
+			}
+			continue
+		}
+		out = append(out, args[i])
+	}
+	return out
+}
+
+// isBoolFlag reports whether f is a boolean flag, such as -prompt.
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
@@ -0,0 +1,63 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+)
+
+// exitInterrupted is the exit status of an import stopped by SIGINT or
+// SIGTERM.
+const exitInterrupted = 6
+
+// interrupted is set to 1 once SIGINT or SIGTERM is received.
+var interrupted int32
+
+// catchSignals makes SIGINT and SIGTERM stop the import once the
+// statements in flight complete, rather than in the middle of one. A
+// second signal exits at once.
+func catchSignals() {
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		s := <-c
+		log.Printf("received %v, stopping once the statements in flight complete; send it again to exit at once", s)
+		atomic.StoreInt32(&interrupted, 1)
+		s = <-c
+		log.Printf("received %v again, exiting; the checkpoint may be behind the database, and the statements in between replayed again on resume", s)
+		os.Exit(exitInterrupted)
+	}()
+}
+
+// stopIfInterrupted exits if a signal was received, with the checkpoint
+// log, whose last checkpoint is pos, flushed.
+func stopIfInterrupted(logFile *os.File, pos int64) {
+	if atomic.LoadInt32(&interrupted) == 0 {
+		return
+	}
+	flushLog()
+	stopProgress()
+	if err := closeLog(logFile); err != nil {
+		log.Fatalf("Error saving to log: %v", err)
+	}
+	recordRun("interrupted", pos, nil)
+	log.Printf("interrupted at offset %d; run the same command again to resume", pos)
+	os.Exit(exitInterrupted)
+}
@@ -0,0 +1,61 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+)
+
+var (
+	skipToTable = flag.String("skip-to-table", "", "Skip the statements of the dump before the first statement on this table (\"db.table\" or \"table\"), other than those setting up the session")
+	skipKeepDDL = flag.Bool("skip-keep-ddl", false, "With -skip-to-table, still replay the skipped statements other than INSERT and REPLACE, such as those creating databases and tables")
+)
+
+// skipTo marks the statements of the dump f that precede the first
+// statement on the -skip-to-table table as replayed.
+func skipTo(f *dumpFile) {
+	db := ""
+	sr := newStmtReader(f.from(0), 0)
+	for {
+		prev := sr.Pos
+		stmt, err := sr.Next()
+		if err == io.EOF {
+			log.Fatalf("-skip-to-table: no statement on %s in the dump", *skipToTable)
+		}
+		if err != nil {
+			log.Fatalf("-skip-to-table: %v", err)
+		}
+		info := classify(stmt)
+		if info.Kind == "USE" {
+			db = info.Database
+		}
+		if info.Table != "" {
+			if info.Database == "" {
+				info.Database = db
+			}
+			if *skipToTable == info.Table || *skipToTable == info.Database+"."+info.Table {
+				log.Printf("skipping to %s at %d", *skipToTable, prev)
+				return
+			}
+		}
+		if isSessionStatement(info.Kind) || *skipKeepDDL && info.Kind != "INSERT" && info.Kind != "REPLACE" {
+			continue
+		}
+		progress.complete(prev, sr.Pos)
+	}
+}
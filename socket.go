@@ -0,0 +1,52 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+)
+
+var (
+	socketPath     = flag.String("socket", "", "Connect through this Unix domain socket instead of -dsn, e.g. /cloudsql/project:region:instance of the Cloud SQL Auth Proxy")
+	socketUser     = flag.String("user", "", "MySQL user to connect as with -socket")
+	socketDatabase = flag.String("database", "", "Database to connect to with -socket")
+)
+
+// socketDSN sets -dsn to connect through -socket as -user. The password
+// comes from -prompt, -password-env or -password-file, if any.
+func socketDSN() {
+	if *socketPath == "" {
+		if *socketUser != "" || *socketDatabase != "" {
+			log.Fatalf("-user and -database require -socket")
+		}
+		return
+	}
+	dsnSet := false
+	flag.Visit(func(f *flag.Flag) {
+		dsnSet = dsnSet || f.Name == "dsn"
+	})
+	switch {
+	case dsnSet:
+		log.Fatalf("-socket cannot be used with -dsn")
+	case *socketUser == "":
+		log.Fatalf("-socket requires -user")
+	case *cloudsqlInstance != "":
+		log.Fatalf("-socket cannot be used with -cloudsql-instance")
+	}
+	*dsn = fmt.Sprintf("%s@unix(%s)/%s", *socketUser, *socketPath, *socketDatabase)
+}
@@ -0,0 +1,306 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"log"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+var (
+	splitSize  byteSize
+	checkSizes = flag.Bool("check-sizes", true, "Before replaying, scan the dump for statements larger than the target's max_allowed_packet that cannot be split")
+)
+
+func init() {
+	flag.Var(&splitSize, "split-size", "Split extended INSERT and REPLACE statements larger than this into several (e.g. 16MB; default a little below the target's max_allowed_packet)")
+}
+
+// driverMaxPacket is the largest packet the MySQL driver sends by
+// default, which validate checks statements against.
+const driverMaxPacket = 64 << 20
+
+// packetLimit is the size above which extended INSERT and REPLACE
+// statements are split into several statements, or 0 not to split.
+var packetLimit int
+
+// serverPacket is the target's max_allowed_packet, capped by the
+// driver's, or 0 if unknown.
+var serverPacket int
+
+// packetParams returns the DSN parameter letting the driver send
+// packets as large as the server's max_allowed_packet, unless -dsn sets
+// maxAllowedPacket itself.
+func packetParams() []string {
+	if strings.Contains(*dsn, "maxAllowedPacket=") {
+		return nil
+	}
+	return []string{"maxAllowedPacket=0"}
+}
+
+// dsnPacketLimit returns the maxAllowedPacket set in -dsn, or 0 if the
+// driver reads it from the server.
+func dsnPacketLimit() int {
+	if !strings.Contains(*dsn, "maxAllowedPacket=") {
+		return 0
+	}
+	cfg, err := mysql.ParseDSN(*dsn)
+	if err != nil {
+		return 0
+	}
+	return cfg.MaxAllowedPacket
+}
+
+// detectPacketLimit sets packetLimit to -split-size or, by default, a
+// little below the largest packet that the server and the driver
+// accept, leaving room for the protocol overhead. Without a target, db
+// is nil and only -split-size applies.
+func detectPacketLimit(db *target) {
+	packetLimit = int(splitSize)
+	if db == nil {
+		return
+	}
+	var n int
+	if err := db.db.QueryRow("SELECT @@max_allowed_packet").Scan(&n); err != nil {
+		if packetLimit == 0 {
+			log.Printf("cannot query max_allowed_packet, large statements will not be split: %v", err)
+		}
+		return
+	}
+	if m := dsnPacketLimit(); m > 0 && n > m {
+		n = m
+	}
+	serverPacket = n
+	switch {
+	case packetLimit == 0:
+		packetLimit = n - n/10
+	case packetLimit > n:
+		log.Printf("-split-size %d is above the largest packet accepted, %d: larger statements will be rejected", packetLimit, n)
+	}
+}
+
+// checkStatementSizes scans the dump f from pos and warns of the
+// statements larger than serverPacket that cannot be split, on which the
+// import would fail, before replaying any.
+func checkStatementSizes(f *dumpFile, pos int64) {
+	if !*checkSizes || serverPacket == 0 || f.piped() {
+		return
+	}
+	r := newStmtReader(f.from(pos), pos)
+	r.SetDelimiter(startDelimiter)
+	var found int
+	var first int64
+	for {
+		stmt, err := r.Next()
+		if err != nil {
+			// Errors are reported when the statement is replayed.
+			break
+		}
+		if len(stmt) <= serverPacket || fitsPacket(stmt) {
+			continue
+		}
+		if found == 0 {
+			first = r.Start
+		}
+		found++
+		if found <= 10 {
+			log.Printf("statement at offset %d is %s, above max_allowed_packet (%s), and cannot be split: %s", r.Start, humanSize(int64(len(stmt))), humanSize(int64(serverPacket)), excerpt(stmt))
+		}
+	}
+	if found > 0 {
+		log.Printf("%d statements are too large for the target; the import will fail at offset %d unless max_allowed_packet is raised (up to 1GB) or -on-error skips them", found, first)
+	}
+}
+
+// fitsPacket reports whether stmt is split into statements that the
+// target accepts.
+func fitsPacket(stmt []byte) bool {
+	parts := splitStatement(stmt)
+	if parts == nil {
+		return false
+	}
+	for _, p := range parts {
+		if len(p) > serverPacket {
+			return false
+		}
+	}
+	return true
+}
+
+// splitStatement splits an extended INSERT or REPLACE statement larger
+// than packetLimit into statements that are not, each inserting some of
+// its rows. It returns nil if stmt does not need to be or cannot be
+// split.
+func splitStatement(stmt []byte) [][]byte {
+	if packetLimit <= 0 || len(stmt) <= packetLimit {
+		return nil
+	}
+	return splitRows(stmt, packetLimit)
+}
+
+// splitRows splits the INSERT or REPLACE statement stmt into statements
+// of at most limit bytes, unless a single row is larger than that.
+func splitRows(stmt []byte, limit int) [][]byte {
+	prefix, rows, suffix := insertRows(stmt)
+	if len(rows) < 2 {
+		return nil
+	}
+
+	var parts [][]byte
+	var cur []byte
+	for _, row := range rows {
+		if cur != nil && len(cur)+1+len(row)+len(suffix) > limit {
+			parts = append(parts, append(cur, suffix...))
+			cur = nil
+		}
+		if cur == nil {
+			cur = append(append([]byte(nil), prefix...), row...)
+		} else {
+			cur = append(append(cur, ','), row...)
+		}
+	}
+	return append(parts, append(cur, suffix...))
+}
+
+// insertRows splits the INSERT or REPLACE statement stmt into what
+// precedes its rows, the rows, each a parenthesized list of values, and
+// what follows them, such as ";" or an ON DUPLICATE KEY UPDATE clause.
+// rows is nil if stmt is not such a statement.
+func insertRows(stmt []byte) (prefix []byte, rows [][]byte, suffix []byte) {
+	if kind := classify(stmt).Kind; kind != "INSERT" && kind != "REPLACE" {
+		return nil, nil, nil
+	}
+	i := valuesIndex(stmt)
+	if i < 0 {
+		return nil, nil, nil
+	}
+	for i < len(stmt) && isSpace(stmt[i]) {
+		i++
+	}
+	prefix = stmt[:i]
+	for {
+		if i >= len(stmt) || stmt[i] != '(' {
+			return nil, nil, nil
+		}
+		end := closingParen(stmt, i)
+		if end < 0 {
+			return nil, nil, nil
+		}
+		rows = append(rows, stmt[i:end])
+		for i = end; i < len(stmt) && isSpace(stmt[i]); i++ {
+		}
+		if i >= len(stmt) || stmt[i] != ',' {
+			return prefix, rows, stmt[end:]
+		}
+		for i++; i < len(stmt) && isSpace(stmt[i]); i++ {
+		}
+	}
+}
+
+// rowValues splits a row returned by insertRows into its values.
+func rowValues(row []byte) [][]byte {
+	var values [][]byte
+	row = row[1 : len(row)-1]
+	start, depth := 0, 0
+	for i := 0; i < len(row); i++ {
+		switch row[i] {
+		case '\'', '"', '`':
+			if i = closingQuote(row, i); i < 0 {
+				return nil
+			}
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				values = append(values, bytes.TrimSpace(row[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	return append(values, bytes.TrimSpace(row[start:]))
+}
+
+// valuesIndex returns the index following the VALUES keyword of an
+// INSERT or REPLACE statement, or -1.
+func valuesIndex(stmt []byte) int {
+	for i := 0; i < len(stmt); i++ {
+		switch c := stmt[i]; {
+		case c == '`' || c == '\'' || c == '"':
+			i = closingQuote(stmt, i)
+			if i < 0 {
+				return -1
+			}
+		case (c == 'V' || c == 'v') && (i == 0 || !isIdentByte(stmt[i-1])) && i+6 <= len(stmt) &&
+			bytes.EqualFold(stmt[i:i+6], []byte("VALUES")) && (i+6 == len(stmt) || !isIdentByte(stmt[i+6])):
+			return i + 6
+		}
+	}
+	return -1
+}
+
+// closingQuote returns the index of the quote closing the one at
+// stmt[i], or -1. Quotes are escaped by a backslash, except in
+// identifiers, or by doubling them.
+func closingQuote(stmt []byte, i int) int {
+	q := stmt[i]
+	for i++; i < len(stmt); i++ {
+		switch stmt[i] {
+		case '\\':
+			if q != '`' {
+				i++
+			}
+		case q:
+			if i+1 < len(stmt) && stmt[i+1] == q {
+				i++
+				continue
+			}
+			return i
+		}
+	}
+	return -1
+}
+
+// closingParen returns the index following the parenthesis closing the
+// one at stmt[i], or -1.
+func closingParen(stmt []byte, i int) int {
+	depth := 0
+	for ; i < len(stmt); i++ {
+		switch stmt[i] {
+		case '\'', '"', '`':
+			if i = closingQuote(stmt, i); i < 0 {
+				return -1
+			}
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return -1
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
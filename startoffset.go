@@ -0,0 +1,98 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"log"
+)
+
+var startOffset = flag.Int64("start-offset", -1, "Start replaying at this byte offset of the dump, which must be the start of a statement, instead of at the checkpoint (e.g. after fixing a broken statement; drop it to resume afterwards)")
+
+// boundaryWindow is how much of the dump is read at a time when looking
+// for the statements around -start-offset.
+const boundaryWindow = 64 << 10
+
+// startAt returns the checkpoint cp moved to -start-offset, exiting if
+// it is not the start of a statement of f, of the given size.
+func startAt(f io.ReaderAt, size int64, cp *checkpoint) *checkpoint {
+	if *skipToTable != "" {
+		log.Fatalf("-start-offset and -skip-to-table cannot be used together")
+	}
+	off := *startOffset
+	if off > size {
+		log.Fatalf("-start-offset %d is past the end of the dump, at %d", off, size)
+	}
+	before, after, err := nearestStatements(f, off, size)
+	if err != nil {
+		log.Fatalf("-start-offset: %v", err)
+	}
+	if before != off {
+		if after < 0 {
+			log.Fatalf("-start-offset %d is not at the start of a statement; the nearest one before it is at %d", off, before)
+		}
+		log.Fatalf("-start-offset %d is not at the start of a statement; the nearest ones are at %d and %d", off, before, after)
+	}
+	log.Printf("starting at offset %d (-start-offset) instead of the checkpoint at %d", off, cp.Position)
+	c := *cp
+	c.Position, c.Done, c.Delimiter = off, nil, ""
+	return &c
+}
+
+// nearestStatements returns the offsets of the nearest statement
+// starts, offsets 0 or following a ";\n", at or before off and after
+// off, or -1 if there is none after it.
+func nearestStatements(f io.ReaderAt, off, size int64) (before, after int64, err error) {
+	buf := make([]byte, boundaryWindow+1)
+	before = 0
+	for end := off; end > 1; end -= boundaryWindow {
+		start := end - boundaryWindow - 1
+		if start < 0 {
+			start = 0
+		}
+		b := buf[:end-start]
+		if _, err := f.ReadAt(b, start); err != nil && err != io.EOF {
+			return 0, 0, err
+		}
+		if i := bytes.LastIndex(b, []byte(";\n")); i >= 0 {
+			before = start + int64(i) + 2
+			break
+		}
+	}
+	after = -1
+	for start := off; start < size; start += boundaryWindow {
+		// Statements ending just before off were counted as before.
+		from := start - 1
+		if from < 0 {
+			from = 0
+		}
+		end := start + boundaryWindow
+		if end > size {
+			end = size
+		}
+		b := buf[:end-from]
+		if _, err := f.ReadAt(b, from); err != nil && err != io.EOF {
+			return 0, 0, err
+		}
+		if i := bytes.Index(b, []byte(";\n")); i >= 0 && from+int64(i)+2 > off {
+			after = from + int64(i) + 2
+			break
+		}
+	}
+	return before, after, nil
+}
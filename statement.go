@@ -0,0 +1,118 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+)
+
+// stmtInfo describes what a statement of a dump operates on.
+type stmtInfo struct {
+	// Kind is the normalized leading keywords of the statement, such
+	// as "CREATE TABLE", "INSERT" or "SET".
+	Kind string
+	// Database is the database the statement names explicitly, if any.
+	Database string
+	// Table is the table or view the statement operates on, if any.
+	Table string
+}
+
+const (
+	ident  = "(`(?:[^`]|``)+`|[\\w$]+)"
+	qident = ident + "(?:\\s*\\.\\s*" + ident + ")?"
+)
+
+// stmtPatterns recognize the statements written by mysqldump. The
+// first submatches are either a database name, or an optional database
+// name followed by a table name.
+var stmtPatterns = []struct {
+	kind  string
+	re    *regexp.Regexp
+	table bool
+}{
+	{"CREATE DATABASE", regexp.MustCompile(`(?is)^CREATE\s+(?:DATABASE|SCHEMA)\s+(?:IF\s+NOT\s+EXISTS\s+)?` + ident), false},
+	{"DROP DATABASE", regexp.MustCompile(`(?is)^DROP\s+(?:DATABASE|SCHEMA)\s+(?:IF\s+EXISTS\s+)?` + ident), false},
+	{"USE", regexp.MustCompile(`(?is)^USE\s+` + ident), false},
+	{"CREATE TABLE", regexp.MustCompile(`(?is)^CREATE\s+(?:TEMPORARY\s+)?TABLE\s+(?:IF\s+NOT\s+EXISTS\s+)?` + qident), true},
+	{"DROP TABLE", regexp.MustCompile(`(?is)^DROP\s+(?:TEMPORARY\s+)?TABLE\s+(?:IF\s+EXISTS\s+)?` + qident), true},
+	{"ALTER TABLE", regexp.MustCompile(`(?is)^ALTER\s+(?:ONLINE\s+|IGNORE\s+)*TABLE\s+` + qident), true},
+	{"TRUNCATE", regexp.MustCompile(`(?is)^TRUNCATE\s+(?:TABLE\s+)?` + qident), true},
+	{"INSERT", regexp.MustCompile(`(?is)^INSERT\s+(?:(?:LOW_PRIORITY|DELAYED|HIGH_PRIORITY|IGNORE)\s+)*(?:INTO\s+)?` + qident), true},
+	{"REPLACE", regexp.MustCompile(`(?is)^REPLACE\s+(?:(?:LOW_PRIORITY|DELAYED)\s+)*(?:INTO\s+)?` + qident), true},
+	{"LOCK TABLES", regexp.MustCompile(`(?is)^LOCK\s+TABLES?\s+` + qident), true},
+	{"LOAD DATA", regexp.MustCompile(`(?is)^LOAD\s+DATA\s+[^;]*?INTO\s+TABLE\s+` + qident), true},
+	{"CREATE VIEW", regexp.MustCompile(`(?is)^CREATE\s+(?:OR\s+REPLACE\s+)?(?:ALGORITHM\s*=\s*\w+\s+)?(?:DEFINER\s*=\s*\S+\s+)?(?:SQL\s+SECURITY\s+\w+\s+)?VIEW\s+` + qident), true},
+	{"DROP VIEW", regexp.MustCompile(`(?is)^DROP\s+VIEW\s+(?:IF\s+EXISTS\s+)?` + qident), true},
+	{"CREATE TRIGGER", regexp.MustCompile(`(?is)^CREATE\s+(?:DEFINER\s*=\s*\S+\s+)?TRIGGER\s+` + qident + `\s+\w+\s+\w+\s+ON\s+` + qident), true},
+}
+
+// conditionalComment matches the markers of MySQL's executable comments,
+// as in "/*!40101 SET NAMES utf8 */".
+var conditionalComment = regexp.MustCompile(`/\*!\d*\s*|\s*\*/`)
+
+// classify describes the statement stmt. Only its first kilobyte is
+// looked at, which is enough for the statements of a dump and keeps
+// classifying multi-megabyte INSERTs cheap.
+func classify(stmt []byte) stmtInfo {
+	if len(stmt) > 1024 {
+		stmt = stmt[:1024]
+	}
+	stmt = bytes.TrimSpace(conditionalComment.ReplaceAll(stmt, []byte(" ")))
+	for _, p := range stmtPatterns {
+		m := p.re.FindSubmatch(stmt)
+		if m == nil {
+			continue
+		}
+		info := stmtInfo{Kind: p.kind}
+		switch {
+		case !p.table:
+			info.Database = unquoteIdent(m[1])
+		case p.kind == "CREATE TRIGGER":
+			// The table a trigger is defined on follows its name.
+			info.Database, info.Table = qualified(m[3], m[4])
+		default:
+			info.Database, info.Table = qualified(m[1], m[2])
+		}
+		return info
+	}
+	kind := stmt
+	if n := bytes.IndexFunc(kind, func(r rune) bool { return !(r == '_' || 'A' <= r && r <= 'Z' || 'a' <= r && r <= 'z') }); n >= 0 {
+		kind = kind[:n]
+	}
+	return stmtInfo{Kind: strings.ToUpper(string(kind))}
+}
+
+// qualified returns the database and table of a possibly qualified name
+// matched by qident.
+func qualified(a, b []byte) (database, table string) {
+	if b == nil {
+		return "", unquoteIdent(a)
+	}
+	return unquoteIdent(a), unquoteIdent(b)
+}
+
+func unquoteIdent(b []byte) string {
+	if len(b) >= 2 && b[0] == '`' {
+		return strings.Replace(string(b[1:len(b)-1]), "``", "`", -1)
+	}
+	return string(b)
+}
+
+func quoteIdent(s string) string {
+	return "`" + strings.Replace(s, "`", "``", -1) + "`"
+}
@@ -0,0 +1,94 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var statusAddr = flag.String("status-addr", "", "Address (e.g. :8080) on which to serve the state of the run as JSON at /status; may be -metrics-addr")
+
+// runStatus is the state of the run served at /status.
+type runStatus struct {
+	Dump       string `json:"dump"`
+	Position   int64  `json:"position"`
+	Checkpoint int64  `json:"checkpoint"`
+	// Size is -1 if unknown, and PercentComplete then 0.
+	Size                     int64   `json:"size"`
+	PercentComplete          float64 `json:"percent_complete"`
+	ThroughputBytesPerSecond float64 `json:"throughput_bytes_per_second"`
+	Statements               int64   `json:"statements"`
+	Bytes                    int64   `json:"bytes"`
+	LastStatement            string  `json:"last_statement,omitempty"`
+	LastStatementTime        string  `json:"last_statement_time,omitempty"`
+	// Errors counts the statements that failed by MySQL error number, 0
+	// for other errors.
+	Errors map[string]int64 `json:"errors"`
+}
+
+// serveStatus starts serving the status at -status-addr, if set and not
+// served with the metrics.
+func serveStatus() {
+	if *statusAddr == "" || *statusAddr == *metricsAddr {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", writeStatus)
+	go func() {
+		log.Fatalf("status: %v", http.ListenAndServe(*statusAddr, mux))
+	}()
+}
+
+// writeStatus writes the status of the run as JSON.
+func writeStatus(w http.ResponseWriter, r *http.Request) {
+	meter.Lock()
+	size := meter.size
+	meter.Unlock()
+	metrics.Lock()
+	s := runStatus{
+		Dump:                     *dump,
+		Position:                 metrics.pos,
+		Checkpoint:               metrics.checkpoint,
+		Size:                     size,
+		ThroughputBytesPerSecond: currentThroughput(),
+		Statements:               metrics.statements,
+		Bytes:                    metrics.bytes,
+		LastStatement:            metrics.lastPrefix,
+		Errors:                   map[string]int64{},
+	}
+	if !metrics.lastStatement.IsZero() {
+		s.LastStatementTime = metrics.lastStatement.UTC().Format(time.RFC3339)
+	}
+	for code, n := range metrics.errors {
+		s.Errors[strconv.Itoa(int(code))] = n
+	}
+	metrics.Unlock()
+	if size > 0 {
+		s.PercentComplete = 100 * float64(s.Position) / float64(size)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(append(b, '\n'))
+}
@@ -0,0 +1,77 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+)
+
+var (
+	stopOffset          = flag.Int64("stop-offset", -1, "Stop, saving the checkpoint, before the first statement ending past this byte offset of the dump")
+	stopAfterBytes      byteSize
+	stopAfterStatements = flag.Int("stop-after-statements", 0, "Stop, saving the checkpoint, once this many statements were replayed (0 for no limit)")
+)
+
+func init() {
+	flag.Var(&stopAfterBytes, "stop-after-bytes", "Stop, saving the checkpoint, before the statement that would take the bytes replayed past this size (e.g. 100GB; 0 for no limit)")
+}
+
+// exitStopped is the exit status of an import stopped by -stop-offset,
+// -stop-after-bytes or -stop-after-statements.
+const exitStopped = 7
+
+// stopCount holds the statements and bytes replayed by this run, for
+// -stop-after-statements and -stop-after-bytes.
+var stopCount struct {
+	statements, bytes int64
+}
+
+// stopBefore returns the flag that stops the import before the
+// statement spanning start to end, or "" if it is to be replayed. It
+// counts the statement as replayed otherwise. The first statement of a
+// run is replayed whatever its size, so that every run makes progress.
+func stopBefore(start, end int64) string {
+	switch {
+	case *stopOffset >= 0 && end > *stopOffset:
+		return "-stop-offset"
+	case *stopAfterStatements > 0 && stopCount.statements >= int64(*stopAfterStatements):
+		return "-stop-after-statements"
+	case stopAfterBytes > 0 && stopCount.statements > 0 && stopCount.bytes+end-start > int64(stopAfterBytes):
+		return "-stop-after-bytes"
+	}
+	stopCount.statements++
+	stopCount.bytes += end - start
+	return ""
+}
+
+// stop exits with the checkpoint log, whose last checkpoint is pos,
+// flushed, once the limit set by the flag name is reached.
+func stop(logFile *os.File, pos int64, name string) {
+	flushLog()
+	stopProgress()
+	if err := closeLog(logFile); err != nil {
+		log.Fatalf("Error saving to log: %v", err)
+	}
+	recordRun("stopped", pos, nil)
+	again := "the same command again"
+	if name == "-stop-offset" {
+		again = "the command again with a later -stop-offset, or without it,"
+	}
+	log.Printf("stopped at offset %d (%s); run %s to resume", pos, name, again)
+	os.Exit(exitStopped)
+}
@@ -0,0 +1,91 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"strconv"
+	"time"
+)
+
+var minFreeStorage byteSize
+
+func init() {
+	flag.Var(&minFreeStorage, "min-free-storage", "With -instance, pause the import while the target has less than this much free storage (e.g. 5GB)")
+}
+
+// storageCheckInterval is how often the free storage of the target is
+// checked, and rechecked while the import is paused.
+const storageCheckInterval = time.Minute
+
+var lastStorageCheck time.Time
+
+// waitForStorage blocks while the target has less than
+// -min-free-storage of free storage, which gives storage auto-resize,
+// or an operator growing the disk, time to catch up instead of letting
+// the import fail with a write error that leaves the instance wedged.
+// It only checks every storageCheckInterval.
+func waitForStorage(db *target) {
+	if minFreeStorage == 0 || *instanceName == "" || time.Since(lastStorageCheck) < storageCheckInterval {
+		return
+	}
+	for {
+		lastStorageCheck = time.Now()
+		free, err := freeStorage(db)
+		if err != nil {
+			log.Printf("cannot check the free storage of the target: %v", err)
+			return
+		}
+		if free >= int64(minFreeStorage) {
+			return
+		}
+		log.Printf("PAUSED: the target has about %d bytes of storage left, less than -min-free-storage=%s; checking again in %v",
+			free, &minFreeStorage, storageCheckInterval)
+		time.Sleep(storageCheckInterval)
+	}
+}
+
+// freeStorage estimates the free storage of the target from the size of
+// its disk, which the Cloud SQL Admin API gives, and the size of its
+// data and indexes.
+func freeStorage(db *target) (int64, error) {
+	ctx := context.Background()
+	inst, err := getInstance(ctx)
+	if err != nil {
+		return 0, err
+	}
+	disk, err := strconv.ParseInt(inst.Settings.DataDiskSizeGb, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	// MySQL 8.0 caches table sizes for a day unless told otherwise for
+	// the session. Older versions have no such variable.
+	c, err := db.db.Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	c.ExecContext(ctx, "SET SESSION information_schema_stats_expiry = 0")
+	var used int64
+	err = c.QueryRowContext(ctx, "SELECT COALESCE(SUM(data_length + index_length + data_free), 0) FROM information_schema.TABLES").Scan(&used)
+	if err != nil {
+		return 0, err
+	}
+	return disk<<30 - used, nil
+}
@@ -0,0 +1,242 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"math"
+	"sort"
+	"time"
+)
+
+var summaryFile = flag.String("summary-file", "", "Append the end-of-run summary to this file, as a line of JSON")
+
+// topCount is how many of the slowest and largest statements the
+// summary lists.
+const topCount = 10
+
+// stmtStat describes a replayed statement.
+type stmtStat struct {
+	Start, End int64
+	Bytes      int
+	Duration   time.Duration
+	Statement  string
+}
+
+// topStats keeps the topCount statements with the highest key.
+type topStats struct {
+	key   func(stmtStat) int64
+	stats []stmtStat
+}
+
+// wants reports whether a statement with key k would make the list.
+func (t *topStats) wants(k int64) bool {
+	return len(t.stats) < topCount || k > t.key(t.stats[len(t.stats)-1])
+}
+
+func (t *topStats) add(s stmtStat) {
+	k := t.key(s)
+	i := len(t.stats)
+	for i > 0 && t.key(t.stats[i-1]) < k {
+		i--
+	}
+	t.stats = append(t.stats, stmtStat{})
+	copy(t.stats[i+1:], t.stats[i:])
+	t.stats[i] = s
+	if len(t.stats) > topCount {
+		t.stats = t.stats[:topCount]
+	}
+}
+
+var (
+	slowest = topStats{key: func(s stmtStat) int64 { return int64(s.Duration) }}
+	largest = topStats{key: func(s stmtStat) int64 { return int64(s.Bytes) }}
+)
+
+// latencyBuckets is the number of buckets of the latency histogram,
+// four per doubling of the latency in microseconds.
+const latencyBuckets = 4 * 40
+
+// runTotals accumulates the statements of a run for the summary.
+type runTotals struct {
+	statements, bytes int64
+	duration, max     time.Duration
+	latencies         [latencyBuckets]int64
+	duplicates        int64
+	// tables counts the statements on each table.
+	tables map[string]int64
+}
+
+var totals runTotals
+
+// latencyBucket returns the bucket of the latency histogram holding d.
+func latencyBucket(d time.Duration) int {
+	i := int(4 * math.Log2(float64(d/time.Microsecond)+1))
+	if i >= latencyBuckets {
+		i = latencyBuckets - 1
+	}
+	return i
+}
+
+// percentile returns the upper bound of the bucket of the latency
+// histogram holding the p-th percentile, capped at the maximum latency.
+func percentile(p float64) time.Duration {
+	rank := int64(math.Ceil(p / 100 * float64(totals.statements)))
+	var n int64
+	for i, c := range totals.latencies {
+		if n += c; n >= rank && c > 0 {
+			d := time.Duration(math.Exp2(float64(i+1)/4)-1) * time.Microsecond
+			if d > totals.max {
+				d = totals.max
+			}
+			return d
+		}
+	}
+	return totals.max
+}
+
+// trackStatement records the statement stmt between start and end of
+// the dump, executed in d with the error err, for the summary.
+func trackStatement(stmt []byte, start, end int64, d time.Duration, err error) {
+	totals.statements++
+	totals.bytes += int64(len(stmt))
+	totals.duration += d
+	if d > totals.max {
+		totals.max = d
+	}
+	totals.latencies[latencyBucket(d)]++
+	if err != nil && isDuplicate(err) {
+		totals.duplicates++
+	}
+	if info := classify(stmt); info.Table != "" {
+		if totals.tables == nil {
+			totals.tables = map[string]int64{}
+		}
+		name := info.Table
+		if info.Database != "" {
+			name = info.Database + "." + name
+		}
+		totals.tables[name]++
+	}
+
+	ws, wl := slowest.wants(int64(d)), largest.wants(int64(len(stmt)))
+	if !ws && !wl {
+		return
+	}
+	s := stmtStat{Start: start, End: end, Bytes: len(stmt), Duration: d, Statement: excerpt(stmt)}
+	if ws {
+		slowest.add(s)
+	}
+	if wl {
+		largest.add(s)
+	}
+}
+
+// logTopStatements logs the slowest and largest statements replayed.
+func logTopStatements() {
+	for _, l := range []struct {
+		title string
+		t     *topStats
+	}{
+		{"slowest", &slowest},
+		{"largest", &largest},
+	} {
+		if len(l.t.stats) == 0 {
+			continue
+		}
+		log.Printf("%d %s statements:", len(l.t.stats), l.title)
+		for i, s := range l.t.stats {
+			log.Printf("  %2d. %7dms %10d bytes at %d-%d %q", i+1, s.Duration/time.Millisecond, s.Bytes, s.Start, s.End, s.Statement)
+		}
+	}
+}
+
+// runSummary is the end-of-run summary written to -summary-file.
+type runSummary struct {
+	Dump        string
+	Outcome     string
+	End         time.Time
+	Statements  int64
+	Bytes       int64
+	WallSeconds float64
+	// The latencies are in milliseconds. The percentiles are upper
+	// bounds, within 19%.
+	LatencyAverageMS, LatencyP50MS, LatencyP90MS, LatencyP99MS, LatencyMaxMS float64
+	DuplicatesIgnored                                                        int64
+	// Tables counts the statements replayed on each table.
+	Tables           map[string]int64
+	Slowest, Largest []stmtStat
+}
+
+// reportSummary logs the summary of the run, which ended with the given
+// outcome, and appends it to -summary-file. The totals are then reset
+// for the next run.
+func reportSummary(outcome string) {
+	if totals.statements == 0 {
+		return
+	}
+	meter.Lock()
+	wall := time.Since(meter.start)
+	meter.Unlock()
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	s := runSummary{
+		Dump:              *dump,
+		Outcome:           outcome,
+		End:               time.Now(),
+		Statements:        totals.statements,
+		Bytes:             totals.bytes,
+		WallSeconds:       wall.Seconds(),
+		LatencyAverageMS:  ms(totals.duration / time.Duration(totals.statements)),
+		LatencyP50MS:      ms(percentile(50)),
+		LatencyP90MS:      ms(percentile(90)),
+		LatencyP99MS:      ms(percentile(99)),
+		LatencyMaxMS:      ms(totals.max),
+		DuplicatesIgnored: totals.duplicates,
+		Tables:            totals.tables,
+		Slowest:           slowest.stats,
+		Largest:           largest.stats,
+	}
+
+	round := func(d time.Duration) time.Duration { return d.Round(100 * time.Microsecond) }
+	log.Printf("summary: %d statements on %d tables, %s in %s; latency average %v, p50 %v, p90 %v, p99 %v, max %v; %d \"duplicate entry\" errors ignored",
+		s.Statements, len(s.Tables), humanSize(s.Bytes), wall.Round(time.Second), round(totals.duration/time.Duration(totals.statements)),
+		round(percentile(50)), round(percentile(90)), round(percentile(99)), round(totals.max), s.DuplicatesIgnored)
+	if len(s.Tables) <= topCount {
+		var tables []string
+		for t := range s.Tables {
+			tables = append(tables, t)
+		}
+		sort.Strings(tables)
+		for _, t := range tables {
+			log.Printf("  %s: %d statements", t, s.Tables[t])
+		}
+	}
+	logTopStatements()
+
+	if *summaryFile != "" {
+		b, err := json.Marshal(s)
+		if err == nil {
+			err = appendFile(*summaryFile, append(redact(b), '\n'))
+		}
+		if err != nil {
+			log.Printf("summary: cannot write %q: %v", *summaryFile, err)
+		}
+	}
+	totals = runTotals{}
+	slowest.stats, largest.stats = nil, nil
+}
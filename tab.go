@@ -0,0 +1,134 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var (
+	tabChunkRows = flag.Int("tab-chunk-rows", 100000, "With -format=tab, rows loaded by each LOAD DATA statement, after which the checkpoint is saved")
+	tabCharset   = flag.String("tab-character-set", "utf8mb4", "With -format=tab, character set of the data files, as given to mysqldump --default-character-set")
+)
+
+// tabTables maps the data files of a mysqldump --tab directory to the
+// table they are loaded into.
+var tabTables = map[string]string{}
+
+// tabFiles returns the files of the mysqldump --tab directory dir in
+// the order they are imported: the schema files, then the data files,
+// whose table it records.
+func tabFiles(dir string) ([]string, error) {
+	if isRemoteDump(dir) {
+		return nil, fmt.Errorf("-format=tab needs a local directory")
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var schemas, data []string
+	for _, e := range entries {
+		name := e.Name()
+		switch {
+		case e.IsDir():
+		case strings.HasSuffix(name, ".sql"):
+			schemas = append(schemas, filepath.Join(dir, name))
+		case strings.HasSuffix(name, ".txt"):
+			path := filepath.Join(dir, name)
+			tabTables[path] = strings.TrimSuffix(name, ".txt")
+			data = append(data, path)
+		}
+	}
+	if len(schemas) == 0 {
+		return nil, fmt.Errorf("no .sql files in %q", dir)
+	}
+	sort.Strings(schemas)
+	sort.Strings(data)
+	return append(schemas, data...), nil
+}
+
+// importTabData loads -dump, a data file of a mysqldump --tab
+// directory, into its table with LOAD DATA, in chunks of rows after
+// each of which the checkpoint is saved.
+func importTabData() {
+	logFilename := checkpointName(*dump)
+	cp, err := recover(logFilename)
+	if err != nil {
+		log.Fatalf("recover from log: %v", err)
+	}
+	if dumpIndex(cp.File) > dumpIndex(*dump) {
+		log.Printf("%q was imported before %q, skipping it", *dump, cp.File)
+		return
+	}
+	newFile := cp.File != *dump
+	if newFile {
+		cp = cp.startFile(*dump)
+	}
+	t := &loadTable{table: tabTables[*dump], tsv: true, charset: *tabCharset}
+	if *dryRun {
+		log.Printf("dry run: not loading %q into %s", *dump, t.table)
+		return
+	}
+	f, err := openDump(*dump)
+	if err != nil {
+		log.Fatalf("open dump: %v", err)
+	}
+	defer f.Close()
+
+	db := connect()
+	defer db.close()
+	registerLoadReader()
+	logFile, err := openLog(logFilename, cp)
+	if err != nil {
+		log.Fatalf("open checkpoint log: %v", err)
+	}
+	defer logFile.Close()
+	if newFile {
+		if err := save(logFile, logLine{File: *dump}); err != nil {
+			log.Fatalf("Error saving to log: %v", err)
+		}
+	} else if cp.Position > 0 {
+		log.Printf("resuming at offset %d of %q", cp.Position, *dump)
+	}
+	catchSignals()
+	startRun(f, cp.Position)
+	if err := loadFile(db, logFile, *dump, cp.Position, t, *tabChunkRows); err != nil {
+		closeLog(logFile)
+		recordRun("failed", cp.Position, err)
+		log.Fatalf("load %q: %v", *dump, err)
+	}
+	if err := closeLog(logFile); err != nil {
+		log.Fatalf("close checkpoint log: %v", err)
+	}
+	size, err := f.decompressedSize()
+	if err != nil {
+		log.Fatalf("dump size: %v", err)
+	}
+	recordRun("completed", size, nil)
+}
+
+// isTabData reports whether name is a data file of a mysqldump --tab
+// directory.
+func isTabData(name string) bool {
+	_, ok := tabTables[name]
+	return ok
+}
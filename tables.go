@@ -0,0 +1,235 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+var tableConcurrency = flag.Int("table-concurrency", 1, "With -format=mydumper or tab, import the data files of this many tables at once, in child processes each with the checkpoint log of its table")
+
+// tableFilesEnv is set in the environment of the child processes of
+// -table-concurrency to the data files they import, separated as in
+// PATH.
+const tableFilesEnv = "CLOUDSQL_IMPORT_TABLE_FILES"
+
+// tablePasswordEnv is set in the environment of the child processes of
+// -table-concurrency to the password read for -prompt, which they read
+// with -password-env.
+const tablePasswordEnv = "CLOUDSQL_IMPORT_TABLE_PASSWORD"
+
+// tableFlags are the flags the child processes of -table-concurrency do
+// not inherit, as they name the checkpoint log or an address or hook of
+// the parent, or prompt on a terminal the children do not have.
+var tableFlags = map[string]bool{
+	"checkpoint":        true,
+	"table-concurrency": true,
+	"metrics-addr":      true,
+	"status-addr":       true,
+	"notify-url":        true,
+	"prompt":            true,
+}
+
+// tableChildArgs returns the arguments of the child processes of
+// -table-concurrency, given the arguments args of this import, and the
+// variables to add to their environment. With -prompt, the password is
+// read once, here.
+func tableChildArgs(args []string) ([]string, []string) {
+	args = dropFlags(args, tableFlags)
+	var env []string
+	if *prompt {
+		password, err := readPassword()
+		if err != nil {
+			log.Fatalln("Error reading password:", err)
+		}
+		addSecret(string(password))
+		args = append(args, "-password-env", tablePasswordEnv)
+		env = append(env, tablePasswordEnv+"="+string(password))
+	}
+	return args, env
+}
+
+// dataTable returns the table of the data file name of a mydumper or
+// mysqldump --tab directory, or "" if name is not one.
+func dataTable(name string) string {
+	if t, ok := tabTables[name]; ok {
+		return t
+	}
+	return mydumperTables[name]
+}
+
+// concurrentTables reports whether data files are imported by child
+// processes, -table-concurrency at a time.
+func concurrentTables() bool {
+	return *tableConcurrency > 1 && os.Getenv(tableFilesEnv) == ""
+}
+
+// importTables imports the data files, grouped by table, in child
+// processes running -table-concurrency at a time. Each imports the
+// files of its table with a checkpoint log of its own, in the directory
+// named after the shared log, so that the tables resume independently.
+// It exits once all are done if any failed.
+func importTables(files []string) {
+	logName := checkpointName(files[0])
+	cp, err := recover(logName)
+	if err != nil {
+		log.Fatalf("recover from log: %v", err)
+	}
+	if cp.File == files[0] && cp.Position > 0 {
+		log.Fatalf("the import of %q was started without -table-concurrency; finish it without", files[0])
+	}
+	if cp.File != files[0] {
+		logFile, err := openLog(logName, cp)
+		if err != nil {
+			log.Fatalf("open checkpoint log: %v", err)
+		}
+		if err := save(logFile, logLine{File: files[0]}); err != nil {
+			log.Fatalf("Error saving to log: %v", err)
+		}
+		if err := closeLog(logFile); err != nil {
+			log.Fatalf("Error saving to log: %v", err)
+		}
+		logFile.Close()
+	}
+	dir := logName + ".d"
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Fatalf("-table-concurrency: %v", err)
+	}
+
+	var tables []string
+	byTable := map[string][]string{}
+	for _, f := range files {
+		t := dataTable(f)
+		if byTable[t] == nil {
+			tables = append(tables, t)
+		}
+		byTable[t] = append(byTable[t], f)
+	}
+	log.Printf("importing %d tables, %d at a time", len(tables), *tableConcurrency)
+
+	// SIGINT reaches the child processes from the terminal, and stops
+	// starting new ones; SIGTERM is passed on to them.
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	var (
+		mu      sync.Mutex
+		running = map[*exec.Cmd]bool{}
+		status  int
+	)
+	go func() {
+		for s := range signals {
+			mu.Lock()
+			if status == 0 {
+				status = exitInterrupted
+			}
+			if s == syscall.SIGTERM {
+				for cmd := range running {
+					cmd.Process.Signal(s)
+				}
+			}
+			mu.Unlock()
+		}
+	}()
+
+	args, env := tableChildArgs(os.Args[1:])
+	slots := make(chan struct{}, *tableConcurrency)
+	var wg sync.WaitGroup
+	for _, t := range tables {
+		slots <- struct{}{}
+		mu.Lock()
+		stopped := status != 0
+		mu.Unlock()
+		if stopped {
+			break
+		}
+		wg.Add(1)
+		go func(t string) {
+			defer func() { <-slots; wg.Done() }()
+			cmd := exec.Command(os.Args[0], append(args, "-checkpoint", filepath.Join(dir, t+".log"))...)
+			cmd.Env = append(append(os.Environ(), env...), tableFilesEnv+"="+strings.Join(byTable[t], string(os.PathListSeparator)), canaryEnv+"=1", tunedEnv+"=1")
+			cmd.Stdout = os.Stdout
+			cmd.Stderr = os.Stderr
+			if !jsonLog() {
+				cmd.Stderr = &prefixWriter{w: stderr, prefix: t + ": "}
+			}
+			err := cmd.Start()
+			if err == nil {
+				mu.Lock()
+				running[cmd] = true
+				mu.Unlock()
+				err = cmd.Wait()
+				mu.Lock()
+				delete(running, cmd)
+				mu.Unlock()
+			}
+			if err == nil {
+				log.Printf("%s: imported", t)
+				return
+			}
+			log.Printf("%s: %v", t, err)
+			mu.Lock()
+			if status == 0 || status == exitInterrupted {
+				status = 1
+				if exit, ok := err.(*exec.ExitError); ok && exit.ExitCode() > 0 {
+					status = exit.ExitCode()
+				}
+			}
+			mu.Unlock()
+		}(t)
+	}
+	wg.Wait()
+	mu.Lock()
+	defer mu.Unlock()
+	if status != 0 {
+		log.Printf("stopped importing the tables; run the same command again to resume")
+		os.Exit(status)
+	}
+}
+
+// prefixWriter writes the lines written to it to w, each preceded by
+// prefix.
+type prefixWriter struct {
+	w      io.Writer
+	prefix string
+	// line holds the start of a line not yet written.
+	line []byte
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.line = append(p.line, b...)
+	for {
+		i := bytes.IndexByte(p.line, '\n')
+		if i < 0 {
+			return len(b), nil
+		}
+		if _, err := fmt.Fprintf(p.w, "%s%s", p.prefix, p.line[:i+1]); err != nil {
+			return 0, err
+		}
+		p.line = p.line[i+1:]
+	}
+}
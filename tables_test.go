@@ -0,0 +1,64 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestTableChildArgsPrompt(t *testing.T) {
+	defer func(p bool, stdin *os.File) {
+		*prompt, os.Stdin, promptedPassword = p, stdin, nil
+	}(*prompt, os.Stdin)
+	stdin, err := ioutil.TempFile("", "stdin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(stdin.Name())
+	if _, err := stdin.WriteString("s3cret\n"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stdin.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	*prompt, os.Stdin = true, stdin
+
+	args, env := tableChildArgs([]string{"-prompt", "-dsn", "user@tcp(10.0.0.1:3306)/", "-table-concurrency", "4", "-format=mydumper"})
+	wantArgs := []string{"-dsn", "user@tcp(10.0.0.1:3306)/", "-format=mydumper", "-password-env", tablePasswordEnv}
+	if !reflect.DeepEqual(args, wantArgs) {
+		t.Errorf("args = %q, want %q", args, wantArgs)
+	}
+	if want := []string{tablePasswordEnv + "=s3cret"}; !reflect.DeepEqual(env, want) {
+		t.Errorf("env = %q, want %q", env, want)
+	}
+	if bytes.Contains(redact([]byte("password s3cret")), []byte("s3cret")) {
+		t.Errorf("the prompted password is not redacted")
+	}
+
+	// A child, started with the arguments and environment above,
+	// takes the password from the environment.
+	defer func(e string) { *passwordEnv = e }(*passwordEnv)
+	*prompt, *passwordEnv = false, tablePasswordEnv
+	defer os.Unsetenv(tablePasswordEnv)
+	os.Setenv(tablePasswordEnv, "s3cret")
+	if p, ok := flagPassword(); !ok || p != "s3cret" {
+		t.Errorf("flagPassword() = %q, %v in the child, want %q, true", p, ok, "s3cret")
+	}
+}
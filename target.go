@@ -0,0 +1,272 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+var (
+	failover        = flag.Bool("failover", false, "Reconnect and resume when the connection to MySQL is lost, as during a Cloud SQL failover")
+	failoverDsn     = flag.String("failover_dsn", "", "MySQL Data Source Name to try when reconnecting after a failover, e.g. the instance's other endpoint (implies -failover)")
+	failoverTimeout = flag.Duration("failover_timeout", 10*time.Minute, "How long to keep trying to reconnect after a failover")
+)
+
+// sessionParams returns the DSN parameters setting the session
+// variables that the import modes require. The driver sets them on
+// every connection, including the ones opened after a failover.
+func sessionParams() []string {
+	var params []string
+	if *deferForeignKeys && !*fastImport {
+		params = append(params, "foreign_key_checks=0")
+	}
+	params = append(params, fastImportParams()...)
+	if *batchSize > 1 {
+		params = append(params, "multiStatements=true")
+	}
+	return params
+}
+
+// target is the MySQL server the dump is replayed to.
+type target struct {
+	db *sql.DB
+	// dsns are the DSNs to connect to, in order of preference.
+	dsns []string
+	// session holds the session statements replayed so far, which a
+	// new connection needs to execute again. sessionMu guards it for
+	// the connections the pool opens.
+	session   []string
+	sessionMu sync.Mutex
+}
+
+// openTarget opens the first of dsns.
+func openTarget(dsns []string) (*target, error) {
+	t := &target{dsns: dsns}
+	db, err := openDB(dsns[0], t.sessionStatements)
+	if err != nil {
+		return nil, err
+	}
+	t.db = db
+	return t, nil
+}
+
+func (t *target) close() error {
+	return t.db.Close()
+}
+
+// sessionStatement returns the statement replaying the dump statement
+// stmt executes if it is a session statement, such as SET NAMES or USE,
+// and "" otherwise. A session statement the filters skip is returned as
+// is, so that restoring the session skips it the same way, keeping
+// track of the current database.
+func sessionStatement(stmt []byte) string {
+	if !isSessionStatement(classify(stmt).Kind) {
+		return ""
+	}
+	if out := rewrite(stmt); out != nil {
+		stmt = out
+	}
+	return string(stmt)
+}
+
+// sessionStatements returns the session statements replayed so far.
+func (t *target) sessionStatements() []string {
+	t.sessionMu.Lock()
+	defer t.sessionMu.Unlock()
+	return append([]string(nil), t.session...)
+}
+
+// setSession records that the session statement stmt was executed.
+func (t *target) setSession(stmt string) {
+	t.sessionMu.Lock()
+	t.session = addToPrelude(t.session, stmt)
+	t.sessionMu.Unlock()
+}
+
+// restoreSession executes the session statements of a checkpoint, so
+// that the import resumes with the character set, database and checks
+// it had when it stopped.
+func (t *target) restoreSession(session []string) error {
+	if len(session) > 0 {
+		log.Printf("replaying %d session statements from the checkpoint", len(session))
+	}
+	t.sessionMu.Lock()
+	t.session = session
+	t.sessionMu.Unlock()
+	return replaySession(t.db, session)
+}
+
+// execer is a connection, or pool of connections, to the target.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// replaySession executes the session statements session on c, but for
+// those the filters skip.
+func replaySession(c execer, session []string) error {
+	for _, s := range session {
+		if rewrite([]byte(s)) == nil {
+			continue
+		}
+		if _, err := c.ExecContext(context.Background(), s); err != nil {
+			return fmt.Errorf("%q: %v", excerpt([]byte(s)), err)
+		}
+	}
+	return nil
+}
+
+// exec executes query. With -failover, when the connection is lost, it
+// reconnects and executes query again. Since query is the statement
+// following the last checkpoint, this is the same as resuming the
+// import from the checkpoint. Other transient errors are retried up
+// to -retries times, with exponential backoff.
+func (t *target) exec(query string) error {
+	t.refreshCredentials()
+	_, err := t.db.Exec(query)
+	if err != nil && (*failover || *failoverDsn != "") && isConnectionError(err) {
+		log.Printf("lost connection to MySQL: %v", err)
+		if err := t.reconnect(); err != nil {
+			return err
+		}
+		_, err = t.db.Exec(query)
+	}
+	for retry := 1; err != nil && isTransient(err) && retry < *maxAttempts; retry++ {
+		d := backoff(retry)
+		log.Printf("transient error, retrying in %v (attempt %d of %d): %v", d, retry+1, *maxAttempts, err)
+		time.Sleep(d)
+		if isConnectionError(err) {
+			// The pool replaces the lost connection with one that
+			// needs the session statements again.
+			if serr := replaySession(t.db, t.session); serr != nil {
+				log.Printf("restore session: %v", serr)
+				continue
+			}
+		}
+		_, err = t.db.Exec(query)
+	}
+	return err
+}
+
+// execBatch executes the transaction query, made of several statements,
+// on a single connection and without retrying it: after a lock wait
+// timeout, the statements before the failing one are still in the open
+// transaction, which a retried START TRANSACTION would commit. On
+// failure, the transaction is rolled back on the same connection, or
+// the connection discarded if that fails too.
+func (t *target) execBatch(query string) error {
+	t.refreshCredentials()
+	ctx := context.Background()
+	conn, err := t.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err = conn.ExecContext(ctx, query); err == nil {
+		return nil
+	}
+	if _, rerr := conn.ExecContext(ctx, "ROLLBACK"); rerr != nil {
+		log.Printf("roll back the batch: %v", rerr)
+		conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+	}
+	return err
+}
+
+// reconnect waits for the instance to be available again and connects
+// to the first of t.dsns that answers.
+func (t *target) reconnect() error {
+	deadline := time.Now().Add(*failoverTimeout)
+	for {
+		if *instanceName != "" {
+			if inst, err := getInstance(context.Background()); err != nil {
+				log.Printf("reconnect: cannot query the instance state: %v", err)
+			} else if inst.State != "RUNNABLE" {
+				log.Printf("reconnect: instance is %s", inst.State)
+			}
+		}
+		for i, dsn := range t.dsns {
+			db, err := openDB(dsn, t.sessionStatements)
+			if err == nil {
+				err = db.Ping()
+			}
+			if err == nil && isReadOnly(db) {
+				err = fmt.Errorf("server is read-only")
+			}
+			if err != nil {
+				if db != nil {
+					db.Close()
+				}
+				log.Printf("reconnect: DSN #%d: %v", i+1, err)
+				continue
+			}
+			if err := replaySession(db, t.session); err != nil {
+				db.Close()
+				log.Printf("reconnect: DSN #%d: %v", i+1, err)
+				continue
+			}
+			t.db.Close()
+			t.db = db
+			log.Printf("reconnected with DSN #%d, resuming from the checkpoint", i+1)
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("could not reconnect within %v", *failoverTimeout)
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// isReadOnly reports whether db is a read-only server, as the former
+// primary of an instance is while a failover completes.
+func isReadOnly(db *sql.DB) bool {
+	var ro bool
+	return db.QueryRow("SELECT @@global.read_only").Scan(&ro) == nil && ro
+}
+
+// isConnectionError reports whether err means that the connection to
+// the server was lost, rather than that a statement failed.
+func isConnectionError(err error) bool {
+	if err == driver.ErrBadConn || err == mysql.ErrInvalidConn || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	if merr, ok := err.(*mysql.MySQLError); ok {
+		switch merr.Number {
+		case 1053, // ER_SERVER_SHUTDOWN
+			1290, // ER_OPTION_PREVENTS_STATEMENT, when the server became read-only
+			1836: // ER_READ_ONLY_MODE
+			return true
+		}
+		return false
+	}
+	s := err.Error()
+	return strings.Contains(s, "connection refused") ||
+		strings.Contains(s, "broken pipe") ||
+		strings.Contains(s, "connection reset")
+}
@@ -0,0 +1,58 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"flag"
+	"log"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloudsql-import/importer"
+)
+
+var telemetryInterval = flag.Duration("telemetry-interval", 0, "Log the memory use, buffer sizes, goroutines and garbage collections of the process at this interval, alongside progress")
+
+// replayReader is the reader of the statements being replayed, whose
+// buffer grows to the size of the largest multi-line statement.
+var replayReader *importer.Reader
+
+var lastTelemetry time.Time
+
+// logTelemetry logs the resource use of the process if
+// -telemetry-interval has elapsed since it last did. It is called as
+// statements are replayed, so that the figures appear next to the
+// progress.
+func logTelemetry() {
+	if *telemetryInterval <= 0 || time.Since(lastTelemetry) < *telemetryInterval {
+		return
+	}
+	lastTelemetry = time.Now()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	var reader int
+	if replayReader != nil {
+		reader = replayReader.Buffered()
+	}
+	log.Printf("telemetry: heap %s in use, %s from the OS, %d goroutines, %d GCs %dms paused, buffers: statement %s, tee %s, checkpoint %s",
+		mb(m.HeapInuse), mb(m.Sys), runtime.NumGoroutine(), m.NumGC, m.PauseTotalNs/uint64(time.Millisecond),
+		mb(uint64(reader)), mb(uint64(cap(teeBuf))), mb(uint64(cap(saveBuf))))
+}
+
+func mb(n uint64) string {
+	return strconv.FormatFloat(float64(n)/(1<<20), 'f', 1, 64) + "MB"
+}
@@ -0,0 +1,84 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	maxQPS         = flag.Float64("max-qps", 0, "Execute at most this many statements per second, so as not to starve the live workload of the target (0 for no limit)")
+	maxBytesPerSec byteSize
+)
+
+func init() {
+	flag.Var(&maxBytesPerSec, "max-bytes-per-sec", "Send at most this many bytes of statements per second (e.g. 10MB; 0 for no limit)")
+}
+
+// throttle paces the statements of all connections to -max-qps and
+// -max-bytes-per-sec.
+var throttle struct {
+	sync.Mutex
+	// next is when the next statement may be executed.
+	next time.Time
+}
+
+// waitTurn sleeps until n statements of the given bytes, executed in
+// one round trip, may be executed within the rate limits and the lag
+// of the replicas. Time left
+// unused while the replay was slower than the limits is not saved up
+// for bursts.
+func waitTurn(n, bytes int) {
+	waitForReplicas()
+	if *maxQPS <= 0 && maxBytesPerSec <= 0 {
+		return
+	}
+	var d time.Duration
+	if *maxQPS > 0 {
+		d = time.Duration(float64(n) / *maxQPS * float64(time.Second))
+	}
+	if maxBytesPerSec > 0 {
+		if b := time.Duration(float64(bytes) / float64(maxBytesPerSec) * float64(time.Second)); b > d {
+			d = b
+		}
+	}
+	throttle.Lock()
+	now := time.Now()
+	if throttle.next.Before(now) {
+		throttle.next = now
+	}
+	at := throttle.next
+	throttle.next = at.Add(d)
+	throttle.Unlock()
+	time.Sleep(time.Until(at))
+}
+
+// throttleLimits describes the rate limits for the progress report, or
+// returns "" if there are none.
+func throttleLimits() string {
+	var limits []string
+	if *maxQPS > 0 {
+		limits = append(limits, fmt.Sprintf("%g statements/s", *maxQPS))
+	}
+	if maxBytesPerSec > 0 {
+		limits = append(limits, humanSize(int64(maxBytesPerSec))+"/s")
+	}
+	return strings.Join(limits, ", ")
+}
@@ -0,0 +1,191 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/pkcs12"
+)
+
+var (
+	sslP12         = flag.String("ssl_p12", "", "MySQL Client PKCS#12 (.p12/.pfx) bundle, used instead of -ssl_cert and -ssl_key")
+	sslP12Password = flag.String("ssl_p12_password", "", "Passphrase of the -ssl_p12 bundle")
+	sslCaPem       = flag.String("ssl_ca_pem", "", "MySQL Server certificate contents, as PEM or base64-encoded PEM, instead of -ssl_ca (default $CLOUDSQL_IMPORT_SSL_CA)")
+	sslCertPem     = flag.String("ssl_cert_pem", "", "MySQL Client certificate contents, as PEM or base64-encoded PEM, instead of -ssl_cert (default $CLOUDSQL_IMPORT_SSL_CERT)")
+	sslKeyPem      = flag.String("ssl_key_pem", "", "MySQL Client key contents, as PEM or base64-encoded PEM, instead of -ssl_key (default $CLOUDSQL_IMPORT_SSL_KEY)")
+	sslMode        = choiceFlag("ssl-mode", "verify-identity", "How -enable_ssl verifies the server certificate; verify-identity also checks that it names -server_name, verify-ca only that it is signed by -ssl_ca", "verify-ca", "verify-identity")
+	sslSkipVerify  = flag.Bool("ssl-insecure-skip-verify", false, "Connect to MySQL with SSL without verifying the server certificate, so without -ssl_ca; insecure, for test instances with self-signed certificates only")
+)
+
+// sslEnabled reports whether the connection to MySQL uses SSL.
+func sslEnabled() bool {
+	return *enableSsl || *sslSkipVerify
+}
+
+// sslConfig returns the TLS configuration of the connections to MySQL.
+// With -ssl-insecure-skip-verify, the server certificate is not
+// verified and the client certificate is only presented if given.
+func sslConfig() (*tls.Config, error) {
+	cfg := &tls.Config{ServerName: *serverName}
+	if *sslSkipVerify {
+		log.Printf("WARNING: -ssl-insecure-skip-verify: the server certificate is not verified, so the connection to MySQL can be intercepted; only use it with test instances")
+		cfg.InsecureSkipVerify = true
+	} else {
+		pem, err := loadCA()
+		if err != nil {
+			return nil, fmt.Errorf("load CA certificate: %v", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if ok := cfg.RootCAs.AppendCertsFromPEM(pem); !ok {
+			return nil, errors.New("Failed to append CA certificate PEM.")
+		}
+		if *sslMode == "verify-ca" {
+			// The TLS package cannot verify the chain without the name,
+			// so verification is left to verifyChain.
+			cfg.InsecureSkipVerify = true
+			cfg.VerifyPeerCertificate = verifyChain(cfg.RootCAs)
+		}
+	}
+	if !*sslSkipVerify || clientCertGiven() {
+		cert, err := loadClientCert()
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// verifyChain returns a VerifyPeerCertificate function that checks that
+// the server certificate is signed by roots, whatever name it holds, as
+// the Cloud SQL Auth Proxy does.
+func verifyChain(roots *x509.CertPool) func([][]byte, [][]*x509.Certificate) error {
+	return func(raw [][]byte, _ [][]*x509.Certificate) error {
+		if len(raw) == 0 {
+			return errors.New("the server sent no certificate")
+		}
+		certs := make([]*x509.Certificate, len(raw))
+		for i, b := range raw {
+			c, err := x509.ParseCertificate(b)
+			if err != nil {
+				return fmt.Errorf("parse the server certificate: %v", err)
+			}
+			certs[i] = c
+		}
+		opts := x509.VerifyOptions{Roots: roots, Intermediates: x509.NewCertPool()}
+		for _, c := range certs[1:] {
+			opts.Intermediates.AddCert(c)
+		}
+		_, err := certs[0].Verify(opts)
+		return err
+	}
+}
+
+// clientCertGiven reports whether a client certificate is available,
+// from any of the sources of loadClientCert.
+func clientCertGiven() bool {
+	if *vaultTLSPath != "" || *sslP12 != "" || *sslCertPem != "" || os.Getenv("CLOUDSQL_IMPORT_SSL_CERT") != "" {
+		return true
+	}
+	_, err := os.Stat(*sslCert)
+	return err == nil
+}
+
+// pemMaterial returns the PEM data given inline by a flag or by the
+// environment variable env, falling back to the contents of file.
+// Inline data may be base64-encoded, which keeps it on a single line.
+func pemMaterial(inline, env, file string) ([]byte, error) {
+	if inline == "" {
+		inline = os.Getenv(env)
+	}
+	if inline == "" {
+		return ioutil.ReadFile(file)
+	}
+	if strings.HasPrefix(strings.TrimSpace(inline), "-----BEGIN") {
+		return []byte(inline), nil
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(inline))
+	if err != nil || !bytes.Contains(b, []byte("-----BEGIN")) {
+		return nil, fmt.Errorf("inline data for %s is neither PEM nor base64-encoded PEM", file)
+	}
+	return b, nil
+}
+
+// loadCA returns the PEM certificates of the server CA.
+func loadCA() ([]byte, error) {
+	if *vaultTLSPath != "" {
+		return vaultTLS("ca", "issuing_ca")
+	}
+	return pemMaterial(*sslCaPem, "CLOUDSQL_IMPORT_SSL_CA", *sslCa)
+}
+
+// loadClientCert loads the client identity presented to MySQL, from
+// Vault, from the -ssl_p12 bundle or from the -ssl_cert and -ssl_key
+// files.
+func loadClientCert() (tls.Certificate, error) {
+	if *vaultTLSPath != "" {
+		certPEM, err := vaultTLS("cert", "certificate")
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		keyPEM, err := vaultTLS("key", "private_key")
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		return tls.X509KeyPair(certPEM, keyPEM)
+	}
+	if *sslP12 == "" {
+		certPEM, err := pemMaterial(*sslCertPem, "CLOUDSQL_IMPORT_SSL_CERT", *sslCert)
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		keyPEM, err := pemMaterial(*sslKeyPem, "CLOUDSQL_IMPORT_SSL_KEY", *sslKey)
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		return tls.X509KeyPair(certPEM, keyPEM)
+	}
+	addSecret(*sslP12Password)
+	data, err := ioutil.ReadFile(*sslP12)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	blocks, err := pkcs12.ToPEM(data, *sslP12Password)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	var certPEM, keyPEM []byte
+	for _, b := range blocks {
+		if b.Type == "CERTIFICATE" {
+			certPEM = append(certPEM, pem.EncodeToMemory(b)...)
+		} else {
+			keyPEM = append(keyPEM, pem.EncodeToMemory(b)...)
+		}
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
@@ -0,0 +1,103 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+// rewrite applies the configured filters and rewrites to the statement
+// stmt before it is replayed. It returns nil when stmt must be skipped.
+func rewrite(stmt []byte) []byte {
+	if (*deferForeignKeys || *fastImport) && setsForeignKeyChecks(stmt) || *fastImport && setsUniqueChecks(stmt) {
+		return nil
+	}
+	if filteredOut(stmt) || skippedKind(stmt) {
+		return nil
+	}
+	return applyRules(rewriteFor80(rewriteColumns(renameDatabase(renameTables(stripDefiners(stmt))))))
+}
+
+// subcommandFlags returns a flag set for the named subcommand that also
+// accepts every global flag, so that the rules configured for an import
+// apply identically to the subcommand.
+func subcommandFlags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	flag.VisitAll(func(f *flag.Flag) {
+		fs.Var(f.Value, f.Name, f.Usage)
+	})
+	return fs
+}
+
+// parseInterspersed parses args with fs, allowing positional arguments
+// to appear before, between or after the flags. It returns the
+// positional arguments.
+func parseInterspersed(fs *flag.FlagSet, args []string) []string {
+	var pos []string
+	for {
+		fs.Parse(args)
+		args = fs.Args()
+		if len(args) == 0 {
+			setLogFormat()
+			return pos
+		}
+		pos = append(pos, args[0])
+		args = args[1:]
+	}
+}
+
+// transformCmd implements "cloudsql-import transform in.sql -out out.sql",
+// which writes the statements that an import of in.sql would execute to
+// out.sql, without connecting to any database.
+func transformCmd(args []string) {
+	fs := subcommandFlags("transform")
+	out := fs.String("out", "", "Output file for the transformed dump")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s transform [flags] in.sql -out out.sql\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	in := parseInterspersed(fs, args)
+	if len(in) != 1 || *out == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	transformDump(in[0], *out)
+}
+
+// transformDump replays the dump in to the file out instead of a database.
+func transformDump(in, out string) {
+	f, err := openDump(in)
+	if err != nil {
+		log.Fatalf("open dump: %v", err)
+	}
+	defer f.Close()
+	size, err := f.Size()
+	if err != nil {
+		log.Fatalf("dump size: %v", err)
+	}
+
+	o, err := createOutput(out, false)
+	if err != nil {
+		log.Fatalf("create output: %v", err)
+	}
+	detectPacketLimit(nil)
+	run(nil, o, f, 0, size, nil)
+	if err := o.Close(); err != nil {
+		log.Fatalf("Close: %v", err)
+	}
+}
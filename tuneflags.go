@@ -0,0 +1,222 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+var tuneFlags = flag.Bool("tune-flags", false, "With -instance, set database flags that speed up bulk loads on the instance for the duration of the import, and restore the original flags afterwards")
+
+// bulkLoadFlags are the database flags set by -tune-flags. They trade
+// durability of the last transactions on a crash, which a resumable
+// import does not need, for fewer disk flushes.
+var bulkLoadFlags = []databaseFlag{
+	{Name: "innodb_flush_log_at_trx_commit", Value: "2"},
+	{Name: "sync_binlog", Value: "0"},
+}
+
+// tunedEnv is set in the environment of the import that runs with the
+// flags tuned, so that it does not tune them again.
+const tunedEnv = "CLOUDSQL_IMPORT_TUNED"
+
+// operationPollInterval is how often a pending Admin API operation is
+// checked.
+const operationPollInterval = 5 * time.Second
+
+// importWithTunedFlags tunes the flags of the instance, runs the import
+// as a child process, and restores the flags whatever way the import
+// ends. The original flags are kept in "<dump>.flags.json" until they
+// are restored, so that a run killed before restoring them restores
+// them when it is started again. It returns the exit status of the
+// import.
+func importWithTunedFlags() int {
+	if *instanceName == "" {
+		log.Fatalf("-tune-flags requires -instance")
+	}
+	ctx := context.Background()
+	stateFile := filepath.Base(*dump) + ".flags.json"
+	var original []databaseFlag
+	if b, err := ioutil.ReadFile(stateFile); err == nil {
+		if err := json.Unmarshal(b, &original); err != nil {
+			log.Fatalf("%s: %v", stateFile, err)
+		}
+		log.Printf("tune-flags: original flags recovered from %q", stateFile)
+	} else if os.IsNotExist(err) {
+		inst, err := getInstance(ctx)
+		if err != nil {
+			log.Fatalf("tune-flags: %v", err)
+		}
+		original = inst.Settings.DatabaseFlags
+		b, err := json.Marshal(original)
+		if err != nil {
+			log.Fatalf("json.Marshal: %v", err)
+		}
+		if err := ioutil.WriteFile(stateFile, b, 0644); err != nil {
+			log.Fatalf("tune-flags: %v", err)
+		}
+	} else {
+		log.Fatalf("tune-flags: %v", err)
+	}
+
+	tuned := append([]databaseFlag(nil), bulkLoadFlags...)
+	for _, f := range original {
+		if !hasFlag(bulkLoadFlags, f.Name) {
+			tuned = append(tuned, f)
+		}
+	}
+	log.Printf("tune-flags: setting %v", bulkLoadFlags)
+	if err := setDatabaseFlags(ctx, tuned); err != nil {
+		log.Printf("tune-flags: %v", err)
+		restoreDatabaseFlags(ctx, original, stateFile)
+		return 1
+	}
+
+	// Interrupting the import must not interrupt restoring the flags:
+	// the child process sees the signals as well and exits.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Env = append(os.Environ(), tunedEnv+"=1")
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	status := 0
+	if err := cmd.Start(); err != nil {
+		log.Printf("tune-flags: %v", err)
+		status = 1
+	} else {
+		go func() {
+			for s := range signals {
+				cmd.Process.Signal(s)
+			}
+		}()
+		if err := cmd.Wait(); err != nil {
+			log.Printf("tune-flags: import: %v", err)
+			status = 1
+			if exit, ok := err.(*exec.ExitError); ok && exit.ExitCode() > 0 {
+				status = exit.ExitCode()
+			}
+		}
+	}
+	if !restoreDatabaseFlags(ctx, original, stateFile) && status == 0 {
+		status = 1
+	}
+	return status
+}
+
+// hasFlag reports whether flags sets the flag name.
+func hasFlag(flags []databaseFlag, name string) bool {
+	for _, f := range flags {
+		if f.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// restoreDatabaseFlags sets the flags of the instance back to original
+// and removes stateFile once they are.
+func restoreDatabaseFlags(ctx context.Context, original []databaseFlag, stateFile string) bool {
+	log.Printf("tune-flags: restoring the original flags %v", original)
+	if err := setDatabaseFlags(ctx, original); err != nil {
+		log.Printf("tune-flags: cannot restore the flags, they are kept in %q: %v", stateFile, err)
+		return false
+	}
+	os.Remove(stateFile)
+	return true
+}
+
+// setDatabaseFlags replaces the database flags of the -instance
+// instance with flags, and waits for the change to be applied.
+func setDatabaseFlags(ctx context.Context, flags []databaseFlag) error {
+	url, err := sqlAdminURL()
+	if err != nil {
+		return err
+	}
+	if flags == nil {
+		// An empty list, rather than null, clears the flags.
+		flags = []databaseFlag{}
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"settings": map[string]interface{}{"databaseFlags": flags},
+	})
+	if err != nil {
+		return err
+	}
+	var op struct {
+		SelfLink string
+		Status   string
+		Error    *struct {
+			Errors []struct{ Code, Message string }
+		}
+	}
+	req, err := http.NewRequest("PATCH", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := adminDo(ctx, req, &op); err != nil {
+		return err
+	}
+	for op.Status != "DONE" {
+		time.Sleep(operationPollInterval)
+		req, err := http.NewRequest("GET", op.SelfLink, nil)
+		if err != nil {
+			return err
+		}
+		if err := adminDo(ctx, req, &op); err != nil {
+			return err
+		}
+	}
+	if op.Error != nil && len(op.Error.Errors) > 0 {
+		return fmt.Errorf("%s: %s", op.Error.Errors[0].Code, op.Error.Errors[0].Message)
+	}
+	return nil
+}
+
+// adminDo sends the Admin API request req and decodes its response
+// into v.
+func adminDo(ctx context.Context, req *http.Request, v interface{}) error {
+	client, err := googleClient(ctx, scopeCloudPlatform)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: %s: %s", req.Method, req.URL, resp.Status, b)
+	}
+	return json.Unmarshal(b, v)
+}
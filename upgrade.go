@@ -0,0 +1,153 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"flag"
+	"log"
+	"regexp"
+	"strings"
+)
+
+var (
+	mysql80Rewrites = flag.Bool("mysql80-rewrites", false, "Rewrite what MySQL 8.0 rejects in MySQL 5.7 dumps: remove the sql_modes it dropped and quote identifiers that became reserved words, and warn about removed features")
+	utf8As          = choiceFlag("utf8-as", "keep", "Character set that utf8 and its collations become, outside of INSERT statements", "keep", "utf8mb3", "utf8mb4")
+)
+
+// removedSQLModes are the sql_modes that MySQL 8.0 removed.
+var removedSQLModes = map[string]bool{
+	"NO_AUTO_CREATE_USER": true,
+	"DB2":                 true,
+	"MAXDB":               true,
+	"MSSQL":               true,
+	"MYSQL323":            true,
+	"MYSQL40":             true,
+	"ORACLE":              true,
+	"POSTGRESQL":          true,
+	"NO_FIELD_OPTIONS":    true,
+	"NO_KEY_OPTIONS":      true,
+	"NO_TABLE_OPTIONS":    true,
+}
+
+// reserved80 are the words that became reserved in MySQL 8.0. FUNCTION
+// and ROW are left out: they are keywords of statements that MySQL 5.7
+// dumps contain, such as CREATE FUNCTION and FOR EACH ROW.
+var reserved80 = map[string]bool{
+	"ARRAY": true, "CUBE": true, "CUME_DIST": true, "DENSE_RANK": true, "EMPTY": true,
+	"EXCEPT": true, "FIRST_VALUE": true, "GROUPING": true, "GROUPS": true, "JSON_TABLE": true,
+	"LAG": true, "LAST_VALUE": true, "LATERAL": true, "LEAD": true, "MEMBER": true,
+	"NTH_VALUE": true, "NTILE": true, "OF": true, "OVER": true, "PERCENT_RANK": true,
+	"RANK": true, "RECURSIVE": true, "ROWS": true, "ROW_NUMBER": true, "SYSTEM": true,
+	"WINDOW": true,
+}
+
+// removedFeatures match uses of the features that MySQL 8.0 removed.
+var removedFeatures = []struct {
+	re      *regexp.Regexp
+	feature string
+}{
+	{regexp.MustCompile(`(?i)\bPASSWORD\s*\(`), "the PASSWORD() function"},
+	{regexp.MustCompile(`(?i)\b(?:ENCODE|DECODE|ENCRYPT|DES_ENCRYPT|DES_DECRYPT)\s*\(`), "the ENCODE(), DECODE(), ENCRYPT(), DES_ENCRYPT() and DES_DECRYPT() functions"},
+	{regexp.MustCompile(`(?i)\bSQL_CACHE\b|\bquery_cache_\w+`), "the query cache"},
+	{regexp.MustCompile(`(?is)^GRANT\b.*\bIDENTIFIED\s+BY\b`), "creating users with GRANT ... IDENTIFIED BY"},
+	{regexp.MustCompile(`(?i)\bPROCEDURE\s+ANALYSE\b`), "PROCEDURE ANALYSE()"},
+	{regexp.MustCompile(`(?is)\bENGINE\s*=\s*MyISAM\b.*\bPARTITION\s+BY\b`), "partitioned MyISAM tables"},
+}
+
+var warnedFeatures = map[string]bool{}
+
+var (
+	sqlModeValue = regexp.MustCompile(`(?i)(sql_mode\s*=\s*')([^']*)'`)
+	utf8Name     = regexp.MustCompile(`(?i)\butf8(_\w+)?\b`)
+)
+
+// rewriteFor80 applies -mysql80-rewrites and -utf8-as to stmt. INSERT
+// and REPLACE statements are left alone, since only their data could
+// match.
+func rewriteFor80(stmt []byte) []byte {
+	if !*mysql80Rewrites && *utf8As == "keep" {
+		return stmt
+	}
+	kind := classify(stmt).Kind
+	if kind == "INSERT" || kind == "REPLACE" {
+		return stmt
+	}
+	if *utf8As != "keep" {
+		stmt = utf8Name.ReplaceAll(stmt, []byte(*utf8As+"$1"))
+	}
+	if !*mysql80Rewrites {
+		return stmt
+	}
+	if kind == "SET" {
+		return sqlModeValue.ReplaceAllFunc(stmt, removeSQLModes)
+	}
+	for _, f := range removedFeatures {
+		if !warnedFeatures[f.feature] && f.re.Match(stmt) {
+			warnedFeatures[f.feature] = true
+			log.Printf("WARNING: MySQL 8.0 removed %s, which %q uses", f.feature, excerpt(stmt))
+		}
+	}
+	return quoteReserved(stmt)
+}
+
+// removeSQLModes removes the sql_modes MySQL 8.0 dropped from the
+// assignment m matched by sqlModeValue.
+func removeSQLModes(m []byte) []byte {
+	sub := sqlModeValue.FindSubmatch(m)
+	var modes []string
+	for _, mode := range strings.Split(string(sub[2]), ",") {
+		if !removedSQLModes[strings.ToUpper(strings.TrimSpace(mode))] {
+			modes = append(modes, mode)
+		}
+	}
+	return []byte(string(sub[1]) + strings.Join(modes, ",") + "'")
+}
+
+// quoteReserved quotes the words of stmt that became reserved in MySQL
+// 8.0. Since MySQL 5.7 has no syntax using them, they are identifiers,
+// unless they are followed by "(" as function calls are.
+func quoteReserved(stmt []byte) []byte {
+	var out []byte
+	last := 0
+	for i := 0; i < len(stmt); i++ {
+		c := stmt[i]
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			if i = closingQuote(stmt, i); i < 0 {
+				return stmt
+			}
+		case isIdentByte(c):
+			j := i
+			for j < len(stmt) && isIdentByte(stmt[j]) {
+				j++
+			}
+			word := stmt[i:j]
+			k := j
+			for k < len(stmt) && isSpace(stmt[k]) {
+				k++
+			}
+			if reserved80[strings.ToUpper(string(word))] && (i == 0 || stmt[i-1] != '@') && (k == len(stmt) || stmt[k] != '(') {
+				out = append(append(append(append(out, stmt[last:i]...), '`'), word...), '`')
+				last = j
+			}
+			i = j - 1
+		}
+	}
+	if out == nil {
+		return stmt
+	}
+	return append(out, stmt[last:]...)
+}
@@ -0,0 +1,147 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+
+	"github.com/GoogleCloudPlatform/cloudsql-import/importer"
+)
+
+var definerClause = regexp.MustCompile(`(?i)\bDEFINER\s*=`)
+
+// validateCmd implements "cloudsql-import validate dump.sql", which scans
+// a dump without connecting to a database and reports the statements the
+// import would fail on. It exits with status 1 if it finds any.
+func validateCmd(args []string) {
+	fs := subcommandFlags("validate")
+	var maxSize byteSize = driverMaxPacket
+	fs.Var(&maxSize, "max-statement-size", "Report statements larger than this that cannot be split (the server's max_allowed_packet)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s validate [flags] dump.sql\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	in := parseInterspersed(fs, args)
+	if len(in) != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	f, err := openDump(in[0])
+	if err != nil {
+		log.Fatalf("validate: %v", err)
+	}
+	defer f.Close()
+
+	problems, statements := 0, 0
+	report := func(pos int64, stmt []byte, format string, args ...interface{}) {
+		problems++
+		fmt.Printf("offset %d: %s: %s\n", pos, fmt.Sprintf(format, args...), excerpt(stmt))
+	}
+	r := newStmtReader(f, 0)
+	for {
+		stmt, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err == importer.ErrUnterminated {
+			problems++
+			fmt.Printf("offset %d: a quote or comment of the statement is never closed; the rest of the dump would be read as part of it\n", r.Start)
+			break
+		}
+		if err == importer.ErrTruncated {
+			problems++
+			fmt.Printf("offset %d: the last statement of the dump does not end with a \";\"; it would not be replayed\n", r.Start)
+			break
+		}
+		if err != nil {
+			log.Fatalf("validate: read %q: %v", in[0], err)
+		}
+		statements++
+		for _, p := range statementProblems(stmt, int(maxSize), r.Delimiter() != ";") {
+			report(r.Start, stmt, "%s", p)
+		}
+	}
+
+	fmt.Printf("%d statements, %d problems\n", statements, problems)
+	if problems > 0 {
+		os.Exit(1)
+	}
+}
+
+// statementProblems returns the reasons why stmt, as split by stmtReader,
+// would fail to import. A routine read from a DELIMITER block holds
+// several statements.
+func statementProblems(stmt []byte, maxSize int, routine bool) []string {
+	var problems []string
+	switch end := statementEnd(stmt); {
+	case routine:
+		// The statements of its body are sent together.
+	case end >= 0 && len(bytes.TrimSpace(stmt[end+1:])) > 0:
+		problems = append(problems, "several statements on one line; only one statement is sent at a time")
+	}
+	if definerClause.Match(stmt) && !*stripDefiner {
+		problems = append(problems, "DEFINER clause; Cloud SQL rejects it unless the user has the SUPER privilege")
+	}
+	if len(stmt) > maxSize && !splittable(stmt, maxSize) {
+		problems = append(problems, fmt.Sprintf("statement of %d bytes is larger than %d bytes and cannot be split", len(stmt), maxSize))
+	}
+	return problems
+}
+
+// statementEnd returns the index of the first ";" of stmt outside quotes
+// and comments, or -1 if stmt ends inside a quoted string.
+func statementEnd(stmt []byte) int {
+	for i := 0; i < len(stmt); i++ {
+		switch stmt[i] {
+		case '\'', '"', '`':
+			if i = closingQuote(stmt, i); i < 0 {
+				return -1
+			}
+		case '/':
+			if i+1 < len(stmt) && stmt[i+1] == '*' && (i+2 >= len(stmt) || stmt[i+2] != '!') {
+				end := bytes.Index(stmt[i+2:], []byte("*/"))
+				if end < 0 {
+					return len(stmt) - 1
+				}
+				i += end + 3
+			}
+		case ';':
+			return i
+		}
+	}
+	return len(stmt) - 1
+}
+
+// splittable reports whether the INSERT or REPLACE statement stmt can be
+// split into statements of at most limit bytes.
+func splittable(stmt []byte, limit int) bool {
+	parts := splitRows(stmt, limit)
+	if parts == nil {
+		return false
+	}
+	for _, p := range parts {
+		if len(p) > limit {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,260 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+var (
+	vaultAddr     = flag.String("vault-addr", "", "Address of the HashiCorp Vault server (default $VAULT_ADDR)")
+	vaultToken    = flag.String("vault-token", "", "Vault token (default $VAULT_TOKEN), unless logging in with -vault-role-id")
+	vaultRoleID   = flag.String("vault-role-id", "", "Vault AppRole role ID to log in with (default $VAULT_ROLE_ID)")
+	vaultSecretID = flag.String("vault-secret-id", "", "Vault AppRole secret ID to log in with (default $VAULT_SECRET_ID)")
+	vaultPath     = flag.String("vault-path", "", "Vault path of the MySQL username and password, such as a database secrets engine role (database/creds/importer) or a KV secret")
+	vaultTLSPath  = flag.String("vault-tls-path", "", "Vault path of the SSL CA certificate, client certificate and key (fields ca, cert and key, or issuing_ca, certificate and private_key)")
+)
+
+// vaultSecret is a response of the Vault HTTP API.
+type vaultSecret struct {
+	LeaseID       string `json:"lease_id"`
+	LeaseDuration int    `json:"lease_duration"`
+	Renewable     bool
+	Data          map[string]interface{}
+	Auth          *struct {
+		ClientToken string `json:"client_token"`
+	}
+}
+
+func envDefault(v, env string) string {
+	if v == "" {
+		return os.Getenv(env)
+	}
+	return v
+}
+
+// vaultDo calls the Vault HTTP API, with the token given if it is not
+// empty.
+func vaultDo(method, path, token string, body interface{}) (*vaultSecret, error) {
+	addr := envDefault(*vaultAddr, "VAULT_ADDR")
+	if addr == "" {
+		return nil, fmt.Errorf("no Vault address; set -vault-addr or $VAULT_ADDR")
+	}
+	var in []byte
+	if body != nil {
+		var err error
+		if in, err = json.Marshal(body); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(addr, "/")+"/v1/"+strings.TrimPrefix(path, "/"), bytes.NewReader(in))
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("vault %s %s: %s: %s", method, path, resp.Status, b)
+	}
+	s := &vaultSecret{}
+	return s, json.Unmarshal(b, s)
+}
+
+// vaultLogin returns the Vault token to use: -vault-token, or one
+// obtained by logging in with the AppRole. Logging in again each time
+// keeps the token from expiring during a long import.
+func vaultLogin() (string, error) {
+	roleID := envDefault(*vaultRoleID, "VAULT_ROLE_ID")
+	if roleID == "" {
+		token := envDefault(*vaultToken, "VAULT_TOKEN")
+		addSecret(token)
+		return token, nil
+	}
+	secretID := envDefault(*vaultSecretID, "VAULT_SECRET_ID")
+	addSecret(secretID)
+	s, err := vaultDo("POST", "auth/approle/login", "", map[string]string{"role_id": roleID, "secret_id": secretID})
+	if err != nil {
+		return "", err
+	}
+	if s.Auth == nil {
+		return "", fmt.Errorf("vault AppRole login returned no token")
+	}
+	addSecret(s.Auth.ClientToken)
+	return s.Auth.ClientToken, nil
+}
+
+// vaultRead reads the secret at path, returning its string fields.
+func vaultRead(path string) (map[string]string, *vaultSecret, error) {
+	token, err := vaultLogin()
+	if err != nil {
+		return nil, nil, err
+	}
+	s, err := vaultDo("GET", path, token, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	data := s.Data
+	// Version 2 of the KV secrets engine nests the secret.
+	if inner, ok := data["data"].(map[string]interface{}); ok && data["metadata"] != nil {
+		data = inner
+	}
+	fields := map[string]string{}
+	for k, v := range data {
+		if s, ok := v.(string); ok {
+			fields[k] = s
+		}
+	}
+	return fields, s, nil
+}
+
+// vaultField returns the first of the named fields that is set.
+func vaultField(fields map[string]string, names ...string) (string, error) {
+	for _, n := range names {
+		if v := fields[n]; v != "" {
+			return v, nil
+		}
+	}
+	return "", fmt.Errorf("vault secret has no %s field", strings.Join(names, " or "))
+}
+
+// vaultLease is the lease of the credentials read from -vault-path, and
+// vaultRenewAt when it must be renewed, or zero if it need not be.
+var (
+	vaultLease   *vaultSecret
+	vaultRenewAt time.Time
+)
+
+// vaultCredentials reads the MySQL username and password at -vault-path.
+func vaultCredentials() (user, password string, err error) {
+	fields, s, err := vaultRead(*vaultPath)
+	if err != nil {
+		return "", "", err
+	}
+	if user, err = vaultField(fields, "username"); err != nil {
+		return "", "", err
+	}
+	if password, err = vaultField(fields, "password"); err != nil {
+		return "", "", err
+	}
+	addSecret(password)
+	vaultLease = s
+	setVaultRenewal(s.LeaseDuration)
+	return user, password, nil
+}
+
+// setVaultRenewal schedules the renewal of the credentials once two
+// thirds of their lease of the given seconds have elapsed.
+func setVaultRenewal(seconds int) {
+	vaultRenewAt = time.Time{}
+	if seconds > 0 {
+		vaultRenewAt = time.Now().Add(time.Duration(seconds) * time.Second * 2 / 3)
+	}
+}
+
+// withCredentials returns dsn with the given username and password.
+func withCredentials(dsn, user, password string) (string, error) {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return "", err
+	}
+	cfg.User, cfg.Passwd = user, password
+	return cfg.FormatDSN(), nil
+}
+
+// refreshCredentials renews the lease of the credentials read from
+// Vault when it is due. If the lease cannot be renewed, as when it
+// reached its maximum duration, new credentials are read and the
+// connections reopened with them.
+func (t *target) refreshCredentials() {
+	if vaultRenewAt.IsZero() || time.Now().Before(vaultRenewAt) {
+		return
+	}
+	if vaultLease.Renewable {
+		token, err := vaultLogin()
+		if err == nil {
+			var s *vaultSecret
+			s, err = vaultDo("PUT", "sys/leases/renew", token, map[string]string{"lease_id": vaultLease.LeaseID})
+			if err == nil && s.LeaseDuration > 0 {
+				log.Printf("renewed the Vault lease of the MySQL credentials for %ds", s.LeaseDuration)
+				setVaultRenewal(s.LeaseDuration)
+				return
+			}
+		}
+		log.Printf("cannot renew the Vault lease of the MySQL credentials, reading new ones: %v", err)
+	}
+
+	user, password, err := vaultCredentials()
+	if err == nil {
+		var dsns []string
+		for _, d := range t.dsns {
+			var nd string
+			if nd, err = withCredentials(d, user, password); err != nil {
+				break
+			}
+			dsns = append(dsns, nd)
+		}
+		if err == nil {
+			// The new pool needs the connector, pool settings and
+			// session of the import, as after a failover.
+			var db *sql.DB
+			if db, err = openDB(dsns[0], t.sessionStatements); err == nil {
+				if err = replaySession(db, t.sessionStatements()); err == nil {
+					t.db.Close()
+					t.db, t.dsns = db, dsns
+					log.Printf("reconnected with new MySQL credentials from Vault")
+					return
+				}
+				db.Close()
+			}
+		}
+	}
+	// Try again shortly; the current credentials may still be valid.
+	log.Printf("cannot refresh the MySQL credentials from Vault: %v", err)
+	vaultRenewAt = time.Now().Add(time.Minute)
+}
+
+// vaultTLS returns the PEM data of one of the names fields of the
+// secret at -vault-tls-path.
+func vaultTLS(names ...string) ([]byte, error) {
+	fields, _, err := vaultRead(*vaultTLSPath)
+	if err != nil {
+		return nil, err
+	}
+	v, err := vaultField(fields, names...)
+	return []byte(v), err
+}
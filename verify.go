@@ -0,0 +1,226 @@
+// Copyright 2014 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var verifySample = flag.Int("verify-sample", 0, "After the import, check that this many random rows of each table of the dump exist on the target with the same values")
+
+// exitSampleMismatch is the exit status of an import that completed but
+// whose sampled rows are missing or differ on the target.
+const exitSampleMismatch = 5
+
+// tableDef is the definition of a table, from its CREATE TABLE
+// statement in the dump.
+type tableDef struct {
+	database, table string
+	columns         []string
+	// comparable tells whether a column's values compare reliably to
+	// their literals in the dump.
+	comparable map[string]bool
+	primaryKey []string
+	rows       [][][]byte
+	seen       int
+}
+
+var (
+	columnPattern     = regexp.MustCompile("(?m)^\\s*(`(?:[^`]|``)+`)\\s+(\\w+)")
+	primaryKeyPattern = regexp.MustCompile(`(?is)PRIMARY\s+KEY\s*\(((?:[^()]|\(\d+\))*)\)`)
+	keyPartLength     = regexp.MustCompile(`\(\d+\)`)
+	insertColumns     = regexp.MustCompile(`(?is)^[^(]*\(([^)]*)\)\s*VALUES`)
+)
+
+// incomparableTypes are the column types whose values may not equal the
+// literal they were inserted with: approximate numbers, and values
+// stored in a different form.
+var incomparableTypes = map[string]bool{
+	"FLOAT": true, "DOUBLE": true, "REAL": true, "JSON": true,
+	"GEOMETRY": true, "POINT": true, "LINESTRING": true, "POLYGON": true,
+	"MULTIPOINT": true, "MULTILINESTRING": true, "MULTIPOLYGON": true, "GEOMETRYCOLLECTION": true,
+}
+
+// parseTableDef parses the CREATE TABLE statement stmt.
+func parseTableDef(info stmtInfo, stmt []byte) *tableDef {
+	t := &tableDef{database: info.Database, table: info.Table, comparable: map[string]bool{}}
+	body := stmt[bytes.IndexByte(stmt, '(')+1:]
+	for _, m := range columnPattern.FindAllSubmatch(body, -1) {
+		name := unquoteIdent(m[1])
+		t.columns = append(t.columns, name)
+		t.comparable[name] = !incomparableTypes[strings.ToUpper(string(m[2]))]
+	}
+	if m := primaryKeyPattern.FindSubmatch(body); m != nil {
+		t.primaryKey = identList(keyPartLength.ReplaceAll(m[1], nil))
+	}
+	return t
+}
+
+// sample keeps each row with the same probability, so that at most n
+// rows of the table are kept.
+func (t *tableDef) sample(row [][]byte, n int) {
+	t.seen++
+	if len(t.rows) < n {
+		t.rows = append(t.rows, row)
+	} else if i := rand.Intn(t.seen); i < n {
+		t.rows[i] = row
+	}
+}
+
+// sampleRows reads the dump r and returns its tables, with up to n of
+// the rows of each.
+func sampleRows(r io.Reader, n int) ([]*tableDef, error) {
+	var tables []*tableDef
+	byName := map[string]*tableDef{}
+	columns := map[*tableDef][]string{}
+	db := ""
+	sr := newStmtReader(r, 0)
+	for {
+		line, err := sr.Next()
+		if err == io.EOF {
+			return tables, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		stmt := rewrite(line)
+		if stmt == nil {
+			continue
+		}
+		info := classify(stmt)
+		if info.Database == "" {
+			info.Database = db
+		}
+		switch info.Kind {
+		case "USE":
+			db = info.Database
+		case "CREATE TABLE":
+			t := parseTableDef(info, stmt)
+			name := qualifiedName(t.database, t.table)
+			if byName[name] == nil {
+				tables = append(tables, t)
+			}
+			byName[name] = t
+		case "INSERT", "REPLACE":
+			t := byName[qualifiedName(info.Database, info.Table)]
+			if t == nil {
+				continue
+			}
+			prefix, rows, _ := insertRows(stmt)
+			if _, ok := columns[t]; !ok {
+				columns[t] = t.columns
+				if m := insertColumns.FindSubmatch(prefix); m != nil {
+					columns[t] = identList(m[1])
+				}
+				t.columns = columns[t]
+			}
+			for _, row := range rows {
+				values := rowValues(row)
+				if len(values) != len(t.columns) {
+					continue
+				}
+				// The reader reuses its buffer, so the values are copied.
+				for i, v := range values {
+					values[i] = append([]byte(nil), v...)
+				}
+				t.sample(values, n)
+			}
+		}
+	}
+}
+
+// check looks for row on the target. It returns "missing" if no row has
+// its primary key, or its values if the table has none, "different" if
+// the row with its primary key has other values, or "".
+func (t *tableDef) check(db *sql.DB, row [][]byte) (string, error) {
+	var match, key []string
+	for i, c := range t.columns {
+		cond := fmt.Sprintf("%s <=> %s", quoteIdent(c), row[i])
+		if t.comparable[c] {
+			match = append(match, cond)
+		}
+		for _, k := range t.primaryKey {
+			if k == c {
+				key = append(key, cond)
+			}
+		}
+	}
+	if len(match) == 0 {
+		match = []string{"TRUE"}
+	}
+	name := qualifiedName(t.database, t.table)
+	if len(key) == 0 || len(key) != len(t.primaryKey) {
+		var n int
+		err := db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s", name, strings.Join(match, " AND "))).Scan(&n)
+		if err != nil || n > 0 {
+			return "", err
+		}
+		return "missing", nil
+	}
+	var same bool
+	err := db.QueryRow(fmt.Sprintf("SELECT %s FROM %s WHERE %s", strings.Join(match, " AND "), name, strings.Join(key, " AND "))).Scan(&same)
+	switch {
+	case err == sql.ErrNoRows:
+		return "missing", nil
+	case err != nil:
+		return "", err
+	case !same:
+		return "different", nil
+	}
+	return "", nil
+}
+
+// verifySampledRows checks that -verify-sample random rows of each table
+// of the dump f exist on the target with the same values, and exits with
+// a distinct status if some do not.
+func verifySampledRows(db *target, f *dumpFile) {
+	rand.Seed(time.Now().UnixNano())
+	tables, err := sampleRows(f.from(0), *verifySample)
+	if err != nil {
+		log.Fatalf("sample rows: %v", err)
+	}
+	checked, failed := 0, 0
+	for _, t := range tables {
+		name := qualifiedName(t.database, t.table)
+		for _, row := range t.rows {
+			problem, err := t.check(db.db, row)
+			if err != nil {
+				log.Printf("check a row of %s: %v", name, err)
+				continue
+			}
+			checked++
+			if problem != "" {
+				failed++
+				log.Printf("MISMATCH: row (%s) of %s is %s on the target", excerpt(bytes.Join(row, []byte(","))), name, problem)
+			}
+		}
+	}
+	if failed > 0 {
+		log.Printf("%d of %d sampled rows are missing or different", failed, checked)
+		os.Exit(exitSampleMismatch)
+	}
+	log.Printf("all %d sampled rows of %d tables match", checked, len(tables))
+}